@@ -38,8 +38,8 @@ func Clear() {
 	}
 }
 
-func LoadParam(crc uint32, e interface{}) error {
-	file, err := os.Open(cache + "/" + fmt.Sprintf("%X", crc) + ".paramcache")
+func LoadParam(crc uint32, version int, e interface{}) error {
+	file, err := os.Open(cache + "/" + fileName(crc, version, "param"))
 	if err != nil {
 		return err
 	}
@@ -53,23 +53,12 @@ func LoadParam(crc uint32, e interface{}) error {
 	return nil
 }
 
-func SaveParam(crc uint32, e interface{}) error {
-	file, err := os.OpenFile(cache+"/"+fmt.Sprintf("%X", crc)+".paramcache", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	encoder := gob.NewEncoder(file)
-	err = encoder.Encode(e)
-	if err != nil {
-		return err
-	}
-	return nil
+func SaveParam(crc uint32, version int, e interface{}) error {
+	return save(fileName(crc, version, "param"), e)
 }
 
-func LoadLog(crc uint32, e interface{}) error {
-	file, err := os.Open(cache + "/" + fmt.Sprintf("%X", crc) + ".logcache")
+func LoadLog(crc uint32, version int, e interface{}) error {
+	file, err := os.Open(cache + "/" + fileName(crc, version, "log"))
 	if err != nil {
 		return err
 	}
@@ -83,17 +72,32 @@ func LoadLog(crc uint32, e interface{}) error {
 	return nil
 }
 
-func SaveLog(crc uint32, e interface{}) error {
-	file, err := os.OpenFile(cache+"/"+fmt.Sprintf("%X", crc)+".logcache", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+func SaveLog(crc uint32, version int, e interface{}) error {
+	return save(fileName(crc, version, "log"), e)
+}
+
+// fileName is the name of the cache of a TOC, by its CRC and the version of the TOC protocol it was downloaded with,
+// since the v1 protocol only reaches the first 255 items of a TOC and numbers them with 8-bit ids
+func fileName(crc uint32, version int, kind string) string {
+	return fmt.Sprintf("%X.v%d.%scache", crc, version, kind)
+}
+
+// save writes e to a temporary file which then replaces the cache file, such that the crazyflies connecting
+// at the same time with the same firmware never read a partially written cache
+func save(name string, e interface{}) error {
+	file, err := ioutil.TempFile(cache, name+".tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
 	encoder := gob.NewEncoder(file)
 	err = encoder.Encode(e)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(file.Name())
 		return err
 	}
-	return nil
+	return os.Rename(file.Name(), cache+"/"+name)
 }
@@ -0,0 +1,133 @@
+package crazyflie
+
+import (
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+	"github.com/mikehamer/crazyserver/internal/protocol"
+)
+
+// the number of times each broadcast is transmitted, since broadcasts are not acknowledged
+const defaultBroadcastRepeats = 3
+
+// high-level commander commands
+const (
+	commandTakeoff         = 1
+	commandLand            = 2
+	commandStop            = 3
+	commandStartTrajectory = 5
+)
+
+// localization (position port) generic channel packet types
+const (
+	localizationEmergencyStop = 3
+)
+
+// the position port channel of the packed external positions, which have no packet type
+const localizationExtPositionPackedChannel = 2
+
+// the packed positions (an id and three int16 millimeter coordinates each) fitting in a CRTP packet
+const maxPackedPositionsPerBroadcast = crtpMaxData / 7
+
+// PackedPosition is the external position of a single Crazyflie in a packed position broadcast,
+// the id being the last byte of the Crazyflie's address
+type PackedPosition struct {
+	ID      uint8
+	X, Y, Z float32 // meters
+}
+
+// Broadcaster sends unacknowledged commands to every Crazyflie listening on a channel and datarate,
+// such that a whole swarm receives a command at the same time.
+type Broadcaster struct {
+	Channel  uint8
+	Datarate crazyradio.RadioDatarate
+	Address  uint64
+	Repeats  int
+	Manager  *crazyradio.Manager // the Crazyradios transmitting the commands, crazyradio.DefaultManager if nil
+}
+
+func NewBroadcaster(channel uint8, datarate crazyradio.RadioDatarate) *Broadcaster {
+	return &Broadcaster{channel, datarate, crazyradio.BroadcastAddress, defaultBroadcastRepeats, crazyradio.DefaultManager}
+}
+
+func (b *Broadcaster) send(packet []byte) error {
+	manager := b.Manager
+	if manager == nil {
+		manager = crazyradio.DefaultManager
+	}
+	return manager.BroadcastSend(b.Channel, b.Datarate, b.Address, packet, b.Repeats)
+}
+
+// EmergencyStop immediately stops the motors of every Crazyflie
+func (b *Broadcaster) EmergencyStop() error {
+	return b.send([]byte{crtp(crtpPortPosition, 1), localizationEmergencyStop})
+}
+
+// Takeoff makes the Crazyflies in the group to take off to height (meters) over duration
+func (b *Broadcaster) Takeoff(groupMask uint8, height float32, duration time.Duration) error {
+	packet := make([]byte, 1+2+2*4)
+	packet[0] = crtp(crtpPortSetpointHL, 0)
+	packet[1] = commandTakeoff
+	packet[2] = groupMask
+	copy(packet[3:7], protocol.Float32ToBytes(height))
+	copy(packet[7:11], protocol.Float32ToBytes(float32(duration.Seconds())))
+	return b.send(packet)
+}
+
+// Land makes the Crazyflies in the group land to height (meters) over duration
+func (b *Broadcaster) Land(groupMask uint8, height float32, duration time.Duration) error {
+	packet := make([]byte, 1+2+2*4)
+	packet[0] = crtp(crtpPortSetpointHL, 0)
+	packet[1] = commandLand
+	packet[2] = groupMask
+	copy(packet[3:7], protocol.Float32ToBytes(height))
+	copy(packet[7:11], protocol.Float32ToBytes(float32(duration.Seconds())))
+	return b.send(packet)
+}
+
+// Stop stops the high-level commander of the Crazyflies in the group, cutting their motors
+func (b *Broadcaster) Stop(groupMask uint8) error {
+	return b.send([]byte{crtp(crtpPortSetpointHL, 0), commandStop, groupMask})
+}
+
+// StartTrajectory starts a previously uploaded trajectory synchronously on the Crazyflies in the group
+func (b *Broadcaster) StartTrajectory(groupMask uint8, trajectoryID uint8, timescale float32, relative bool, reversed bool) error {
+	packet := make([]byte, 1+5+4)
+	packet[0] = crtp(crtpPortSetpointHL, 0)
+	packet[1] = commandStartTrajectory
+	packet[2] = groupMask
+	if relative {
+		packet[3] = 1
+	}
+	if reversed {
+		packet[4] = 1
+	}
+	packet[5] = trajectoryID
+	copy(packet[6:10], protocol.Float32ToBytes(timescale))
+	return b.send(packet)
+}
+
+// ExternalPositionsSend broadcasts the external positions of many Crazyflies, packing up to four positions
+// (with millimeter resolution) in each packet
+func (b *Broadcaster) ExternalPositionsSend(positions []PackedPosition) error {
+	for start := 0; start < len(positions); start += maxPackedPositionsPerBroadcast {
+		end := start + maxPackedPositionsPerBroadcast
+		if end > len(positions) {
+			end = len(positions)
+		}
+
+		packet := []byte{crtp(crtpPortPosition, localizationExtPositionPackedChannel)}
+		for _, position := range positions[start:end] {
+			packet = append(packet, position.ID)
+			packet = append(packet, protocol.Int16ToBytes(int16(position.X*1000))...)
+			packet = append(packet, protocol.Int16ToBytes(int16(position.Y*1000))...)
+			packet = append(packet, protocol.Int16ToBytes(int16(position.Z*1000))...)
+		}
+
+		err := b.send(packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,8 +1,7 @@
 package crazyflie
 
 import (
-	"container/list"
-
+	"context"
 	"sync"
 	"time"
 
@@ -14,74 +13,107 @@ const statusTimeoutDuration time.Duration = 1 * time.Second
 func (cf *Crazyflie) communicationSystemInit() {
 	cf.disconnect = make(chan bool)
 	cf.waitGroup = &sync.WaitGroup{}
-	cf.statusTimeout = time.NewTimer(statusTimeoutDuration)
-
-	// setup the communication callbacks
-	cf.responseCallbacks = map[crtpPort](*list.List){
-		crtpPortConsole:  list.New(),
-		crtpPortParam:    list.New(),
-		crtpPortSetpoint: list.New(),
-		crtpPortMem:      list.New(),
-		crtpPortLog:      list.New(),
-		crtpPortPosition: list.New(),
-		crtpPortPlatform: list.New(),
-		crtpPortLink:     list.New(),
-		crtpPortEmpty1:   list.New(),
-		crtpPortEmpty2:   list.New(),
-		crtpPortGreedy:   list.New(),
-	}
+	statusTimeout := time.NewTimer(statusTimeoutDuration)
+	cf.statusLock.Lock()
+	cf.statusTimeout = statusTimeout // the callback of the previous connection may still be running
+	cf.statusLock.Unlock()
+
+	cf.dispatchSystemInit()
 
 	cf.waitGroup.Add(1)
-	go cf.statusTimeoutThread()
+	go cf.statusTimeoutThread(cf.disconnect, statusTimeout)
 }
 
-func (cf *Crazyflie) statusTimeoutThread() {
+func (cf *Crazyflie) statusTimeoutThread(disconnect chan bool, statusTimeout *time.Timer) {
 	defer cf.waitGroup.Done()
 
 	for {
 		select {
-		case <-cf.disconnect:
+		case <-disconnect:
+			statusTimeout.Stop()
 			return
-		case <-cf.statusTimeout.C:
-			cf.status = StatusNoResponse
-			cf.statusTimeout.Reset(time.Second)
+		case <-statusTimeout.C:
+			cf.setStatus(StatusNoResponse)
+			statusTimeout.Reset(time.Second)
 		}
 	}
 }
 
-func (cf *Crazyflie) PacketSend(packet []byte) {
-	crazyradio.PacketSend(cf.channel, cf.address, packet)
+// PacketSend queues a packet, returning an error if the link dropped it (eg. crazyradio.ErrorQueueFull)
+func (cf *Crazyflie) PacketSend(packet []byte) error {
+	return cf.link.PacketSend(cf.channel, cf.address, packet)
 }
 
 func (cf *Crazyflie) PacketSendPriority(packet []byte) {
-	crazyradio.PacketSendPriority(cf.channel, cf.address, packet)
+	cf.link.PacketSendPriority(cf.channel, cf.address, packet)
 }
 
-// Waits for the packet queues to be empty
-func (cf *Crazyflie) PacketQueueWaitForEmpty() {
-	crazyradio.PacketQueueWaitForEmpty(cf.channel, cf.address)
+// PacketSendDeadline schedules a packet with priority, which is dropped if it cannot be sent before the deadline
+func (cf *Crazyflie) PacketSendDeadline(packet []byte, deadline time.Time) {
+	if link, ok := cf.link.(DeadlineLink); ok {
+		link.PacketSendDeadline(cf.channel, cf.address, packet, deadline)
+	} else {
+		cf.link.PacketSendPriority(cf.channel, cf.address, packet)
+	}
 }
 
-func (cf *Crazyflie) responseHandler(resp []byte) {
-	cf.status = StatusConnected
-	cf.statusTimeout.Reset(statusTimeoutDuration)
+// the coalescing slots of the messages which are superseded by the next one, see PacketSendLatest
+const (
+	slotSetpoint uint8 = iota
+	slotPosition
+)
 
-	if len(resp) > 0 {
-		header := crtpHeader(resp[0])
+// PacketSendLatest schedules a packet as PacketSendDeadline, replacing the packet of the same slot which has not yet
+// been sent (if the link supports it), such that a message streamed faster than the link can carry is not delayed
+func (cf *Crazyflie) PacketSendLatest(slot uint8, packet []byte, deadline time.Time) {
+	if link, ok := cf.link.(LatestLink); ok {
+		link.PacketSendLatest(cf.channel, cf.address, slot, packet, deadline)
+	} else {
+		cf.PacketSendDeadline(packet, deadline)
+	}
+}
 
-		if header.port() == 0xF3 || header.port() == 0xF7 {
-			return // CF has nothing to report, indicate we can transmit at a lower frequency
-		}
+// SetBandwidthBudget limits the rate of the non real-time packets sent to the Crazyflie (0 for no limit),
+// such that eg. a TOC download does not slow down the other Crazyflies on the channel
+func (cf *Crazyflie) SetBandwidthBudget(packetsPerSecond float64) error {
+	link, ok := cf.link.(BudgetLink)
+	if !ok {
+		return ErrorNotSupported
+	}
+	return link.PacketQueueSetBudget(cf.channel, cf.address, packetsPerSecond)
+}
 
-		// call any registered callbacks for this port
-		for e := cf.responseCallbacks[header.port()].Front(); e != nil; e = e.Next() {
-			f := e.Value.(func(r []byte))
-			go f(resp) // TODO: send them copies? otherwise they can modify underlying data?
-		}
+// SetQueueDepth limits the number of non real-time packets queued for the Crazyflie (0 for no limit),
+// the packets sent while the queue is full are dropped and counted in the LinkStats
+func (cf *Crazyflie) SetQueueDepth(depth int) error {
+	link, ok := cf.link.(DepthLink)
+	if !ok {
+		return ErrorNotSupported
+	}
+	return link.PacketQueueSetDepth(cf.channel, cf.address, depth)
+}
 
-		for e := cf.responseCallbacks[crtpPortGreedy].Front(); e != nil; e = e.Next() {
-			f := e.Value.(func(r []byte))
-			go f(resp)
-		}
+// Waits for the packet queues to be empty, or for ctx to be done
+func (cf *Crazyflie) PacketQueueWaitForEmpty(ctx context.Context) error {
+	return cf.link.PacketQueueWaitForEmpty(ctx, cf.channel, cf.address)
+}
+
+// LinkStats returns the quality statistics of the link to the Crazyflie
+func (cf *Crazyflie) LinkStats() crazyradio.LinkStats {
+	return cf.link.LinkStats(cf.channel, cf.address)
+}
+
+// responseHandler is called by the link with every response of the Crazyflie, in the order they were received
+func (cf *Crazyflie) responseHandler(resp []byte) {
+	cf.statusLock.Lock()
+	cf.status = StatusConnected
+	cf.statusTimeout.Reset(statusTimeoutDuration)
+	cf.statusLock.Unlock()
+
+	// an acknowledgement without payload, or with only a null packet header (0xF3/0xF7), means the crazyflie had nothing to report
+	if len(resp) == 0 || (len(resp) == 1 && resp[0]&0xF3 == 0xF3) {
+		return
 	}
+
+	cf.dispatch(resp)
 }
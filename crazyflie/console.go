@@ -3,7 +3,7 @@ package crazyflie
 import "strings"
 
 func (cf *Crazyflie) consoleSystemInit() {
-	cf.responseCallbacks[crtpPortConsole].PushBack(cf.handleConsoleResponse)
+	cf.subscribe(crtpPortConsole, cf.handleConsoleResponse)
 }
 
 func (cf *Crazyflie) handleConsoleResponse(resp []byte) {
@@ -0,0 +1,28 @@
+package crazyflie
+
+import (
+	"context"
+	"time"
+)
+
+// how long to wait for an answer before sending a request again, see DefaultRetryPolicy
+const retryInterval = 500 * time.Millisecond
+
+// contextError is the error returned when ctx is done before the Crazyflie answered:
+// ErrorNoResponse if its deadline passed, otherwise the cancellation error of ctx
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrorNoResponse
+	}
+	return ctx.Err()
+}
+
+// sleep waits for d, returning the error of ctx if it is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
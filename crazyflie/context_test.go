@@ -0,0 +1,60 @@
+package crazyflie
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazysim"
+)
+
+func TestConnectNoResponse(t *testing.T) {
+	link := crazysim.NewLink()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ConnectLink(ctx, link, testAddress, testChannel, testDatarate); err == nil {
+		t.Fatal("connected to a crazyflie which is not there")
+	}
+}
+
+func TestConnectCancelled(t *testing.T) {
+	link := crazysim.NewLink()
+	if _, err := link.CrazyflieAdd(testChannel, testDatarate, testAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ConnectLink(ctx, link, testAddress, testChannel, testDatarate); err != context.Canceled {
+		t.Fatalf("connected with a cancelled context: %v", err)
+	}
+}
+
+func TestRequestCancelled(t *testing.T) {
+	cf, _ := simConnect(t, 4)
+	if err := cf.ParamTOCGetList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cf.ParamTOCGetList(ctx); err != context.Canceled {
+		t.Fatalf("downloaded the TOC with a cancelled context: %v", err)
+	}
+
+	// a passed deadline is reported as the crazyflie not responding
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := cf.ParamRead(ctx, "pid_rate.roll_kp"); err != ErrorNoResponse {
+		t.Fatalf("read a parameter after the deadline: %v", err)
+	}
+
+	// the connection is still usable once the cancelled requests returned
+	if _, err := cf.ParamRead(context.Background(), "pid_rate.roll_kp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.PacketQueueWaitForEmpty(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
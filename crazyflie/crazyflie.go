@@ -1,7 +1,7 @@
 package crazyflie
 
 import (
-	"container/list"
+	"context"
 	"sync"
 	"time"
 
@@ -17,20 +17,41 @@ const (
 )
 
 type Crazyflie struct {
-	address         uint64
-	firmwareAddress uint64
-	channel         uint8
-	firmwareChannel uint8
-	status          CrazyflieStatus
-	firstInit       sync.Once
+	link             Link
+	firmwareLink     Link
+	scheme           string
+	dongle           int
+	host             string
+	address          uint64
+	firmwareAddress  uint64
+	channel          uint8
+	firmwareChannel  uint8
+	datarate         crazyradio.RadioDatarate
+	firmwareDatarate crazyradio.RadioDatarate
+	status           CrazyflieStatus
+	statusLock       sync.Mutex
+	firstInit        sync.Once
 
 	// communication loop
 	disconnect    chan bool
 	statusTimeout *time.Timer
 	waitGroup     *sync.WaitGroup
 
-	// callbacks for packet reception
-	responseCallbacks map[crtpPort](*list.List)
+	// dispatching of the responses to the subscribed handlers, see dispatch.go
+	dispatchLock  sync.Mutex
+	subscriptions map[crtpPort][]*subscription
+	pending       [][]byte // responses waiting to be dispatched
+	pendingSignal chan bool
+
+	// statistics of the transactions, see Transact
+	transactions     map[string]*TransactionStats
+	lateAnswers      map[crtpPort][]*lateAnswer // the answers still expected by the transactions already done
+	transactionsLock sync.Mutex
+
+	// platform, see ProtocolVersion
+	protocolVersion      int
+	protocolVersionKnown bool
+	protocolVersionLock  sync.Mutex // held while the version is requested, such that it is requested once
 
 	// console printing
 	accumulatedConsolePrint string
@@ -40,24 +61,64 @@ type Crazyflie struct {
 	logCRC         uint32
 	logMaxPacket   uint8
 	logMaxOps      uint8
-	logNameToIndex map[string]logItem
-	logIndexToName map[uint8]string
+	logNameToIndex map[string]logItem // the TOC, replaced as a whole once downloaded
+	logIndexToName map[uint16]string
 	logBlocks      map[int]logBlock
+	logLock        sync.RWMutex   // protects the TOC and logBlocks, which the dispatcher reads for every log block packet
+	logSamples     map[int]uint64 // log block samples received, see LogSamples
+	logSamplesLock sync.Mutex
 
 	// parameters
 	paramCount       int
 	paramCRC         uint32
 	paramNameToIndex map[string]paramItem
-	paramIndexToName map[uint8]string
+	paramIndexToName map[uint16]string
+}
+
+// Connect opens a connection to the Crazyflie at the given link URI, eg. radio://0/80/2M/E7E7E7E7E7,
+// giving up when ctx is done (or after the default timeout of the link if ctx has no deadline)
+func Connect(ctx context.Context, uri string) (*Crazyflie, error) {
+	linkURI, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var link Link = RadioLink
+	switch linkURI.Scheme {
+	case "usb":
+		link = NewUSBLink(linkURI.Dongle)
+	case "udp":
+		link = NewUDPLink(linkURI.Host)
+	case "share":
+		link, err = shareLink(linkURI.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cf, err := ConnectLink(ctx, link, linkURI.Address, linkURI.Channel, linkURI.Datarate)
+	if err != nil {
+		return nil, err
+	}
+
+	cf.scheme = linkURI.Scheme
+	cf.dongle = linkURI.Dongle
+	cf.host = linkURI.Host
+	return cf, nil
 }
 
-func Connect(address uint64, channel uint8) (*Crazyflie, error) {
+// ConnectLink opens a connection to the Crazyflie at address, channel and datarate over the given link
+func ConnectLink(ctx context.Context, link Link, address uint64, channel uint8, datarate crazyradio.RadioDatarate) (*Crazyflie, error) {
 	cf := new(Crazyflie)
+	cf.link = link
+	cf.firmwareLink = link
+	cf.scheme = "radio"
 
-	cf.firmwareAddress = address // we save explicitly the firmware address and channel since a restart to bootloader will overwrite the current radio settings
+	cf.firmwareAddress = address // we save explicitly the firmware address, channel and datarate since a restart to bootloader will overwrite the current radio settings
 	cf.firmwareChannel = channel
+	cf.firmwareDatarate = datarate
 
-	err := cf.connect(address, channel)
+	err := cf.connect(ctx, address, channel, datarate)
 	if err != nil {
 		return nil, err
 	}
@@ -65,18 +126,24 @@ func Connect(address uint64, channel uint8) (*Crazyflie, error) {
 	return cf, nil
 }
 
-func (cf *Crazyflie) connect(address uint64, channel uint8) error {
+func (cf *Crazyflie) connect(ctx context.Context, address uint64, channel uint8, datarate crazyradio.RadioDatarate) error {
 	cf.address = address
 	cf.channel = channel
-	cf.status = StatusDisconnected
+	cf.datarate = datarate
+	cf.setStatus(StatusDisconnected)
+
+	if cf.waitGroup != nil {
+		cf.waitGroup.Wait() // the threads of the previous connection, eg. before a reboot
+	}
 
 	// initialize the structures required for communication and packet handling
 	cf.communicationSystemInit()
+	cf.platformSystemInit()
 	cf.consoleSystemInit()
 	cf.logSystemInit()
 	cf.paramSystemInit()
 
-	return crazyradio.CrazyflieRegister(cf.channel, cf.address, cf.responseHandler)
+	return cf.link.CrazyflieRegister(ctx, cf.channel, cf.datarate, cf.address, cf.responseHandler)
 }
 
 func (cf *Crazyflie) Address() uint64 {
@@ -87,19 +154,34 @@ func (cf *Crazyflie) FirmwareAddress() uint64 {
 	return cf.firmwareAddress
 }
 
+// URI returns the link URI of the Crazyflie's firmware, eg. radio://0/80/2M/E7E7E7E7E7
+func (cf *Crazyflie) URI() string {
+	return LinkURI{cf.scheme, cf.dongle, cf.firmwareChannel, cf.firmwareDatarate, cf.firmwareAddress, cf.host}.String()
+}
+
 func (cf *Crazyflie) Status() CrazyflieStatus {
+	cf.statusLock.Lock()
+	defer cf.statusLock.Unlock()
 	return cf.status
 }
 
+func (cf *Crazyflie) setStatus(status CrazyflieStatus) {
+	cf.statusLock.Lock()
+	defer cf.statusLock.Unlock()
+	cf.status = status
+}
+
 func (cf *Crazyflie) DisconnectImmediately() {
 	// asynchronously (& non-blocking) stops the communications thread
-	crazyradio.CrazyflieRemove(cf.channel, cf.address)
+	cf.link.CrazyflieRemove(cf.channel, cf.address)
 	close(cf.disconnect)
-	cf.status = StatusDisconnected
+	cf.setStatus(StatusDisconnected)
 }
 
-func (cf *Crazyflie) DisconnectOnEmpty() {
-	// asynchronously (& non-blocking) stops the communications thread
-	cf.PacketQueueWaitForEmpty()
+// DisconnectOnEmpty waits for the queued packets to be sent before disconnecting.
+// If ctx is done first, the Crazyflie is disconnected immediately and the error of ctx is returned.
+func (cf *Crazyflie) DisconnectOnEmpty(ctx context.Context) error {
+	err := cf.PacketQueueWaitForEmpty(ctx)
 	cf.DisconnectImmediately()
+	return err
 }
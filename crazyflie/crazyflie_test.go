@@ -0,0 +1,88 @@
+package crazyflie
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mikehamer/crazyserver/cache"
+	"github.com/mikehamer/crazyserver/crazyradio"
+	"github.com/mikehamer/crazyserver/crazysim"
+)
+
+const (
+	testChannel  = 80
+	testDatarate = crazyradio.RadioDatarate_2MPS
+	testAddress  = 0xE7E7E7E701
+)
+
+// the TOC caches are written to a temporary home, rather than to the one of the user running the tests
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "crazyflie-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	if err := cache.Init(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// simConnect connects to a simulated crazyflie with the firmware of protocolVersion
+func simConnect(t *testing.T, protocolVersion int) (*Crazyflie, *crazysim.Crazyflie) {
+	link := crazysim.NewLink()
+	sim, err := link.CrazyflieAdd(testChannel, testDatarate, testAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.SetProtocolVersion(protocolVersion)
+
+	cf, err := ConnectLink(context.Background(), link, testAddress, testChannel, testDatarate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cf.DisconnectImmediately)
+	return cf, sim
+}
+
+func TestConnect(t *testing.T) {
+	cf, _ := simConnect(t, 4)
+
+	if err := cf.PacketQueueWaitForEmpty(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if cf.Status() != StatusConnected {
+		t.Fatalf("status %v, expecting connected", cf.Status())
+	}
+}
+
+func TestParam(t *testing.T) {
+	for _, protocolVersion := range []int{3, 4} {
+		cf, _ := simConnect(t, protocolVersion)
+		if err := cf.ParamTOCGetList(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cf.ParamWrite(context.Background(), "pid_rate.roll_kp", float32(3)); err != nil {
+			t.Fatal(err)
+		}
+		value, err := cf.ParamRead(context.Background(), "pid_rate.roll_kp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.(float32) != 3 {
+			t.Fatalf("protocol %d: read %v, expecting 3", protocolVersion, value)
+		}
+
+		if _, err := cf.ParamRead(context.Background(), "no.such"); err != ErrorParamNotFound {
+			t.Fatalf("read an unknown parameter: %v", err)
+		}
+	}
+}
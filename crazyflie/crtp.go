@@ -1,33 +1,26 @@
 package crazyflie
 
-type crtpHeader byte
-type crtpPort byte
+import "github.com/mikehamer/crazyserver/internal/protocol"
+
+type crtpHeader = protocol.Header
+type crtpPort = protocol.Port
 
 const (
-	crtpPortConsole  crtpPort = 0x00
-	crtpPortParam             = 0x02
-	crtpPortSetpoint          = 0x03
-	crtpPortMem               = 0x04
-	crtpPortLog               = 0x05
-	crtpPortPosition          = 0x06
-	crtpPortPlatform          = 0x0D
-	crtpPortLink              = 0x0F
-	crtpPortEmpty1            = 0xF3
-	crtpPortEmpty2            = 0xF7
-	crtpPortGreedy            = 0xFF
+	crtpPortConsole    = protocol.PortConsole
+	crtpPortParam      = protocol.PortParam
+	crtpPortSetpoint   = protocol.PortSetpoint
+	crtpPortMem        = protocol.PortMem
+	crtpPortLog        = protocol.PortLog
+	crtpPortPosition   = protocol.PortPosition
+	crtpPortSetpointHL = protocol.PortSetpointHL
+	crtpPortPlatform   = protocol.PortPlatform
+	crtpPortLink       = protocol.PortLink
+	crtpPortGreedy     = crtpPort(0xFF) // every port, see subscribe
 )
 
-func crtp(port crtpPort, channel byte) byte {
-	var link byte = 3
-	return ((byte(port) & 0x0F) << 4) |
-		((link & 0x03) << 2) |
-		((channel & 0x03) << 0)
-}
-
-func (header crtpHeader) channel() byte {
-	return (byte(header) >> 0) & 0x03
-}
+// the largest payload of a CRTP packet, following its header
+const crtpMaxData = protocol.MaxData
 
-func (header crtpHeader) port() crtpPort {
-	return crtpPort((byte(header) >> 4) & 0x0F)
+func crtp(port crtpPort, channel byte) byte {
+	return protocol.MakeHeader(port, channel)
 }
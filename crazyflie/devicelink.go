@@ -0,0 +1,282 @@
+package crazyflie
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// how long to wait for a Crazyflie to become reachable, eg. to appear on the USB bus while it reboots,
+// when the context of CrazyflieRegister has no deadline
+const deviceOpenTimeout = 5 * time.Second
+
+// the empty packet sent to keep a device link alive, the same as the radio sends to poll a crazyflie
+var keepalivePacket = []byte{0xFF}
+
+// packetDevice carries CRTP packets to and from a single Crazyflie
+type packetDevice interface {
+	SendPacket(packet []byte) error
+	// ReadPacket returns the next packet from the crazyflie, an empty packet if the crazyflie is known to be connected
+	// but has nothing to send, or nil if nothing was received before the read timed out
+	ReadPacket() ([]byte, error)
+	Close()
+}
+
+// deviceLink is the Link to a Crazyflie reached through a packetDevice, eg. a USB cable. The link carries a single
+// Crazyflie, so the channel and address are ignored. Outgoing packets are written as soon as they are queued,
+// and a reader forwards every packet the Crazyflie sends. Devices which only answer what they receive are sent
+// an empty packet every keepalive period while there is nothing else to send, as the radio polls idle crazyflies.
+type deviceLink struct {
+	open      func() (packetDevice, error)
+	keepalive time.Duration // 0 for no keepalive packets
+
+	lock          sync.Mutex
+	device        packetDevice
+	standardQueue *list.List
+	priorityQueue *list.List
+	queued        chan bool // signalled when a packet is queued
+	dequeued      chan bool // signalled when a packet has been written
+	stop          chan bool
+	waitGroup     sync.WaitGroup
+	stats         crazyradio.LinkStats
+}
+
+// NewUSBLink returns the link to the index-th Crazyflie connected over USB, see crazyradio.OpenUsbCrazyflie.
+// The device is opened when the Crazyflie is connected, and closed when it is disconnected.
+func NewUSBLink(index int) Link {
+	return &deviceLink{open: func() (packetDevice, error) {
+		return crazyradio.OpenUsbCrazyflie(index)
+	}}
+}
+
+func (link *deviceLink) CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	link.CrazyflieRemove(channel, address)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deviceOpenTimeout)
+		defer cancel()
+	}
+
+	// the crazyflie may still be enumerating, eg. after a reboot
+	var device packetDevice
+	var err error
+	for {
+		device, err = link.open()
+		if err == nil {
+			break
+		}
+		if sleep(ctx, 100*time.Millisecond) != nil {
+			return contextError(ctx)
+		}
+	}
+
+	link.lock.Lock()
+	link.device = device
+	link.standardQueue = list.New()
+	link.priorityQueue = list.New()
+	link.queued = make(chan bool, 1)
+	link.dequeued = make(chan bool, 1)
+	link.stop = make(chan bool)
+	link.lock.Unlock()
+
+	// as with the radio, wait for the crazyflie to respond before handing over the callback
+	cfCommunicating := make(chan bool)
+	var callbackLock sync.Mutex
+	callback := func(resp []byte) {
+		select {
+		case cfCommunicating <- true:
+		default:
+		}
+	}
+
+	link.waitGroup.Add(2)
+	go link.writeThread(device, link.stop)
+	go link.readThread(device, link.stop, func(resp []byte) {
+		callbackLock.Lock()
+		f := callback
+		callbackLock.Unlock()
+		f(resp)
+	})
+
+	select {
+	case <-ctx.Done():
+		link.CrazyflieRemove(channel, address)
+		return contextError(ctx)
+	case <-cfCommunicating:
+		callbackLock.Lock()
+		callback = responseCallback
+		callbackLock.Unlock()
+		return nil
+	}
+}
+
+func (link *deviceLink) CrazyflieRemove(channel uint8, address uint64) {
+	link.lock.Lock()
+	device, stop := link.device, link.stop
+	link.device = nil
+	link.lock.Unlock()
+
+	if device == nil {
+		return
+	}
+
+	close(stop)
+	link.waitGroup.Wait()
+	device.Close()
+}
+
+func (link *deviceLink) packetQueue(packet []byte, priority bool) {
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+
+	link.lock.Lock()
+	if link.device == nil {
+		link.lock.Unlock()
+		return // not connected, the packet is dropped
+	}
+	if priority {
+		link.priorityQueue.PushBack(packetCopy)
+	} else {
+		link.standardQueue.PushBack(packetCopy)
+	}
+	link.lock.Unlock()
+
+	select {
+	case link.queued <- true:
+	default:
+	}
+}
+
+func (link *deviceLink) PacketSend(channel uint8, address uint64, packet []byte) error {
+	link.packetQueue(packet, false)
+	return nil
+}
+
+func (link *deviceLink) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	link.packetQueue(packet, true)
+}
+
+func (link *deviceLink) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	for {
+		link.lock.Lock()
+		if link.device == nil {
+			link.lock.Unlock()
+			return nil
+		}
+		empty := link.priorityQueue.Front() == nil && link.standardQueue.Front() == nil
+		dequeued, stop := link.dequeued, link.stop
+		link.lock.Unlock()
+
+		if empty {
+			return nil
+		}
+
+		select {
+		case <-dequeued:
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (link *deviceLink) LinkStats(channel uint8, address uint64) crazyradio.LinkStats {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+	return link.stats
+}
+
+// writeThread writes the queued packets, priority packets first
+func (link *deviceLink) writeThread(device packetDevice, stop chan bool) {
+	defer link.waitGroup.Done()
+
+	for {
+		link.lock.Lock()
+		var packets *list.List
+		if link.priorityQueue.Front() != nil {
+			packets = link.priorityQueue
+		} else if link.standardQueue.Front() != nil {
+			packets = link.standardQueue
+		}
+		link.lock.Unlock()
+
+		var element *list.Element
+		var packet []byte
+		if packets == nil {
+			var keepalive <-chan time.Time
+			if link.keepalive > 0 {
+				keepalive = time.After(link.keepalive)
+			}
+			select {
+			case <-stop:
+				return
+			case <-link.queued:
+				continue
+			case <-keepalive:
+				packet = keepalivePacket
+			}
+		} else {
+			link.lock.Lock()
+			element = packets.Front()
+			link.lock.Unlock()
+			packet = element.Value.([]byte)
+		}
+
+		err := device.SendPacket(packet)
+
+		link.lock.Lock()
+		link.stats.Update(crazyradio.Ack{Received: err == nil}, err)
+		if err == nil && element != nil {
+			packets.Remove(element)
+		}
+		link.lock.Unlock()
+
+		if err != nil {
+			select { // the crazyflie is rebooting or unplugged, retry later
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue
+		}
+
+		select {
+		case link.dequeued <- true:
+		default:
+		}
+	}
+}
+
+// readThread forwards the packets sent by the crazyflie, including the empty packets showing that the crazyflie
+// is connected but has nothing to report, like an empty acknowledgement
+func (link *deviceLink) readThread(device packetDevice, stop chan bool, responseCallback func([]byte)) {
+	defer link.waitGroup.Done()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		resp, err := device.ReadPacket()
+		if resp == nil && err == nil {
+			continue // nothing received
+		}
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue
+		}
+
+		responseCallback(resp) // from the read thread, such that the responses are delivered in order
+	}
+}
@@ -0,0 +1,104 @@
+package crazyflie
+
+// The responses of a Crazyflie are handed by the link to responseHandler, which queues them for the dispatcher.
+// A single dispatcher goroutine per connection then calls the handlers subscribed to the port of each response,
+// followed by the greedy handlers, one at a time and in the order the responses were received.
+
+// subscription is a handler of the responses on a port, see subscribe
+type subscription struct {
+	handler      func([]byte)
+	unsubscribed bool // protected by the dispatch lock
+}
+
+// subscribe calls handler with a copy of every response received on port (every response for crtpPortGreedy),
+// until the returned function is called. The handlers run on the dispatcher one at a time, so a handler must not
+// block (eg. by selecting on the context of its request) and the later responses wait until it returns.
+func (cf *Crazyflie) subscribe(port crtpPort, handler func([]byte)) (unsubscribe func()) {
+	sub := &subscription{handler: handler}
+
+	cf.dispatchLock.Lock()
+	cf.subscriptions[port] = append(cf.subscriptions[port], sub)
+	cf.dispatchLock.Unlock()
+
+	return func() {
+		cf.dispatchLock.Lock()
+		defer cf.dispatchLock.Unlock()
+
+		sub.unsubscribed = true
+		subs := cf.subscriptions[port]
+		for i, s := range subs {
+			if s == sub {
+				// a new slice, such that the dispatcher can keep iterating over the one it holds
+				cf.subscriptions[port] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (cf *Crazyflie) dispatchSystemInit() {
+	pendingSignal := make(chan bool, 1)
+
+	cf.dispatchLock.Lock()
+	cf.subscriptions = make(map[crtpPort][]*subscription)
+	cf.pending = nil
+	cf.pendingSignal = pendingSignal
+	cf.dispatchLock.Unlock()
+
+	cf.waitGroup.Add(1)
+	go cf.dispatchThread(cf.disconnect, pendingSignal)
+}
+
+// dispatch queues a response for the dispatcher, without blocking the link
+func (cf *Crazyflie) dispatch(resp []byte) {
+	cf.dispatchLock.Lock()
+	cf.pending = append(cf.pending, resp)
+	pendingSignal := cf.pendingSignal
+	cf.dispatchLock.Unlock()
+
+	select {
+	case pendingSignal <- true:
+	default: // the dispatcher has already been signalled
+	}
+}
+
+func (cf *Crazyflie) dispatchThread(disconnect chan bool, pendingSignal chan bool) {
+	defer cf.waitGroup.Done()
+
+	for {
+		select {
+		case <-disconnect:
+			return
+		case <-pendingSignal:
+		}
+
+		for {
+			cf.dispatchLock.Lock()
+			if len(cf.pending) == 0 {
+				cf.dispatchLock.Unlock()
+				break
+			}
+			resp := cf.pending[0]
+			cf.pending[0] = nil
+			cf.pending = cf.pending[1:]
+
+			port := crtpHeader(resp[0]).Port()
+			subs := make([]*subscription, 0, len(cf.subscriptions[port])+len(cf.subscriptions[crtpPortGreedy]))
+			subs = append(subs, cf.subscriptions[port]...)
+			subs = append(subs, cf.subscriptions[crtpPortGreedy]...)
+			cf.dispatchLock.Unlock()
+
+			for _, sub := range subs {
+				cf.dispatchLock.Lock()
+				unsubscribed := sub.unsubscribed // eg. by a handler earlier in the list
+				cf.dispatchLock.Unlock()
+
+				if !unsubscribed {
+					packet := make([]byte, len(resp))
+					copy(packet, resp)
+					sub.handler(packet)
+				}
+			}
+		}
+	}
+}
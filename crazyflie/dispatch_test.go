@@ -0,0 +1,38 @@
+package crazyflie
+
+import "testing"
+
+func TestDispatchOrder(t *testing.T) {
+	cf := new(Crazyflie)
+	cf.communicationSystemInit()
+	defer func() {
+		close(cf.disconnect)
+		cf.waitGroup.Wait()
+	}()
+
+	received := make(chan []byte, 1000)
+	unsubscribe := cf.subscribe(crtpPortLog, func(packet []byte) {
+		packet[1]++ // each handler receives its own copy
+		received <- packet
+	})
+	cf.subscribe(crtpPortGreedy, func(packet []byte) { received <- packet })
+
+	for i := 0; i < 400; i++ {
+		cf.responseHandler([]byte{crtp(crtpPortLog, 2), byte(i)})
+	}
+	for i := 0; i < 400; i++ {
+		port, greedy := <-received, <-received
+		if port[1] != byte(i+1) || greedy[1] != byte(i) {
+			t.Fatalf("response %d dispatched as %v and %v", i, port, greedy)
+		}
+	}
+
+	unsubscribe()
+	cf.responseHandler([]byte{crtp(crtpPortLog, 2), 7})
+	if packet := <-received; packet[1] != 7 {
+		t.Fatalf("response dispatched as %v to an unsubscribed handler", packet)
+	}
+	if len(received) != 0 {
+		t.Fatal("response dispatched to an unsubscribed handler")
+	}
+}
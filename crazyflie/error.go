@@ -11,28 +11,41 @@ func (e crazyflieError) Error() string {
 const (
 	ErrorNoResponse crazyflieError = iota
 
+	ErrorInvalidURI
+	ErrorNotSupported
+
 	ErrorLogBlockOrItemNotFound
 	ErrorLogBlockNoMemory
 	ErrorLogBlockTooLong
 	ErrorLogBlockPeriodTooShort
+	ErrorLogBlockExists
 
 	ErrorParamNotFound
 
+	ErrorTOCItemInvalid
+
 	ErrorFlashDataTooLarge
+	ErrorFlashWrite
 
 	ErrorUnknown
 )
 
 var crazyflieErrorString = map[crazyflieError]string{
 	ErrorNoResponse:             "not responding",
+	ErrorInvalidURI:             "invalid link URI",
+	ErrorNotSupported:           "not supported by the link",
 	ErrorLogBlockOrItemNotFound: "log block or item not found",
 	ErrorLogBlockNoMemory:       "no memory to allocated log block",
 	ErrorLogBlockTooLong:        "log block is too long",
 	ErrorLogBlockPeriodTooShort: "log block reporting period too short",
+	ErrorLogBlockExists:         "log block already exists",
 
 	ErrorParamNotFound: "parameter not found",
 
+	ErrorTOCItemInvalid: "invalid TOC item",
+
 	ErrorFlashDataTooLarge: "image is too large for flash",
+	ErrorFlashWrite:        "the bootloader failed to write the flash",
 
 	ErrorUnknown: "an unknown error occurred",
 }
@@ -1,10 +1,13 @@
 package crazyflie
 
 import (
+	"context"
 	"log"
 	"time"
 
 	"reflect"
+
+	"github.com/mikehamer/crazyserver/internal/protocol"
 )
 
 type flashObj struct {
@@ -23,40 +26,48 @@ const (
 	TargetCPU_STM32
 )
 
+// writing the flash takes a while, during which the status requests are not answered
+var flashWriteRetryPolicy = RetryPolicy{Interval: 20 * time.Millisecond, Attempts: 500}
+
 var cpuName = map[TargetCPU]string{TargetCPU_NRF51: "NRF51", TargetCPU_STM32: "STM32"}
 
-func (cf *Crazyflie) ReflashSTM32(data []byte, verify bool, progressChannel chan int) error {
-	return cf.reflash(TargetCPU_STM32, data, verify, progressChannel)
+// ReflashSTM32 reboots the Crazyflie to its bootloader, writes data to the STM32 and reboots to the new firmware.
+// If ctx is done before the flash is written, the Crazyflie is left in its bootloader.
+func (cf *Crazyflie) ReflashSTM32(ctx context.Context, data []byte, verify bool, progressChannel chan int) error {
+	return cf.reflash(ctx, TargetCPU_STM32, data, verify, progressChannel)
 }
 
-func (cf *Crazyflie) ReflashNRF51(data []byte, verify bool, progressChannel chan int) error {
-	return cf.reflash(TargetCPU_NRF51, data, verify, progressChannel)
+// ReflashNRF51 is as ReflashSTM32 for the NRF51
+func (cf *Crazyflie) ReflashNRF51(ctx context.Context, data []byte, verify bool, progressChannel chan int) error {
+	return cf.reflash(ctx, TargetCPU_NRF51, data, verify, progressChannel)
 }
 
-func (cf *Crazyflie) reflash(target TargetCPU, data []byte, verify bool, progressChannel chan int) error {
-	err := cf.RebootToBootloader()
+func (cf *Crazyflie) reflash(ctx context.Context, target TargetCPU, data []byte, verify bool, progressChannel chan int) error {
+	err := cf.RebootToBootloader(ctx)
 
 	if err != nil {
 		return err
 	}
 
-	flash, err := cf.flashGetInfo(target)
+	flash, err := cf.flashGetInfo(ctx, target)
 	if err != nil {
 		return err
 	}
 
-	err = cf.flashLoadData(flash, data, progressChannel)
+	err = cf.flashLoadData(ctx, flash, data, progressChannel)
 	if err != nil {
 		return err
 	}
 
 	if verify {
 		for i := 0; i < len(data); i += 16 {
-			cf.flashVerifyAddress(flash, i, data)
+			if _, err := cf.flashVerifyAddress(ctx, flash, i, data); err != nil {
+				return err
+			}
 		}
 	}
 
-	err = cf.RebootToFirmware()
+	err = cf.RebootToFirmware(ctx)
 	if err != nil {
 		return err
 	}
@@ -64,7 +75,7 @@ func (cf *Crazyflie) reflash(target TargetCPU, data []byte, verify bool, progres
 	return nil
 }
 
-func (cf *Crazyflie) flashGetInfo(target TargetCPU) (*flashObj, error) {
+func (cf *Crazyflie) flashGetInfo(ctx context.Context, target TargetCPU) (*flashObj, error) {
 	var flash = new(flashObj)
 
 	cpu := 0xFE | uint8(target)
@@ -72,47 +83,24 @@ func (cf *Crazyflie) flashGetInfo(target TargetCPU) (*flashObj, error) {
 
 	packet := []byte{0xFF, cpu, 0x10} // get info command
 
-	callbackTriggered := make(chan bool)
-	callback := func(resp []byte) {
-		if resp[0] == 0xFF && resp[1] == cpu && resp[2] == 0x10 {
-			flash.pageSize = int(bytesToUint16(resp[3:5]).(uint16))
-			flash.numBuffPages = int(bytesToUint16(resp[5:7]).(uint16))
-			flash.numFlashPages = int(bytesToUint16(resp[7:9]).(uint16))
-			flash.startFlashPage = int(bytesToUint16(resp[9:11]).(uint16))
-			callbackTriggered <- true
-		}
+	resp, err := cf.Transact(ctx, packet, matchAnswer(packet, 2, 11), bootloaderRetryPolicy)
+	if err != nil {
+		return nil, err
 	}
 
-	e := cf.responseCallbacks[crtpPortGreedy].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortGreedy].Remove(e)
-
-	cf.PacketSend(packet)
-
-	select {
-	case <-callbackTriggered:
-		return flash, nil
-	case <-time.After(500 * time.Millisecond):
-		return nil, ErrorNoResponse
-	}
+	flash.pageSize = int(protocol.BytesToUint16(resp[3:5]).(uint16))
+	flash.numBuffPages = int(protocol.BytesToUint16(resp[5:7]).(uint16))
+	flash.numFlashPages = int(protocol.BytesToUint16(resp[7:9]).(uint16))
+	flash.startFlashPage = int(protocol.BytesToUint16(resp[9:11]).(uint16))
+	return flash, nil
 }
 
-func (cf *Crazyflie) flashLoadData(flash *flashObj, data []byte, progressChannel chan int) error {
+func (cf *Crazyflie) flashLoadData(ctx context.Context, flash *flashObj, data []byte, progressChannel chan int) error {
 
 	if len(data) > int(flash.numFlashPages-flash.startFlashPage)*int(flash.pageSize) {
 		return ErrorFlashDataTooLarge
 	}
 
-	writeFlashError := make(chan byte)
-	writeFlashCallback := func(resp []byte) {
-		if resp[0] == 0xFF && resp[1] == flash.target && (resp[2] == 0x18 || resp[2] == 0x19) { // response to write flash
-			errorcode := resp[4]
-			writeFlashError <- errorcode
-		}
-	}
-
-	e := cf.responseCallbacks[crtpPortGreedy].PushBack(writeFlashCallback)
-	defer cf.responseCallbacks[crtpPortGreedy].Remove(e)
-
 	writeFlashPacket := make([]byte, 9)
 	writeFlashPacket[0] = 0xFF
 	writeFlashPacket[1] = flash.target
@@ -142,7 +130,13 @@ func (cf *Crazyflie) flashLoadData(flash *flashObj, data []byte, progressChannel
 			}
 
 			// write the buffer page, consists of multiple packets
-			cf.flashLoadBufferPage(flash, pageIdx, data[dataIdx:dataIdx+dataLen])
+			if err := cf.flashLoadBufferPage(flash, pageIdx, data[dataIdx:dataIdx+dataLen]); err != nil {
+				return err
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 
 			if cf.Status() == StatusNoResponse {
 				return ErrorNoResponse
@@ -170,44 +164,32 @@ func (cf *Crazyflie) flashLoadData(flash *flashObj, data []byte, progressChannel
 		flashIdx += pageIdx
 
 		// send the packet
-		cf.PacketSend(writeFlashPacket)
-
-		cf.PacketQueueWaitForEmpty()
-
-		for flashConfirmation := false; !flashConfirmation; {
-			timeout := time.After(20 * time.Millisecond)
-			select {
-			case errorcode := <-writeFlashError:
-				if errorcode != 0 {
-					// progressBar.FinishPrint(fmt.Sprintf("Write flash error %d", errorcode))
-					return nil
-				}
-				flashConfirmation = true // breaks out of the loop
-			case <-timeout:
-				// Since uplink is safe we know the flash request has been executed
-				// Send a flash info request to find out if the flash process is done
-				flashInfoPacket := []byte{0xFF, flash.target, 0x19}
-				cf.PacketSend(flashInfoPacket)
-
-				if cf.Status() == StatusNoResponse {
-					return ErrorNoResponse
-				}
-			}
+		if err := cf.PacketSend(writeFlashPacket); err != nil {
+			return err
 		}
-	}
-	return nil
-}
 
-func (cf *Crazyflie) flashLoadBufferPage(flash *flashObj, bufferPageNum int, data []byte) {
+		if err := cf.PacketQueueWaitForEmpty(ctx); err != nil {
+			return err
+		}
 
-	readBuffData := make(chan []byte)
-	readBuffCallback := func(resp []byte) {
-		if resp[0] == 0xFF && resp[1] == flash.target && resp[2] == 0x15 { // response to read flash
-			readBuffData <- resp
+		// Since uplink is safe we know the flash request has been executed
+		// Ask for the flash status until the bootloader answers that the write is done (resp[3]) or has failed (resp[4])
+		resp, err := cf.Transact(ctx, []byte{0xFF, flash.target, 0x19}, func(resp []byte) bool {
+			return len(resp) >= 5 && resp[0] == 0xFF && resp[1] == flash.target && (resp[2] == 0x18 || resp[2] == 0x19) &&
+				(resp[3] == 1 || resp[4] != 0)
+		}, flashWriteRetryPolicy)
+		if err != nil {
+			return err
+		}
+		if done, errorcode := resp[3], resp[4]; done != 1 || errorcode != 0 {
+			log.Printf("Write flash error %d", errorcode)
+			return ErrorFlashWrite
 		}
 	}
-	e := cf.responseCallbacks[crtpPortGreedy].PushBack(readBuffCallback)
-	defer cf.responseCallbacks[crtpPortGreedy].Remove(e)
+	return nil
+}
+
+func (cf *Crazyflie) flashLoadBufferPage(flash *flashObj, bufferPageNum int, data []byte) error {
 
 	loadBufferPacket := make([]byte, 32)
 	loadBufferPacket[0] = 0xFF
@@ -243,14 +225,17 @@ func (cf *Crazyflie) flashLoadBufferPage(flash *flashObj, bufferPageNum int, dat
 
 		copy(loadBufferPacket[7:7+dataLen], data[dataIdx:dataIdx+dataLen])
 
-		cf.PacketSend(loadBufferPacket[0 : 7+dataLen])
+		if err := cf.PacketSend(loadBufferPacket[0 : 7+dataLen]); err != nil {
+			return err // a page missing a packet would be written to the flash
+		}
 
 		dataIdx += dataLen
 		bufferPageIdx += dataLen
 	}
+	return nil
 }
 
-func (cf *Crazyflie) flashVerifyAddress(flash *flashObj, flashAddress int, data []byte) bool {
+func (cf *Crazyflie) flashVerifyAddress(ctx context.Context, flash *flashObj, flashAddress int, data []byte) (bool, error) {
 
 	pageIdx := flashAddress / flash.pageSize
 	pageAddress := flashAddress - pageIdx*flash.pageSize
@@ -261,43 +246,21 @@ func (cf *Crazyflie) flashVerifyAddress(flash *flashObj, flashAddress int, data
 	readFlashPacket[5] = byte(pageAddress & 0xFF)
 	readFlashPacket[6] = byte((pageAddress >> 8) & 0xFF)
 
-	readFlashData := make(chan []byte)
-	readFlashCallback := func(resp []byte) {
-		if resp[0] == 0xFF && resp[1] == flash.target && resp[2] == 0x1C { // response to read flash
-			if !reflect.DeepEqual(resp[3:7], readFlashPacket[3:7]) {
-				return // Data for the wrong address (previous duplicated request)
-			}
-			readFlashData <- resp
-		} else {
-			log.Println("Read strange data: ", resp)
-		}
+	// the address is echoed, so that the answer to an earlier request is not taken for this one
+	readData, err := cf.Transact(ctx, readFlashPacket, matchAnswer(readFlashPacket, 6, 7), bootloaderRetryPolicy)
+	if err != nil {
+		return false, err
 	}
 
-	e := cf.responseCallbacks[crtpPortGreedy].PushBack(readFlashCallback)
-	defer cf.responseCallbacks[crtpPortGreedy].Remove(e)
-
-	var readData []byte
-	for readSuccess := false; !readSuccess; {
-		cf.PacketSend(readFlashPacket)
-
-		select {
-		case readData = <-readFlashData:
-			dataLen := len(readData) - 7
-			if flashAddress+dataLen > len(data) {
-				dataLen = len(data) - flashAddress
-			}
-
-			equal := reflect.DeepEqual(readData[7:7+dataLen], data[flashAddress:flashAddress+dataLen])
-			if !equal {
-				log.Fatalf("Flash @ 0x%X = \n%v expecting \n%v", flashAddress, readData[7:7+dataLen], data[flashAddress:flashAddress+dataLen])
-				return false
-			}
-			return true
-
-		case <-time.After(20 * time.Millisecond):
-			break
-		}
+	dataLen := len(readData) - 7
+	if flashAddress+dataLen > len(data) {
+		dataLen = len(data) - flashAddress
 	}
 
-	return true
+	equal := reflect.DeepEqual(readData[7:7+dataLen], data[flashAddress:flashAddress+dataLen])
+	if !equal {
+		log.Fatalf("Flash @ 0x%X = \n%v expecting \n%v", flashAddress, readData[7:7+dataLen], data[flashAddress:flashAddress+dataLen])
+		return false, nil
+	}
+	return true, nil
 }
@@ -0,0 +1,45 @@
+package crazyflie
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReflash(t *testing.T) {
+	cf, sim := simConnect(t, 4)
+
+	data := make([]byte, 5000) // spans several pages
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	progress := make(chan int, 100)
+	go func() {
+		for range progress {
+		}
+	}()
+	defer close(progress)
+
+	if err := cf.ReflashSTM32(context.Background(), data, true, progress); err != nil {
+		t.Fatal(err)
+	}
+
+	flash := sim.Flash(0xFF)
+	for i := range data {
+		if flash[i] != data[i] {
+			t.Fatalf("flash differs at %d", i)
+		}
+	}
+	if sim.InBootloader() {
+		t.Fatal("left in the bootloader")
+	}
+}
+
+func TestReflashTooLarge(t *testing.T) {
+	cf, _ := simConnect(t, 4)
+
+	progress := make(chan int, 100)
+	if err := cf.ReflashSTM32(context.Background(), make([]byte, 2<<20), false, progress); err != ErrorFlashDataTooLarge {
+		t.Fatalf("flashed an image too large: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package crazyflie
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// Link is the transport over which a Crazyflie exchanges CRTP packets.
+// A Crazyflie is identified on a link by its channel, datarate and address, the link is responsible for
+// queueing outgoing packets and for calling the registered callback with every response it receives,
+// one at a time and in the order they were received. The callback must return quickly.
+type Link interface {
+	// CrazyflieRegister starts communication with a Crazyflie, returning once it has responded or ctx is done
+	CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error
+	// CrazyflieRemove stops communication with a Crazyflie and drops its queued packets
+	CrazyflieRemove(channel uint8, address uint64)
+
+	// PacketSend queues a packet, returning an error if the link dropped it (eg. its queue is full)
+	PacketSend(channel uint8, address uint64, packet []byte) error
+	PacketSendPriority(channel uint8, address uint64, packet []byte)
+	// PacketQueueWaitForEmpty waits for the queued packets of a Crazyflie to be sent, or for ctx to be done
+	PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error
+
+	// LinkStats returns the link quality statistics gathered for a Crazyflie
+	LinkStats(channel uint8, address uint64) crazyradio.LinkStats
+}
+
+// DeadlineLink is implemented by links which can drop a packet that could not be sent before its deadline.
+// On other links, packets with a deadline are sent with priority.
+type DeadlineLink interface {
+	PacketSendDeadline(channel uint8, address uint64, packet []byte, deadline time.Time)
+}
+
+// LatestLink is implemented by links which can coalesce packets: a packet sent to a slot replaces the unsent packet
+// of the same slot, such that only the latest value of eg. a setpoint is sent. On other links, packets are sent with a deadline.
+type LatestLink interface {
+	PacketSendLatest(channel uint8, address uint64, slot uint8, packet []byte, deadline time.Time)
+}
+
+// BudgetLink is implemented by links which can limit the bandwidth used by a Crazyflie
+type BudgetLink interface {
+	PacketQueueSetBudget(channel uint8, address uint64, packetsPerSecond float64) error
+}
+
+// DepthLink is implemented by links which can limit the number of packets queued for a Crazyflie
+type DepthLink interface {
+	PacketQueueSetDepth(channel uint8, address uint64, depth int) error
+}
+
+// radioLink is the Link implemented by the packet scheduler of a crazyradio.Manager
+type radioLink struct {
+	manager *crazyradio.Manager
+}
+
+// RadioLink communicates with Crazyflies through the Crazyradio dongles opened by crazyradio.Start
+var RadioLink Link = radioLink{crazyradio.DefaultManager}
+
+// NewRadioLink returns a link communicating with Crazyflies through the Crazyradio dongles of manager
+func NewRadioLink(manager *crazyradio.Manager) Link {
+	return radioLink{manager}
+}
+
+func (link radioLink) CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	return link.manager.CrazyflieRegister(ctx, channel, datarate, address, responseCallback)
+}
+
+func (link radioLink) CrazyflieRemove(channel uint8, address uint64) {
+	link.manager.CrazyflieRemove(channel, address)
+}
+
+func (link radioLink) PacketSend(channel uint8, address uint64, packet []byte) error {
+	return link.manager.PacketSend(channel, address, packet)
+}
+
+func (link radioLink) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	link.manager.PacketSendPriority(channel, address, packet)
+}
+
+func (link radioLink) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	return link.manager.PacketQueueWaitForEmpty(ctx, channel, address)
+}
+
+func (link radioLink) LinkStats(channel uint8, address uint64) crazyradio.LinkStats {
+	return link.manager.LinkStatsGet(channel, address)
+}
+
+func (link radioLink) PacketSendDeadline(channel uint8, address uint64, packet []byte, deadline time.Time) {
+	link.manager.PacketSendDeadline(channel, address, packet, deadline)
+}
+
+func (link radioLink) PacketSendLatest(channel uint8, address uint64, slot uint8, packet []byte, deadline time.Time) {
+	link.manager.PacketSendLatest(channel, address, slot, packet, deadline)
+}
+
+func (link radioLink) PacketQueueSetDepth(channel uint8, address uint64, depth int) error {
+	return link.manager.PacketQueueSetDepth(channel, address, depth)
+}
+
+func (link radioLink) PacketQueueSetBudget(channel uint8, address uint64, packetsPerSecond float64) error {
+	return link.manager.PacketQueueSetBudget(channel, address, packetsPerSecond)
+}
@@ -1,24 +1,24 @@
 package crazyflie
 
 import (
-	"encoding/binary"
+	"context"
 	"log"
 	"math"
-	"strings"
 	"time"
 
 	"github.com/mikehamer/crazyserver/cache"
+	"github.com/mikehamer/crazyserver/internal/protocol"
 )
 
 var logTypeToValue = map[uint8](func([]byte) interface{}){
-	1: bytesToUint8,
-	2: bytesToUint16,
-	3: bytesToUint32,
-	4: bytesToInt8,
-	5: bytesToInt16,
-	6: bytesToInt32,
-	7: bytesToFloat32,
-	8: bytesToFloat16,
+	1: protocol.BytesToUint8,
+	2: protocol.BytesToUint16,
+	3: protocol.BytesToUint32,
+	4: protocol.BytesToInt8,
+	5: protocol.BytesToInt16,
+	6: protocol.BytesToInt32,
+	7: protocol.BytesToFloat32,
+	8: protocol.BytesToFloat16,
 }
 
 var logTypeToSize = map[uint8]uint8{
@@ -33,7 +33,7 @@ var logTypeToSize = map[uint8]uint8{
 }
 
 type logItem struct {
-	ID       uint8
+	ID       uint16
 	Datatype uint8
 }
 
@@ -43,21 +43,59 @@ type logBlock struct {
 	Variables []logItem
 }
 
+// logControlError is the error matching the error number of a log control answer
+func logControlError(errNum byte) error {
+	switch errNum {
+	case 0:
+		return nil
+	case 2:
+		return ErrorLogBlockOrItemNotFound
+	case 7:
+		return ErrorLogBlockTooLong
+	case 12:
+		return ErrorLogBlockNoMemory
+	case 17:
+		return ErrorLogBlockExists
+	default:
+		return ErrorUnknown
+	}
+}
+
 func (cf *Crazyflie) logSystemInit() {
 	cf.logNameToIndex = make(map[string]logItem)
-	cf.logIndexToName = make(map[uint8]string)
+	cf.logIndexToName = make(map[uint16]string)
 	cf.logBlocks = make(map[int]logBlock)
+	cf.logSamples = make(map[int]uint64)
 
-	cf.responseCallbacks[crtpPortLog].PushBack(cf.handleLogBlock)
+	cf.subscribe(crtpPortLog, cf.handleLogBlock)
+}
+
+// LogSamples returns the number of samples received for each log block since the Crazyflie connected
+func (cf *Crazyflie) LogSamples() map[int]uint64 {
+	cf.logSamplesLock.Lock()
+	defer cf.logSamplesLock.Unlock()
+
+	samples := make(map[int]uint64, len(cf.logSamples))
+	for blockid, count := range cf.logSamples {
+		samples[blockid] = count
+	}
+	return samples
 }
 
 func (cf *Crazyflie) handleLogBlock(resp []byte) {
 	header := crtpHeader(resp[0])
 
-	if header.port() == crtpPortLog && header.channel() == 2 {
+	if header.Port() == crtpPortLog && header.Channel() == 2 {
+		if len(resp) < 5 {
+			log.Printf("warning: log block packet too short (%d bytes)", len(resp))
+			return
+		}
 		blockid := int(resp[1])
 		//timestamp := uint32(resp[2]) | (uint32(resp[3]) << 8) | (uint32(resp[4]) << 16)
 
+		cf.logLock.RLock()
+		defer cf.logLock.RUnlock()
+
 		block, ok := cf.logBlocks[blockid]
 		if !ok {
 			// we are getting told about an unknown block
@@ -66,11 +104,23 @@ func (cf *Crazyflie) handleLogBlock(resp []byte) {
 			return
 		}
 
+		cf.logSamplesLock.Lock()
+		cf.logSamples[blockid]++
+		cf.logSamplesLock.Unlock()
+
 		idx := 5 // first index of element
 		for i := 0; i < len(block.Variables) && idx < len(resp); i++ {
 			variable := block.Variables[i]
+			decode, ok := logTypeToValue[variable.Datatype]
+			if !ok {
+				log.Printf("warning: block %d has a variable of unknown type %d", blockid, variable.Datatype)
+				return
+			}
 			datasize := int(logTypeToSize[variable.Datatype])
-			data := logTypeToValue[variable.Datatype](resp[idx : idx+datasize])
+			if idx+datasize > len(resp) {
+				break // reported below as a strange size
+			}
+			data := decode(resp[idx : idx+datasize])
 			log.Printf("%s = %v", cf.logIndexToName[variable.ID], data)
 			idx += datasize
 		}
@@ -79,107 +129,69 @@ func (cf *Crazyflie) handleLogBlock(resp []byte) {
 		if idx != len(resp) {
 			log.Printf("warning: block %d has strange size %d (expect %d)", blockid, idx, len(resp))
 		}
-
 	}
 }
 
-func (cf *Crazyflie) logTOCGetInfo() (int, uint32, error) {
-
-	// the packet to initialize the transaction
-	packet := []byte{crtp(crtpPortLog, 0), 0x01}
-
-	// the function which matches and acts on the response packet
-	callbackTriggered := make(chan bool)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 0 && resp[1] == 0x01 {
-
-			cf.logCount = int(resp[2])
-			cf.logCRC = binary.LittleEndian.Uint32(resp[3 : 3+4])
-			cf.logMaxPacket = uint8(resp[7])
-			cf.logMaxOps = uint8(resp[8])
-
-			callbackTriggered <- true
-		}
+func (cf *Crazyflie) logTOCGetInfo(ctx context.Context, version int) (int, uint32, error) {
+	count, crc, extra, err := cf.tocGetInfo(ctx, crtpPortLog, version, 2)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
+	cf.logCount = count
+	cf.logCRC = crc
+	cf.logMaxPacket = uint8(extra[0])
+	cf.logMaxOps = uint8(extra[1])
 
-	cf.PacketSend(packet) // schedule transmission of the packet
+	return cf.logCount, cf.logCRC, nil
+}
 
-	select {
-	case <-callbackTriggered:
-		return cf.logCount, cf.logCRC, nil
-	case <-time.After(500 * time.Millisecond):
-		return 0, 0, ErrorNoResponse
+func (cf *Crazyflie) LogTOCGetList(ctx context.Context) error {
+	version, err := cf.tocVersion(ctx)
+	if err != nil {
+		return err
 	}
-}
 
-func (cf *Crazyflie) LogTOCGetList() error {
-	_, crc, err := cf.logTOCGetInfo()
+	_, crc, err := cf.logTOCGetInfo(ctx, version)
 	if err != nil {
 		return err
 	}
 
-	err = cache.LoadLog(crc, &cf.logNameToIndex)
+	// the TOC is built aside, then swapped in for the log blocks received meanwhile
+	nameToIndex := make(map[string]logItem)
+	indexToName := make(map[uint16]string)
+
+	err = cache.LoadLog(crc, version, &nameToIndex)
 	if err == nil {
-		for k, v := range cf.logNameToIndex {
-			cf.logIndexToName[v.ID] = k
+		for k, v := range nameToIndex {
+			indexToName[v.ID] = k
 		}
-		log.Printf("Uncached Log TOC Size %d with CRC %X", len(cf.logNameToIndex), crc)
+		cf.logTOCSet(nameToIndex, indexToName)
+		log.Printf("Uncached Log TOC Size %d with CRC %X", len(nameToIndex), crc)
 		return nil
 	}
 
-	// the packet to initialize the transaction
-	packet := []byte{crtp(crtpPortLog, 0), 0x00, 0x00}
-
-	// the function which matches and acts on the response packet
-	callbackTriggered := make(chan bool)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 0 && resp[1] == 0x00 {
-			id := uint8(resp[2])
-			datatype := resp[3]
-
-			str := strings.Split(string(resp[4:]), "\x00")
-			groupName := str[0]
-			varName := str[1]
-			name := groupName + "." + varName
-
-			cf.logNameToIndex[name] = logItem{id, datatype}
-			cf.logIndexToName[id] = name
-
-			log.Printf("%d -> %s (%d)", id, name, datatype)
-
-			callbackTriggered <- true
-		}
+	items, err := cf.tocGetItems(ctx, crtpPortLog, version, cf.logCount)
+	if err != nil {
+		return err
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
+	for _, resp := range items {
+		id, datatype, name, err := tocItemParse(resp, version)
+		if err != nil {
+			return err
+		}
 
-	for i := 0; i < cf.logCount; {
-		packet[2] = uint8(i)  // the log variable we want to read
-		cf.PacketSend(packet) // schedule transmission of the packet
+		nameToIndex[name] = logItem{id, datatype}
+		indexToName[id] = name
 
-		select {
-		case <-callbackTriggered:
-			i++
-		case <-time.After(500 * time.Millisecond):
-			// no increment
-		}
+		log.Printf("%d -> %s (%d)", id, name, datatype)
 	}
 
+	cf.logTOCSet(nameToIndex, indexToName)
 	log.Printf("Loaded Log TOC Size %d with CRC %X", cf.logCount, cf.logCRC)
 
-	err = cache.SaveLog(crc, &cf.logNameToIndex)
+	err = cache.SaveLog(crc, version, &nameToIndex)
 	if err != nil {
 		log.Printf("Error while caching: %s", err)
 	}
@@ -188,42 +200,41 @@ func (cf *Crazyflie) LogTOCGetList() error {
 	return nil
 }
 
-func (cf *Crazyflie) LogSystemReset() error {
-	packet := []byte{crtp(crtpPortLog, 1), 0x05}
-
-	// callback on logblock creation
-	callbackTriggered := make(chan bool)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 1 && resp[1] == 0x05 {
-			callbackTriggered <- true
-		}
-	}
+func (cf *Crazyflie) logTOCSet(nameToIndex map[string]logItem, indexToName map[uint16]string) {
+	cf.logLock.Lock()
+	defer cf.logLock.Unlock()
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
+	cf.logNameToIndex = nameToIndex
+	cf.logIndexToName = indexToName
+}
 
-	// request creation of the log block
-	cf.PacketSend(packet)
+func (cf *Crazyflie) LogSystemReset(ctx context.Context) error {
+	packet := []byte{crtp(crtpPortLog, 1), 0x05}
 
-	select {
-	case <-callbackTriggered:
-		return nil
-	case <-time.After(500 * time.Millisecond):
-		return ErrorNoResponse
-	}
+	_, err := cf.Transact(ctx, packet, matchAnswer(packet, 1, 2), DefaultRetryPolicy)
+	return err
 }
 
-func (cf *Crazyflie) LogBlockAdd(period time.Duration, variables []string) (int, error) {
+func (cf *Crazyflie) LogBlockAdd(ctx context.Context, period time.Duration, variables []string) (int, error) {
 	blockid := 0
 
-	if len(variables) > 30 {
+	version, err := cf.tocVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the variables are given by their type and id, which all fit in the packet creating the block
+	command := byte(0x00) // control create block
+	itemSize := 2
+	if version == 2 {
+		command = 0x06 // control create block v2, with 16-bit ids
+		itemSize = 3
+	}
+	if 2+itemSize*len(variables) > crtpMaxData {
 		return 0, ErrorLogBlockTooLong
 	}
 
+	cf.logLock.Lock()
 	// find a free logblock id
 	for ; blockid < 256; blockid++ {
 		if _, ok := cf.logBlocks[blockid]; !ok {
@@ -232,6 +243,7 @@ func (cf *Crazyflie) LogBlockAdd(period time.Duration, variables []string) (int,
 	}
 
 	if blockid >= 256 {
+		cf.logLock.Unlock()
 		return 0, ErrorLogBlockNoMemory
 	}
 
@@ -245,111 +257,61 @@ func (cf *Crazyflie) LogBlockAdd(period time.Duration, variables []string) (int,
 	for i := 0; i < len(variables); i++ {
 		val, ok := cf.logNameToIndex[variables[i]]
 		if !ok {
+			cf.logLock.Unlock()
 			return 0, ErrorLogBlockOrItemNotFound
 		}
 		block.Variables[i] = val
 	}
 
-	// request block creation
-	packet := make([]byte, 2*len(variables)+3)
-	packet[0] = crtp(crtpPortLog, 1)
-	packet[1] = 0x00           // control create block
-	packet[2] = uint8(blockid) // logblock id
-	for i := 0; i < len(variables); i++ {
-		packet[3+2*i] = block.Variables[i].Datatype
-		packet[3+2*i+1] = block.Variables[i].ID
-	}
+	// reserve the id while the block is created, such that a concurrent LogBlockAdd picks another one
+	cf.logBlocks[blockid] = block
+	cf.logLock.Unlock()
 
-	// callback on logblock creation
-	callbackTriggered := make(chan error)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 1 && resp[1] == 0x00 && resp[2] == uint8(blockid) {
-			errNum := resp[3]
-			switch errNum {
-			case 0:
-				callbackTriggered <- nil
-			case 2:
-				callbackTriggered <- ErrorLogBlockOrItemNotFound
-			case 7:
-				callbackTriggered <- ErrorLogBlockTooLong
-			case 12:
-				callbackTriggered <- ErrorLogBlockNoMemory
-			default:
-				callbackTriggered <- ErrorUnknown
-			}
+	// request block creation
+	packet := []byte{crtp(crtpPortLog, 1), command, uint8(blockid)}
+	for _, variable := range block.Variables {
+		packet = append(packet, variable.Datatype, uint8(variable.ID))
+		if version == 2 {
+			packet = append(packet, uint8(variable.ID>>8))
 		}
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
-
-	// request creation of the log block
-	cf.PacketSend(packet)
-
-	select {
-	case err := <-callbackTriggered:
-		if err != nil {
-			return 0, err
+	err = cf.logControl(ctx, packet)
+	if err == ErrorLogBlockExists {
+		// the block was left on the firmware (eg. by an earlier connection, or by an attempt whose answer was lost),
+		// with variables which may not be those requested, so it is replaced
+		if err = cf.logControl(ctx, []byte{crtp(crtpPortLog, 1), 0x02, uint8(blockid)}); err == nil {
+			err = cf.logControl(ctx, packet)
 		}
-	case <-time.After(500 * time.Millisecond):
-		return 0, ErrorNoResponse
 	}
-
-	cf.logBlocks[blockid] = block
+	if err != nil {
+		cf.logBlockFree(blockid)
+		return 0, err
+	}
 	return blockid, nil
 }
 
-func (cf *Crazyflie) LogBlockDelete(blockid int) error {
-	packet := []byte{crtp(crtpPortLog, 1), 0x02, uint8(blockid)}
-
-	// callback on logblock creation
-	callbackTriggered := make(chan error)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 1 && resp[1] == 0x02 {
-			errNum := resp[3]
-			switch errNum {
-			case 0:
-				callbackTriggered <- nil
-			case 2:
-				callbackTriggered <- ErrorLogBlockOrItemNotFound
-			case 7:
-				callbackTriggered <- ErrorLogBlockTooLong
-			case 12:
-				callbackTriggered <- ErrorLogBlockNoMemory
-			default:
-				callbackTriggered <- ErrorUnknown
-			}
-		}
-	}
-
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
-
-	// request creation of the log block
-	cf.PacketSend(packet)
+// logBlockFree forgets a log block, such that its id can be reused
+func (cf *Crazyflie) logBlockFree(blockid int) {
+	cf.logLock.Lock()
+	defer cf.logLock.Unlock()
+	delete(cf.logBlocks, blockid)
+}
 
-	select {
-	case err := <-callbackTriggered:
-		if err != nil {
-			return err
-		}
-	case <-time.After(500 * time.Millisecond):
-		return ErrorNoResponse
+// LogBlockDelete deletes a log block, returning ErrorLogBlockOrItemNotFound when the firmware has no such block
+// (eg. when the answer to an earlier attempt deleting it was lost). The id of the block is freed in both cases.
+func (cf *Crazyflie) LogBlockDelete(ctx context.Context, blockid int) error {
+	err := cf.logControl(ctx, []byte{crtp(crtpPortLog, 1), 0x02, uint8(blockid)})
+	if err == nil || err == ErrorLogBlockOrItemNotFound {
+		cf.logBlockFree(blockid)
 	}
-
-	return nil
+	return err
 }
 
-func (cf *Crazyflie) LogBlockStart(blockid int) error {
+func (cf *Crazyflie) LogBlockStart(ctx context.Context, blockid int) error {
+	cf.logLock.RLock()
 	block, ok := cf.logBlocks[blockid]
+	cf.logLock.RUnlock()
 	if !ok {
 		return ErrorLogBlockOrItemNotFound
 	}
@@ -359,92 +321,18 @@ func (cf *Crazyflie) LogBlockStart(blockid int) error {
 		return ErrorLogBlockPeriodTooShort
 	}
 
-	packet := []byte{crtp(crtpPortLog, 1), 0x03, uint8(blockid), period} // period in multiples of 10 ms
-
-	// callback on logblock creation
-	callbackTriggered := make(chan error)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 1 && resp[1] == 0x03 && resp[2] == uint8(blockid) {
-			errNum := resp[3]
-			switch errNum {
-			case 0:
-				callbackTriggered <- nil
-			case 2:
-				callbackTriggered <- ErrorLogBlockOrItemNotFound
-			case 7:
-				callbackTriggered <- ErrorLogBlockTooLong
-			case 12:
-				callbackTriggered <- ErrorLogBlockNoMemory
-			default:
-				callbackTriggered <- ErrorUnknown
-			}
-		}
-	}
-
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
-
-	// request creation of the log block
-	cf.PacketSend(packet)
-
-	select {
-	case err := <-callbackTriggered:
-		if err != nil {
-			return err
-		}
-	case <-time.After(500 * time.Millisecond):
-		return ErrorNoResponse
-	}
-
-	return nil
+	return cf.logControl(ctx, []byte{crtp(crtpPortLog, 1), 0x03, uint8(blockid), period}) // period in multiples of 10 ms
 }
 
-func (cf *Crazyflie) LogBlockStop(blockid int) error {
-
-	packet := []byte{crtp(crtpPortLog, 1), 0x04, uint8(blockid)}
-
-	// callback on logblock creation
-	callbackTriggered := make(chan error)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortLog && header.channel() == 1 && resp[1] == 0x03 {
-			errNum := resp[3]
-			switch errNum {
-			case 0:
-				callbackTriggered <- nil
-			case 2:
-				callbackTriggered <- ErrorLogBlockOrItemNotFound
-			case 7:
-				callbackTriggered <- ErrorLogBlockTooLong
-			case 12:
-				callbackTriggered <- ErrorLogBlockNoMemory
-			default:
-				callbackTriggered <- ErrorUnknown
-			}
-		}
-	}
-
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortLog].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortLog].Remove(e) // and remove it once we're done
-
-	// request creation of the log block
-	cf.PacketSend(packet)
+func (cf *Crazyflie) LogBlockStop(ctx context.Context, blockid int) error {
+	return cf.logControl(ctx, []byte{crtp(crtpPortLog, 1), 0x04, uint8(blockid)})
+}
 
-	select {
-	case err := <-callbackTriggered:
-		if err != nil {
-			return err
-		}
-	case <-time.After(500 * time.Millisecond):
-		return ErrorNoResponse
+// logControl sends a request on the log control channel, and returns the error code of its answer
+func (cf *Crazyflie) logControl(ctx context.Context, packet []byte) error {
+	resp, err := cf.Transact(ctx, packet, matchAnswer(packet, 2, 4), DefaultRetryPolicy)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return logControlError(resp[3])
 }
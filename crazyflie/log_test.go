@@ -0,0 +1,125 @@
+package crazyflie
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogBlock(t *testing.T) {
+	for _, protocolVersion := range []int{3, 4} {
+		cf, _ := simConnect(t, protocolVersion)
+		if err := cf.LogTOCGetList(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		blockid, err := cf.LogBlockAdd(context.Background(), 20*time.Millisecond, []string{"stabilizer.roll", "pm.vbat"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.LogBlockStart(context.Background(), blockid); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for cf.LogSamples()[blockid] == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("protocol %d: no samples of the log block", protocolVersion)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err := cf.LogBlockStop(context.Background(), blockid); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.LogBlockDelete(context.Background(), blockid); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cf.LogBlockAdd(context.Background(), 20*time.Millisecond, []string{"no.such"}); err != ErrorLogBlockOrItemNotFound {
+			t.Fatalf("added an unknown variable: %v", err)
+		}
+	}
+}
+
+func TestLogBlockAddConcurrent(t *testing.T) {
+	const blocks = 8
+	cf, _ := simConnect(t, 4)
+	if err := cf.LogTOCGetList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	ids := make(chan int, blocks)
+	errs := make(chan error, blocks)
+	for i := 0; i < blocks; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			blockid, err := cf.LogBlockAdd(context.Background(), 100*time.Millisecond, []string{"pm.vbat"})
+			if err != nil {
+				errs <- err
+				return
+			}
+			ids <- blockid
+		}()
+	}
+	wait.Wait()
+	close(ids)
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for blockid := range ids {
+		if seen[blockid] {
+			t.Fatalf("block id %d allocated twice", blockid)
+		}
+		seen[blockid] = true
+	}
+
+	// a deleted block frees its id, and a failed creation does not hold one
+	if err := cf.LogBlockDelete(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.LogBlockAdd(context.Background(), 100*time.Millisecond, []string{"no.such"}); err != ErrorLogBlockOrItemNotFound {
+		t.Fatalf("added an unknown variable: %v", err)
+	}
+	blockid, err := cf.LogBlockAdd(context.Background(), 100*time.Millisecond, []string{"pm.vbat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockid != 0 {
+		t.Fatalf("allocated block id %d, expecting the freed 0", blockid)
+	}
+}
+
+func TestLogBlockAddReplacesLeftover(t *testing.T) {
+	cf, _ := simConnect(t, 4)
+	if err := cf.LogTOCGetList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a block left on the firmware, eg. by an earlier connection
+	leftover := []byte{crtp(crtpPortLog, 1), 0x00, 0, 7, 0}
+	if err := cf.logControl(context.Background(), leftover); err != nil {
+		t.Fatal(err)
+	}
+
+	blockid, err := cf.LogBlockAdd(context.Background(), 20*time.Millisecond, []string{"stabilizer.roll"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockid != 0 {
+		t.Fatalf("allocated block id %d, expecting 0", blockid)
+	}
+
+	if err := cf.LogBlockDelete(context.Background(), blockid); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.LogBlockDelete(context.Background(), blockid); err != ErrorLogBlockOrItemNotFound {
+		t.Fatalf("deleted a deleted block: %v", err)
+	}
+}
@@ -1,12 +1,12 @@
 package crazyflie
 
 import (
-	"encoding/binary"
+	"context"
 	"log"
 	"strings"
-	"time"
 
 	"github.com/mikehamer/crazyserver/cache"
+	"github.com/mikehamer/crazyserver/internal/protocol"
 )
 
 // PARAM_UINT8  (0x00 | (0x00<<2) | (0x01<<3)) = 0x8
@@ -18,23 +18,23 @@ import (
 // PARAM_FLOAT  (0x02 | (0x01<<2) | (0x00<<3)) = 0x6
 
 var paramTypeToValue = map[uint8](func([]byte) interface{}){
-	0x8: bytesToUint8,
-	0x9: bytesToUint16,
-	0xA: bytesToUint32,
-	0x0: bytesToInt8,
-	0x1: bytesToInt16,
-	0x2: bytesToInt32,
-	0x6: bytesToFloat32,
+	0x8: protocol.BytesToUint8,
+	0x9: protocol.BytesToUint16,
+	0xA: protocol.BytesToUint32,
+	0x0: protocol.BytesToInt8,
+	0x1: protocol.BytesToInt16,
+	0x2: protocol.BytesToInt32,
+	0x6: protocol.BytesToFloat32,
 }
 
 var paramTypeToBytes = map[uint8](func(interface{}) []byte){
-	0x8: uint8ToBytes,
-	0x9: uint16ToBytes,
-	0xA: uint32ToBytes,
-	0x0: int8ToBytes,
-	0x1: int16ToBytes,
-	0x2: int32ToBytes,
-	0x6: float32ToBytes,
+	0x8: protocol.Uint8ToBytes,
+	0x9: protocol.Uint16ToBytes,
+	0xA: protocol.Uint32ToBytes,
+	0x0: protocol.Int8ToBytes,
+	0x1: protocol.Int16ToBytes,
+	0x2: protocol.Int32ToBytes,
+	0x6: protocol.Float32ToBytes,
 }
 
 var paramTypeToSize = map[uint8]uint8{
@@ -58,7 +58,7 @@ var paramTypeToName = map[uint8]string{
 }
 
 type paramItem struct {
-	ID       uint8
+	ID       uint16
 	Datatype uint8
 	Readonly bool
 }
@@ -72,50 +72,41 @@ type ParamTocItem struct {
 
 func (cf *Crazyflie) paramSystemInit() {
 	cf.paramNameToIndex = make(map[string]paramItem)
-	cf.paramIndexToName = make(map[uint8]string)
+	cf.paramIndexToName = make(map[uint16]string)
 }
 
-func (cf *Crazyflie) paramTOCGetInfo() (int, uint32, error) {
-
-	// the packet to initialize the transaction
-	packet := []byte{crtp(crtpPortParam, 0), 0x01}
-
-	// the function which matches and acts on the response packet
-	callbackTriggered := make(chan bool)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortParam && header.channel() == 0 && resp[1] == 0x01 {
-
-			cf.paramCount = int(resp[2])
-			cf.paramCRC = binary.LittleEndian.Uint32(resp[3 : 3+4])
-
-			callbackTriggered <- true
-		}
+func (cf *Crazyflie) paramTOCGetInfo(ctx context.Context, version int) (int, uint32, error) {
+	count, crc, _, err := cf.tocGetInfo(ctx, crtpPortParam, version, 0)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortParam].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortParam].Remove(e) // and remove it once we're done
+	cf.paramCount = count
+	cf.paramCRC = crc
 
-	cf.PacketSend(packet) // schedule transmission of the packet
+	return cf.paramCount, cf.paramCRC, nil
+}
 
-	select {
-	case <-callbackTriggered:
-		return cf.paramCount, cf.paramCRC, nil
-	case <-time.After(500 * time.Millisecond):
-		return 0, 0, ErrorNoResponse
+// paramIDBytes encodes the id of a parameter in the read and write requests, as for the TOC of the given version
+func paramIDBytes(version int, id uint16) []byte {
+	if version == 2 {
+		return []byte{uint8(id), uint8(id >> 8)}
 	}
+	return []byte{uint8(id)}
 }
 
-func (cf *Crazyflie) ParamTOCGetList() error {
-	_, crc, err := cf.paramTOCGetInfo()
+func (cf *Crazyflie) ParamTOCGetList(ctx context.Context) error {
+	version, err := cf.tocVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, crc, err := cf.paramTOCGetInfo(ctx, version)
 	if err != nil {
 		return err
 	}
 
-	err = cache.LoadParam(crc, &cf.paramNameToIndex)
+	err = cache.LoadParam(crc, version, &cf.paramNameToIndex)
 	if err == nil {
 		for k, v := range cf.paramNameToIndex {
 			cf.paramIndexToName[v.ID] = k
@@ -124,54 +115,29 @@ func (cf *Crazyflie) ParamTOCGetList() error {
 		return nil
 	}
 
-	// the packet to initialize the transaction
-	packet := []byte{crtp(crtpPortParam, 0), 0x00, 0x00}
-
-	// the function which matches and acts on the response packet
-	callbackTriggered := make(chan bool)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortParam && header.channel() == 0 && resp[1] == 0x00 {
-			id := uint8(resp[2])
-			datatype := resp[3] & 0x0F
-			readonly := resp[3]&(1<<6) != 0
-			// group := resp[3]&(1<<7) != 0
-
-			str := strings.Split(string(resp[4:]), "\x00")
-			groupName := str[0]
-			varName := str[1]
-			name := groupName + "." + varName
-
-			// log.Printf("%s -> id: %d, group: %t, dtype: %X, readonly: %t", name, id, group, datatype, readonly)
-
-			cf.paramNameToIndex[name] = paramItem{id, datatype, readonly}
-			cf.paramIndexToName[id] = name
-
-			callbackTriggered <- true
-		}
+	items, err := cf.tocGetItems(ctx, crtpPortParam, version, cf.paramCount)
+	if err != nil {
+		return err
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortParam].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortParam].Remove(e) // and remove it once we're done
+	for _, resp := range items {
+		id, paramtype, name, err := tocItemParse(resp, version)
+		if err != nil {
+			return err
+		}
+		datatype := paramtype & 0x0F
+		readonly := paramtype&(1<<6) != 0
+		// group := paramtype&(1<<7) != 0
 
-	for i := 0; i < cf.paramCount; {
-		packet[2] = uint8(i)  // the parameter we want to read
-		cf.PacketSend(packet) // schedule transmission of the packet
+		// log.Printf("%s -> id: %d, group: %t, dtype: %X, readonly: %t", name, id, group, datatype, readonly)
 
-		select {
-		case <-callbackTriggered:
-			i++
-		case <-time.After(500 * time.Millisecond):
-			// no increment
-		}
+		cf.paramNameToIndex[name] = paramItem{id, datatype, readonly}
+		cf.paramIndexToName[id] = name
 	}
 
 	log.Printf("Loaded Param TOC Size %d with CRC %X", cf.paramCount, cf.paramCRC)
 
-	err = cache.SaveParam(crc, &cf.paramNameToIndex)
+	err = cache.SaveParam(crc, version, &cf.paramNameToIndex)
 	if err != nil {
 		log.Printf("Error while caching: %s", err)
 	}
@@ -208,41 +174,36 @@ func (cf *Crazyflie) ParamGetToc() []ParamTocItem {
 	return list
 }
 
-func (cf *Crazyflie) ParamRead(name string) (interface{}, error) {
+func (cf *Crazyflie) ParamRead(ctx context.Context, name string) (interface{}, error) {
 	param, ok := cf.paramNameToIndex[name]
 	if !ok {
 		return nil, ErrorParamNotFound
 	}
 
-	// the packet to initialize the transaction
-	packet := []byte{crtp(crtpPortParam, 1), param.ID}
-
-	// the function which matches and acts on the response packet
-	callbackTriggered := make(chan interface{})
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
-
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortParam && header.channel() == 1 && resp[1] == param.ID {
-			callbackTriggered <- paramTypeToValue[param.Datatype](resp[2:])
-		}
+	version, err := cf.tocVersion(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortParam].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortParam].Remove(e) // and remove it once we're done
+	packet := append([]byte{crtp(crtpPortParam, 1)}, paramIDBytes(version, param.ID)...)
 
-	cf.PacketSend(packet) // schedule transmission of the packet
+	// the v2 answer has a status byte between the id and the value
+	offset := len(packet)
+	if version == 2 {
+		offset++
+	}
 
-	select {
-	case value := <-callbackTriggered:
-		return value, nil
-	case <-time.After(500 * time.Millisecond):
-		return nil, ErrorNoResponse
+	resp, err := cf.Transact(ctx, packet, matchAnswer(packet, len(packet)-1, offset+int(paramTypeToSize[param.Datatype])), DefaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if version == 2 && resp[offset-1] != 0 {
+		return nil, ErrorParamNotFound
 	}
+	return paramTypeToValue[param.Datatype](resp[offset:]), nil
 }
 
-func (cf *Crazyflie) ParamWriteFromFloat64(name string, valf float64) error {
+func (cf *Crazyflie) ParamWriteFromFloat64(ctx context.Context, name string, valf float64) error {
 	param, ok := cf.paramNameToIndex[name]
 	if !ok {
 		return ErrorParamNotFound
@@ -267,45 +228,31 @@ func (cf *Crazyflie) ParamWriteFromFloat64(name string, valf float64) error {
 		val = float32(valf)
 	}
 
-	return cf.ParamWrite(name, val)
+	return cf.ParamWrite(ctx, name, val)
 }
 
-func (cf *Crazyflie) ParamWrite(name string, val interface{}) error {
+func (cf *Crazyflie) ParamWrite(ctx context.Context, name string, val interface{}) error {
 	param, ok := cf.paramNameToIndex[name]
 	if !ok {
 		return ErrorParamNotFound
 	}
 
+	version, err := cf.tocVersion(ctx)
+	if err != nil {
+		return err
+	}
+
 	// the packet to initialize the transaction
-	datasize := int(paramTypeToSize[param.Datatype])
-	packet := make([]byte, datasize+2)
-	packet[0] = crtp(crtpPortParam, 2)
-	packet[1] = param.ID
+	id := paramIDBytes(version, param.ID)
 	databytes := paramTypeToBytes[param.Datatype](val)
-	copy(packet[2:], databytes)
-
-	// the function which matches and acts on the response packet
-	callbackTriggered := make(chan []byte)
-	callback := func(resp []byte) {
-		header := crtpHeader(resp[0])
+	packet := append([]byte{crtp(crtpPortParam, 2)}, id...)
+	packet = append(packet, databytes...)
 
-		// should check the header port and channel like this (rather than check the hex value of resp[0]) since the link bits might vary(?)
-		if header.port() == crtpPortParam && header.channel() == 2 && resp[1] == param.ID {
-			callbackTriggered <- resp[2:]
-		}
+	resp, err := cf.Transact(ctx, packet, matchAnswer(packet, len(id), 1+len(id)), DefaultRetryPolicy)
+	if err != nil {
+		return err
 	}
 
-	// add the callback to the list
-	e := cf.responseCallbacks[crtpPortParam].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortParam].Remove(e) // and remove it once we're done
-
-	cf.PacketSend(packet) // schedule transmission of the packet
-
-	select {
-	case value := <-callbackTriggered:
-		log.Printf("%v -> %v", databytes, value)
-		return nil
-	case <-time.After(500 * time.Millisecond):
-		return ErrorNoResponse
-	}
+	log.Printf("%v -> %v", databytes, resp[1+len(id):])
+	return nil
 }
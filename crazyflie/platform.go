@@ -0,0 +1,54 @@
+package crazyflie
+
+import "context"
+
+// the CRTP protocol version from which the firmware has the v2 log and param TOCs, with 16-bit ids
+const tocV2ProtocolVersion = 4
+
+// the firmware which predates the version request never answers it, so it is not asked for long
+var protocolVersionRetryPolicy = RetryPolicy{Interval: retryInterval, Attempts: 3}
+
+func (cf *Crazyflie) platformSystemInit() {
+	cf.protocolVersionLock.Lock()
+	defer cf.protocolVersionLock.Unlock()
+
+	cf.protocolVersionKnown = false // the firmware may have changed, eg. after a reflash
+}
+
+// ProtocolVersion returns the CRTP protocol version of the firmware, requested over the platform port once per connection.
+// The firmware which does not answer predates the version request, which is protocol version 0.
+func (cf *Crazyflie) ProtocolVersion(ctx context.Context) (int, error) {
+	cf.protocolVersionLock.Lock()
+	defer cf.protocolVersionLock.Unlock()
+
+	if cf.protocolVersionKnown {
+		return cf.protocolVersion, nil
+	}
+
+	packet := []byte{crtp(crtpPortPlatform, 1), 0x00} // get protocol version command
+
+	resp, err := cf.Transact(ctx, packet, matchAnswer(packet, 1, 3), protocolVersionRetryPolicy)
+	switch {
+	case err == nil:
+		cf.protocolVersion = int(resp[2])
+	case err == ErrorNoResponse && ctx.Err() == nil:
+		cf.protocolVersion = 0
+	default:
+		return 0, err
+	}
+
+	cf.protocolVersionKnown = true
+	return cf.protocolVersion, nil
+}
+
+// tocVersion returns the version of the log and param TOC protocols of the firmware: 2 with 16-bit ids, otherwise 1
+func (cf *Crazyflie) tocVersion(ctx context.Context) (int, error) {
+	protocolVersion, err := cf.ProtocolVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if protocolVersion >= tocV2ProtocolVersion {
+		return 2, nil
+	}
+	return 1, nil
+}
@@ -1,62 +1,71 @@
 package crazyflie
 
 import (
+	"context"
 	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
 )
 
 //https://forum.bitcraze.io/viewtopic.php?f=9&t=1488
 
-func (cf *Crazyflie) RebootToFirmware() error {
-	callbackData := make(chan []byte)
-	callback := func(resp []byte) {
-		if resp[0] == 0xFF {
-			callbackData <- resp
-		}
+// how long a rebooting Crazyflie is left alone before connecting to it again
+const rebootDelay = 500 * time.Millisecond
+
+// reboot sends the reboot packets, returning the answer of the Crazyflie to the init packet
+func (cf *Crazyflie) reboot(ctx context.Context, initPacket []byte, rebootPacket []byte) ([]byte, error) {
+	resp, err := cf.Transact(ctx, initPacket, matchAnswer(initPacket, 2, 7), DefaultRetryPolicy)
+	if err != nil {
+		return nil, err
 	}
 
-	e := cf.responseCallbacks[crtpPortGreedy].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortGreedy].Remove(e)
+	// only once the Crazyflie is known to be listening, since it stops answering as it reboots
+	if err := cf.PacketSend(rebootPacket); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
 
+func (cf *Crazyflie) RebootToFirmware(ctx context.Context) error {
 	initPacket := []byte{0xFF, 0xFE, 0xFF, 1, 2, 4, 5, 6, 7, 8, 9, 10, 11, 12} //need these extra bytes due to CF1 legacy
 	rebootPacket := []byte{0xFF, 0xFE, 0xF0, 0x01}
 
-	// important that these two packets are serviced directly after each other
-	cf.PacketSend(initPacket)
-	cf.PacketSend(rebootPacket)
-
-	<-callbackData
-
-	cf.DisconnectOnEmpty()
-
-	<-time.After(500 * time.Millisecond)
-
-	return cf.connect(cf.firmwareAddress, cf.firmwareChannel)
-}
+	_, err := cf.reboot(ctx, initPacket, rebootPacket)
+	if err != nil {
+		return err
+	}
 
-func (cf *Crazyflie) RebootToBootloader() error {
-	callbackData := make(chan []byte)
-	callback := func(resp []byte) {
-		if resp[0] == 0xFF {
-			callbackData <- resp
-		}
+	if err := cf.DisconnectOnEmpty(ctx); err != nil {
+		return err
+	}
+	if err := sleep(ctx, rebootDelay); err != nil {
+		return err
 	}
 
-	e := cf.responseCallbacks[crtpPortGreedy].PushBack(callback)
-	defer cf.responseCallbacks[crtpPortGreedy].Remove(e)
+	cf.link = cf.firmwareLink
+	return cf.connect(ctx, cf.firmwareAddress, cf.firmwareChannel, cf.firmwareDatarate)
+}
 
+func (cf *Crazyflie) RebootToBootloader(ctx context.Context) error {
 	initPacket := []byte{0xFF, 0xFE, 0xFF}
 	rebootPacket := []byte{0xFF, 0xFE, 0xF0, 0x00}
 
-	cf.PacketSend(initPacket)
-	cf.PacketSend(rebootPacket) // initialize the reboot
-
-	data := <-callbackData
+	data, err := cf.reboot(ctx, initPacket, rebootPacket)
+	if err != nil {
+		return err
+	}
 
 	bootloaderAddress := uint64(data[3]) | (uint64(data[4]) << 8) | (uint64(data[5]) << 16) | (uint64(data[6]) << 24) | (uint64(0xb1) << 32)
 
-	cf.DisconnectOnEmpty()
-
-	<-time.After(500 * time.Millisecond)
+	if err := cf.DisconnectOnEmpty(ctx); err != nil {
+		return err
+	}
+	if err := sleep(ctx, rebootDelay); err != nil {
+		return err
+	}
 
-	return cf.connect(bootloaderAddress, 0)
+	if cf.scheme == "usb" {
+		cf.link = RadioLink // the bootloader of a Crazyflie connected over USB only listens on the radio
+	}
+	return cf.connect(ctx, bootloaderAddress, 0, crazyradio.RadioDatarate_2MPS)
 }
@@ -0,0 +1,187 @@
+package crazyflie
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// ReplayLink is a Link which plays a radio capture (see crazyradio.CaptureStart) back to the Crazyflies connected over it.
+// Every acknowledgement recorded for a Crazyflie is delivered to it again, with the original timing, such that the crazyflie
+// package can be run against the traffic of a past session offline. The packets sent over the link are recorded, not transmitted.
+//
+// A capture holds the exchanges of the radio threads with the registered Crazyflies only: broadcasts and scans (which take
+// over a radio) are not recorded, so they cannot be replayed. The acknowledgements are replayed on the wall clock, from the
+// time the Crazyflie is registered, rather than in answer to the packets sent: a Crazyflie replayed against other requests
+// than those of the capture receives the original answers, at the original times.
+type ReplayLink struct {
+	lock    sync.Mutex
+	records []crazyradio.CaptureRecord
+	replays map[replayKey]*replay
+	speed   float64
+}
+
+type replayKey struct {
+	channel uint8
+	address uint64
+}
+
+type replay struct {
+	stats crazyradio.LinkStats
+	sent  [][]byte
+	stop  chan bool
+}
+
+// NewReplayLink reads a capture to be replayed. At speed 1 the acknowledgements are replayed with their original timing,
+// at speed 2 twice as fast and so on; at speed 0 they are replayed as fast as possible.
+func NewReplayLink(r io.Reader, speed float64) (*ReplayLink, error) {
+	link := &ReplayLink{
+		replays: make(map[replayKey]*replay),
+		speed:   speed,
+	}
+
+	reader := crazyradio.NewCaptureReader(r)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		link.records = append(link.records, record)
+	}
+
+	return link, nil
+}
+
+// Crazyflies returns the channel, datarate and address of every Crazyflie which acknowledged a packet in the capture
+func (link *ReplayLink) Crazyflies() []LinkURI {
+	seen := make(map[replayKey]bool)
+	uris := make([]LinkURI, 0)
+	for _, record := range link.records {
+		key := replayKey{record.Channel, record.Address}
+		if record.Acked && !seen[key] {
+			seen[key] = true
+			uris = append(uris, LinkURI{Scheme: "radio", Dongle: record.Dongle, Channel: record.Channel, Datarate: record.Datarate, Address: record.Address})
+		}
+	}
+	return uris
+}
+
+func (link *ReplayLink) CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	records := make([]crazyradio.CaptureRecord, 0)
+	acked := false
+	for _, record := range link.records {
+		if record.Channel == channel && record.Address == address {
+			records = append(records, record)
+			acked = acked || record.Acked
+		}
+	}
+	if !acked {
+		return ErrorNoResponse
+	}
+
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	key := replayKey{channel, address}
+	if r, ok := link.replays[key]; ok {
+		close(r.stop)
+	}
+	r := &replay{stop: make(chan bool)}
+	link.replays[key] = r
+
+	go link.replayThread(r, records, responseCallback)
+	return nil
+}
+
+func (link *ReplayLink) replayThread(r *replay, records []crazyradio.CaptureRecord, responseCallback func([]byte)) {
+	start := time.Now()
+
+	for _, record := range records {
+		if link.speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(records[0].Time)) / link.speed)
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(time.Until(start.Add(offset))):
+			}
+		} else {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+		}
+
+		var err error
+		if record.Error != "" {
+			err = ErrorUnknown
+		}
+		link.lock.Lock()
+		r.stats.Update(crazyradio.Ack{Received: record.Acked, PowerDetector: record.PowerDetector, Retries: record.Retries, Data: record.Response}, err)
+		link.lock.Unlock()
+
+		if record.Acked && err == nil {
+			responseCallback(record.Response)
+		}
+	}
+}
+
+func (link *ReplayLink) CrazyflieRemove(channel uint8, address uint64) {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	key := replayKey{channel, address}
+	if r, ok := link.replays[key]; ok {
+		close(r.stop)
+		delete(link.replays, key)
+	}
+}
+
+func (link *ReplayLink) packetRecord(channel uint8, address uint64, packet []byte) {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	if r, ok := link.replays[replayKey{channel, address}]; ok {
+		r.sent = append(r.sent, append([]byte{}, packet...))
+	}
+}
+
+func (link *ReplayLink) PacketSend(channel uint8, address uint64, packet []byte) error {
+	link.packetRecord(channel, address, packet)
+	return nil
+}
+
+func (link *ReplayLink) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	link.packetRecord(channel, address, packet)
+}
+
+func (link *ReplayLink) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	return nil // nothing is queued, packets are recorded as they are sent
+}
+
+func (link *ReplayLink) LinkStats(channel uint8, address uint64) crazyradio.LinkStats {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	if r, ok := link.replays[replayKey{channel, address}]; ok {
+		return r.stats
+	}
+	return crazyradio.LinkStats{}
+}
+
+// Sent returns the packets sent to a Crazyflie during the replay, eg. to compare them with the capture
+func (link *ReplayLink) Sent(channel uint8, address uint64) [][]byte {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	if r, ok := link.replays[replayKey{channel, address}]; ok {
+		return append([][]byte{}, r.sent...)
+	}
+	return nil
+}
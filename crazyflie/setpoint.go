@@ -1,18 +1,28 @@
 package crazyflie
 
+import (
+	"time"
+
+	"github.com/mikehamer/crazyserver/internal/protocol"
+)
+
+// a setpoint older than this is dropped rather than sent, since a newer one is on its way.
+// A setpoint (or position) which has not been sent yet is also replaced by the next one.
+const setpointDeadline = 50 * time.Millisecond
+
 func (cf *Crazyflie) SetpointSend(roll, pitch, yawrate float32, thrust uint16) {
 
 	// the packet to initialize the transaction
 	packet := make([]byte, 1+3*4+2)
 	packet[0] = crtp(crtpPortSetpoint, 0)
-	copy(packet[1:5], float32ToBytes(roll))
-	copy(packet[5:9], float32ToBytes(pitch))
-	copy(packet[9:13], float32ToBytes(yawrate))
-	copy(packet[13:15], uint16ToBytes(thrust))
+	copy(packet[1:5], protocol.Float32ToBytes(roll))
+	copy(packet[5:9], protocol.Float32ToBytes(pitch))
+	copy(packet[9:13], protocol.Float32ToBytes(yawrate))
+	copy(packet[13:15], protocol.Uint16ToBytes(thrust))
 
 	// don't wait for a callback just send and be done with it
 
-	cf.PacketSendPriority(packet) // schedule transmission of the packet
+	cf.PacketSendLatest(slotSetpoint, packet, time.Now().Add(setpointDeadline)) // schedule transmission of the packet
 }
 
 func (cf *Crazyflie) ExternalPositionSend(x, y, z float32) {
@@ -20,11 +30,11 @@ func (cf *Crazyflie) ExternalPositionSend(x, y, z float32) {
 	// the packet to initialize the transaction
 	packet := make([]byte, 1+3*4)
 	packet[0] = crtp(crtpPortPosition, 0)
-	copy(packet[1:5], float32ToBytes(x))
-	copy(packet[5:9], float32ToBytes(y))
-	copy(packet[9:13], float32ToBytes(z))
+	copy(packet[1:5], protocol.Float32ToBytes(x))
+	copy(packet[5:9], protocol.Float32ToBytes(y))
+	copy(packet[9:13], protocol.Float32ToBytes(z))
 
 	// don't wait for a callback just send and be done with it
 
-	cf.PacketSendPriority(packet) // schedule transmission of the packet
+	cf.PacketSendLatest(slotPosition, packet, time.Now().Add(setpointDeadline)) // schedule transmission of the packet
 }
@@ -0,0 +1,33 @@
+package crazyflie
+
+import (
+	"sync"
+
+	"github.com/mikehamer/crazyserver/radioshare"
+)
+
+// the connections to radio-share servers, shared by all the Crazyflies reached through the same server
+var shareLinks = make(map[string]*radioshare.Link)
+var shareLinksLock sync.Mutex
+
+// shareLink returns the link to the radio-share server at host, connecting if there is none yet
+func shareLink(host string) (Link, error) {
+	shareLinksLock.Lock()
+	defer shareLinksLock.Unlock()
+
+	if link, ok := shareLinks[host]; ok {
+		select {
+		case <-link.Closed():
+			delete(shareLinks, host) // the server went away, connect again
+		default:
+			return link, nil
+		}
+	}
+
+	link, err := radioshare.Dial(host)
+	if err != nil {
+		return nil, err
+	}
+	shareLinks[host] = link
+	return link, nil
+}
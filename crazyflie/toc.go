@@ -0,0 +1,141 @@
+package crazyflie
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
+)
+
+// how many TOC item requests are in flight at once while downloading a TOC
+const tocWindow = 8
+
+// The log and param TOCs share their commands. The v1 commands number the items with 8-bit ids, which limits
+// a TOC to 255 items, the v2 commands of the recent firmware (see tocVersion) with 16-bit little endian ids.
+const (
+	tocCommandItemV1 byte = 0x00
+	tocCommandInfoV1      = 0x01
+	tocCommandItemV2      = 0x02
+	tocCommandInfoV2      = 0x03
+)
+
+// tocGetInfo requests the info of the TOC on port, returning its item count, its CRC and the extra bytes which follow them
+func (cf *Crazyflie) tocGetInfo(ctx context.Context, port crtpPort, version int, extra int) (int, uint32, []byte, error) {
+	packet := []byte{crtp(port, 0), tocCommandInfoV1}
+	countSize := 1
+	if version == 2 {
+		packet[1] = tocCommandInfoV2
+		countSize = 2
+	}
+
+	resp, err := cf.Transact(ctx, packet, matchAnswer(packet, 1, 2+countSize+4+extra), DefaultRetryPolicy)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	count := int(resp[2])
+	if version == 2 {
+		count = int(binary.LittleEndian.Uint16(resp[2:4]))
+	}
+	crc := binary.LittleEndian.Uint32(resp[2+countSize : 2+countSize+4])
+	return count, crc, resp[2+countSize+4:], nil
+}
+
+// tocItemRequest is the packet requesting the item id of the TOC on port
+func tocItemRequest(port crtpPort, version int, id int) []byte {
+	if version == 2 {
+		return []byte{crtp(port, 0), tocCommandItemV2, uint8(id), uint8(id >> 8)}
+	}
+	return []byte{crtp(port, 0), tocCommandItemV1, uint8(id)}
+}
+
+// tocItemParse returns the id, type and name (group.name) of the item described by the answer to tocItemRequest,
+// or ErrorTOCItemInvalid if the answer is truncated or its name is not terminated
+func tocItemParse(resp []byte, version int) (uint16, uint8, string, error) {
+	idSize := 1
+	if version == 2 {
+		idSize = 2
+	}
+	if len(resp) < 3+idSize {
+		return 0, 0, "", ErrorTOCItemInvalid
+	}
+
+	id := uint16(resp[2])
+	if version == 2 {
+		id = binary.LittleEndian.Uint16(resp[2:4])
+	}
+	datatype := resp[2+idSize]
+
+	str := strings.Split(string(resp[3+idSize:]), "\x00")
+	if len(str) < 2 {
+		return 0, 0, "", ErrorTOCItemInvalid
+	}
+	groupName := str[0]
+	varName := str[1]
+	return id, datatype, groupName + "." + varName, nil
+}
+
+// tocGetItems requests the count items of the TOC on port, keeping tocWindow requests in flight, and returns the
+// answers indexed by item id. The answers are matched by id, so a lost one only delays its own item.
+func (cf *Crazyflie) tocGetItems(ctx context.Context, port crtpPort, version int, count int) ([][]byte, error) {
+	// released once the TOC is downloaded, or as soon as an item fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	items := make([][]byte, count)
+	ids := make(chan int)
+	errs := make(chan error, tocWindow) // at most one per worker
+
+	var waitGroup sync.WaitGroup
+	for w := 0; w < tocWindow && w < count; w++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for id := range ids {
+				packet := tocItemRequest(port, version, id)
+				resp, err := cf.Transact(ctx, packet, matchAnswer(packet, len(packet)-1, len(packet)+2), DefaultRetryPolicy)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				items[id] = resp
+			}
+		}()
+	}
+
+feed:
+	for id := 0; id < count; id++ {
+		select {
+		case ids <- id:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ids)
+	waitGroup.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err // the first failed item, the others failed because it cancelled them
+	default:
+	}
+	if ctx.Err() != nil {
+		return nil, contextError(ctx)
+	}
+	return items, nil
+}
+
+// TOCGetLists downloads the log and param TOCs at the same time, see LogTOCGetList and ParamTOCGetList
+func (cf *Crazyflie) TOCGetLists(ctx context.Context) error {
+	logErr := make(chan error, 1)
+	go func() {
+		logErr <- cf.LogTOCGetList(ctx)
+	}()
+
+	paramErr := cf.ParamTOCGetList(ctx)
+	if err := <-logErr; err != nil {
+		return err
+	}
+	return paramErr
+}
@@ -0,0 +1,119 @@
+package crazyflie
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mikehamer/crazyserver/cache"
+)
+
+func TestTOCVersions(t *testing.T) {
+	for _, test := range []struct {
+		protocolVersion int
+		tocVersion      int
+	}{
+		{0, 1}, // predates the version request
+		{3, 1},
+		{4, 2},
+	} {
+		cache.Clear()
+
+		for _, cached := range []bool{false, true} { // the second connection reads the TOCs from the cache
+			cf, _ := simConnect(t, test.protocolVersion)
+
+			if err := cf.TOCGetLists(context.Background()); err != nil {
+				t.Fatalf("protocol %d (cached %v): %v", test.protocolVersion, cached, err)
+			}
+			version, err := cf.tocVersion(context.Background())
+			if err != nil || version != test.tocVersion {
+				t.Fatalf("protocol %d: TOC version %d (%v), expecting %d", test.protocolVersion, version, err, test.tocVersion)
+			}
+			if _, err := cf.ParamRead(context.Background(), "pid_rate.roll_kp"); err != nil {
+				t.Fatalf("protocol %d (cached %v): %v", test.protocolVersion, cached, err)
+			}
+		}
+	}
+}
+
+func TestTOCItemParse(t *testing.T) {
+	header := crtp(crtpPortLog, 0)
+	for _, test := range []struct {
+		resp    []byte
+		version int
+		id      uint16
+		name    string
+		err     error
+	}{
+		{[]byte{header, 0x00, 5, 7, 'p', 'm', 0, 'v', 'b', 'a', 't', 0}, 1, 5, "pm.vbat", nil},
+		{[]byte{header, 0x02, 5, 1, 7, 'p', 'm', 0, 'v', 'b', 'a', 't', 0}, 2, 261, "pm.vbat", nil},
+		{[]byte{header, 0x00, 5, 7, 'p', 'm'}, 1, 0, "", ErrorTOCItemInvalid}, // truncated in the group name
+		{[]byte{header, 0x00, 5}, 1, 0, "", ErrorTOCItemInvalid},              // without a type
+		{[]byte{header, 0x02, 5}, 2, 0, "", ErrorTOCItemInvalid},              // half an id
+	} {
+		id, _, name, err := tocItemParse(test.resp, test.version)
+		if id != test.id || name != test.name || err != test.err {
+			t.Fatalf("%x parsed as %d %q (%v), expecting %d %q (%v)", test.resp, id, name, err, test.id, test.name, test.err)
+		}
+	}
+}
+
+func TestTOCGetItemsPipelined(t *testing.T) {
+	const count = 20
+	cf, link := manualConnect(t)
+	answer := func(request []byte) {
+		id := request[2]
+		cf.responseHandler(append([]byte{request[0], request[1], id, 7}, fmt.Sprintf("group\x00item%d\x00", id)...))
+	}
+
+	type result struct {
+		items [][]byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		items, err := cf.tocGetItems(context.Background(), crtpPortParam, 1, count)
+		done <- result{items, err}
+	}()
+
+	requests := make([][]byte, 0, tocWindow)
+	for len(requests) < tocWindow {
+		requests = append(requests, <-link.sent)
+	}
+	select {
+	case request := <-link.sent:
+		t.Fatalf("request %v sent beyond the window", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the window is answered in reverse order, and the answer to its first request is lost
+	for i := len(requests) - 1; i > 0; i-- {
+		answer(requests[i])
+	}
+
+	var r result
+serve:
+	for {
+		select {
+		case request := <-link.sent:
+			answer(request)
+		case r = <-done:
+			break serve
+		}
+	}
+
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	for id, item := range r.items {
+		itemID, _, name, err := tocItemParse(item, 1)
+		if err != nil || int(itemID) != id || name != fmt.Sprintf("group.item%d", id) {
+			t.Fatalf("item %d is %d %q (%v)", id, itemID, name, err)
+		}
+	}
+
+	if stats := cf.TransactionStats()["param/0"]; stats.Transactions != count || stats.Sent != count+1 {
+		t.Fatalf("stats %+v, expecting %d transactions with one retry", stats, count)
+	}
+}
@@ -0,0 +1,215 @@
+package crazyflie
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy is how long a transaction waits for the answer of the Crazyflie, see Transact
+type RetryPolicy struct {
+	Interval time.Duration // how long to wait for an answer before sending the request again
+	Attempts int           // how many times the request is sent before giving up, 0 to retry until the context is done
+}
+
+// DefaultRetryPolicy is the policy of the requests to the Crazyflie firmware
+var DefaultRetryPolicy = RetryPolicy{Interval: retryInterval, Attempts: 4}
+
+// the bootloader answers as soon as it receives a request, so a lost request is resent sooner
+var bootloaderRetryPolicy = RetryPolicy{Interval: 20 * time.Millisecond, Attempts: 25}
+
+// TransactionStats are the statistics of the transactions of one kind, see Crazyflie.TransactionStats
+type TransactionStats struct {
+	Transactions uint64  `json:"transactions"`
+	Sent         uint64  `json:"sent"`       // requests sent, including the retries
+	Failed       uint64  `json:"failed"`     // transactions which were not answered
+	Duplicates   uint64  `json:"duplicates"` // answers discarded because the transaction was already answered
+	Latency      float64 `json:"latency"`    // the total time taken by the answered transactions, in seconds
+}
+
+var crtpPortName = map[crtpPort]string{
+	crtpPortConsole:    "console",
+	crtpPortParam:      "param",
+	crtpPortSetpoint:   "setpoint",
+	crtpPortMem:        "mem",
+	crtpPortLog:        "log",
+	crtpPortPosition:   "position",
+	crtpPortSetpointHL: "setpoint-hl",
+	crtpPortPlatform:   "platform",
+	crtpPortLink:       "link",
+}
+
+// transactionKind names the kind of a request by its port and channel, eg. log/1 for the log control requests
+func transactionKind(packet []byte) string {
+	header := crtpHeader(packet[0])
+	if name, ok := crtpPortName[header.Port()]; ok {
+		return fmt.Sprintf("%s/%d", name, header.Channel())
+	}
+	return fmt.Sprintf("%d/%d", header.Port(), header.Channel())
+}
+
+// matchAnswer returns a matcher of the answers to packet: the responses on its port and channel which echo
+// the echoed bytes following its header (eg. a command and an id), and which are at least length bytes long
+func matchAnswer(packet []byte, echoed int, length int) func([]byte) bool {
+	header := crtpHeader(packet[0])
+	prefix := packet[1 : 1+echoed]
+
+	return func(resp []byte) bool {
+		if len(resp) < length || len(resp) < 1+echoed {
+			return false
+		}
+		respHeader := crtpHeader(resp[0])
+		return respHeader.Port() == header.Port() && respHeader.Channel() == header.Channel() && bytes.Equal(resp[1:1+echoed], prefix)
+	}
+}
+
+// lateAnswer is an answer still expected to a request sent several times, once its transaction is done
+type lateAnswer struct {
+	match     func(resp []byte) bool
+	remaining int       // answers still expected, one per request sent and not answered
+	expires   time.Time // when the answers are no longer expected
+}
+
+// Transact sends packet to the Crazyflie and returns the first response accepted by match, sending the packet again
+// as the policy allows while it is not answered. The answers arriving once the transaction is answered (eg. to a request
+// sent again) are discarded, also when they arrive after Transact returned and until one retry interval has passed,
+// such that they are not taken as the answer to the next request of the same kind.
+// ErrorNoResponse is returned once the attempts are exhausted, or when the deadline of ctx passes.
+// match is called on the dispatcher (see subscribe), so it must not block.
+func (cf *Crazyflie) Transact(ctx context.Context, packet []byte, match func(resp []byte) bool, policy RetryPolicy) ([]byte, error) {
+	kind := transactionKind(packet)
+	port := crtpHeader(packet[0]).Port()
+	start := time.Now()
+
+	answer := make(chan []byte, 1)
+	var answers int32 // the responses accepted by match, counted on the dispatcher
+	unsubscribe := cf.subscribe(port, func(resp []byte) {
+		if !match(resp) {
+			return
+		}
+		if cf.lateAnswerDiscard(port, resp) {
+			cf.transactionRecord(kind, func(stats *TransactionStats) { stats.Duplicates++ })
+			return
+		}
+		atomic.AddInt32(&answers, 1)
+		select {
+		case answer <- resp:
+		default:
+			cf.transactionRecord(kind, func(stats *TransactionStats) { stats.Duplicates++ })
+		}
+	})
+
+	var attempt int
+	defer func() {
+		unsubscribe()
+		if remaining := attempt - int(atomic.LoadInt32(&answers)); remaining > 0 && policy.Interval > 0 {
+			cf.lateAnswerExpect(port, &lateAnswer{match, remaining, time.Now().Add(policy.Interval)})
+		}
+	}()
+
+	for attempt = 1; ; attempt++ {
+		cf.PacketSend(packet) // a packet dropped by a full queue is an attempt lost, which is retried as any other
+
+		var retry <-chan time.Time // without an interval, the request is sent once and waits for ctx
+		if policy.Interval > 0 {
+			retry = time.After(policy.Interval)
+		}
+
+		select {
+		case resp := <-answer:
+			cf.transactionRecord(kind, func(stats *TransactionStats) {
+				stats.Transactions++
+				stats.Sent += uint64(attempt)
+				stats.Latency += time.Since(start).Seconds()
+			})
+			return resp, nil
+
+		case <-retry:
+			if policy.Attempts == 0 || attempt < policy.Attempts {
+				continue
+			}
+			cf.transactionRecord(kind, func(stats *TransactionStats) {
+				stats.Transactions++
+				stats.Sent += uint64(attempt)
+				stats.Failed++
+			})
+			return nil, ErrorNoResponse
+
+		case <-ctx.Done():
+			cf.transactionRecord(kind, func(stats *TransactionStats) {
+				stats.Transactions++
+				stats.Sent += uint64(attempt)
+				stats.Failed++
+			})
+			return nil, contextError(ctx)
+		}
+	}
+}
+
+// lateAnswerExpect records the answers still expected to a transaction which is done
+func (cf *Crazyflie) lateAnswerExpect(port crtpPort, late *lateAnswer) {
+	cf.transactionsLock.Lock()
+	defer cf.transactionsLock.Unlock()
+
+	if cf.lateAnswers == nil {
+		cf.lateAnswers = make(map[crtpPort][]*lateAnswer)
+	}
+	cf.lateAnswers[port] = append(cf.lateAnswers[port], late)
+}
+
+// lateAnswerDiscard returns whether resp is a late answer to a transaction which is done, and must be discarded
+func (cf *Crazyflie) lateAnswerDiscard(port crtpPort, resp []byte) bool {
+	cf.transactionsLock.Lock()
+	defer cf.transactionsLock.Unlock()
+
+	if len(cf.lateAnswers[port]) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	expected := cf.lateAnswers[port][:0]
+	discard := false
+	for _, late := range cf.lateAnswers[port] {
+		if now.After(late.expires) {
+			continue
+		}
+		if !discard && late.match(resp) {
+			discard = true
+			late.remaining--
+		}
+		if late.remaining > 0 {
+			expected = append(expected, late)
+		}
+	}
+	cf.lateAnswers[port] = expected
+	return discard
+}
+
+func (cf *Crazyflie) transactionRecord(kind string, update func(stats *TransactionStats)) {
+	cf.transactionsLock.Lock()
+	defer cf.transactionsLock.Unlock()
+
+	if cf.transactions == nil {
+		cf.transactions = make(map[string]*TransactionStats)
+	}
+	stats, ok := cf.transactions[kind]
+	if !ok {
+		stats = new(TransactionStats)
+		cf.transactions[kind] = stats
+	}
+	update(stats)
+}
+
+// TransactionStats returns the statistics of the transactions with the Crazyflie, by kind (eg. param/1 for the parameter reads)
+func (cf *Crazyflie) TransactionStats() map[string]TransactionStats {
+	cf.transactionsLock.Lock()
+	defer cf.transactionsLock.Unlock()
+
+	stats := make(map[string]TransactionStats, len(cf.transactions))
+	for kind, s := range cf.transactions {
+		stats[kind] = *s
+	}
+	return stats
+}
@@ -0,0 +1,112 @@
+package crazyflie
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// manualLink hands the packets sent to the test, which answers them by calling the response handler
+type manualLink struct {
+	sent chan []byte
+}
+
+func (link *manualLink) CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	return nil
+}
+
+func (link *manualLink) CrazyflieRemove(channel uint8, address uint64) {}
+
+func (link *manualLink) PacketSend(channel uint8, address uint64, packet []byte) error {
+	link.sent <- packet
+	return nil
+}
+
+func (link *manualLink) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	link.sent <- packet
+}
+
+func (link *manualLink) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	return nil
+}
+
+func (link *manualLink) LinkStats(channel uint8, address uint64) crazyradio.LinkStats {
+	return crazyradio.LinkStats{}
+}
+
+func manualConnect(t *testing.T) (*Crazyflie, *manualLink) {
+	link := &manualLink{make(chan []byte, 16)}
+	cf := &Crazyflie{link: link}
+	cf.communicationSystemInit()
+	t.Cleanup(func() {
+		close(cf.disconnect)
+		cf.waitGroup.Wait()
+	})
+	return cf, link
+}
+
+func TestTransactLateAnswer(t *testing.T) {
+	cf, link := manualConnect(t)
+	policy := RetryPolicy{Interval: 50 * time.Millisecond, Attempts: 4}
+	packet := []byte{crtp(crtpPortLog, 1), 0x02, 0}
+	answer := func(code byte) { cf.responseHandler([]byte{packet[0], packet[1], packet[2], code}) }
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	transact := func() chan result {
+		done := make(chan result, 1)
+		go func() {
+			resp, err := cf.Transact(context.Background(), packet, matchAnswer(packet, 2, 4), policy)
+			done <- result{resp, err}
+		}()
+		return done
+	}
+
+	// the answer to the first attempt is late, the second attempt is answered
+	done := transact()
+	<-link.sent
+	<-link.sent
+	answer(0)
+	if r := <-done; r.err != nil || r.resp[3] != 0 {
+		t.Fatalf("first transaction answered %v, %v", r.resp, r.err)
+	}
+
+	// the late answer arrives while the same request is sent again, and must not be taken as its answer
+	done = transact()
+	<-link.sent
+	answer(2)
+	answer(0)
+	if r := <-done; r.err != nil || r.resp[3] != 0 {
+		t.Fatalf("second transaction answered %v, %v", r.resp, r.err)
+	}
+
+	stats := cf.TransactionStats()["log/1"]
+	if stats.Transactions != 2 || stats.Sent != 3 || stats.Duplicates != 1 {
+		t.Fatalf("stats %+v, expecting 2 transactions, 3 sent and 1 duplicate", stats)
+	}
+
+	// once the retry interval has passed, the late answer is no longer expected
+	done = transact()
+	<-link.sent
+	<-link.sent
+	answer(0)
+	if r := <-done; r.err != nil {
+		t.Fatal(r.err)
+	}
+	time.Sleep(2 * policy.Interval)
+	done = transact()
+	<-link.sent
+	answer(0)
+	select {
+	case r := <-done:
+		if r.err != nil || r.resp[3] != 0 {
+			t.Fatalf("transaction answered %v, %v", r.resp, r.err)
+		}
+	case <-link.sent:
+		t.Fatal("the answer was discarded as a late one")
+	}
+}
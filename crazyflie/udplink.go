@@ -0,0 +1,60 @@
+package crazyflie
+
+import (
+	"net"
+	"time"
+)
+
+// how often a Crazyflie reached over UDP is sent an empty packet when there is nothing else to send
+const udpKeepalivePeriod = 10 * time.Millisecond
+
+// how long a read waits for a datagram, such that the reader notices when the link is closed
+const udpReadTimeout = 50 * time.Millisecond
+
+// udpDevice exchanges CRTP packets with a simulated or software-in-the-loop Crazyflie, one packet per datagram
+type udpDevice struct {
+	conn *net.UDPConn
+}
+
+// NewUDPLink returns the link to the Crazyflie listening on the UDP address host:port, eg. a firmware SITL build.
+// As on the radio, every packet sent is answered with a packet from the Crazyflie, empty if it has nothing to report,
+// and the Crazyflie is kept alive with empty packets.
+func NewUDPLink(address string) Link {
+	return &deviceLink{
+		open: func() (packetDevice, error) {
+			udpAddress, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := net.DialUDP("udp", nil, udpAddress)
+			if err != nil {
+				return nil, err
+			}
+			return &udpDevice{conn}, nil
+		},
+		keepalive: udpKeepalivePeriod,
+	}
+}
+
+func (device *udpDevice) SendPacket(packet []byte) error {
+	_, err := device.conn.Write(packet)
+	return err
+}
+
+func (device *udpDevice) ReadPacket() ([]byte, error) {
+	buffer := make([]byte, 64)
+	device.conn.SetReadDeadline(time.Now().Add(udpReadTimeout))
+
+	length, err := device.conn.Read(buffer)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:length], nil
+}
+
+func (device *udpDevice) Close() {
+	device.conn.Close()
+}
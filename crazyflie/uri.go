@@ -0,0 +1,113 @@
+package crazyflie
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+const defaultAddress uint64 = 0xE7E7E7E7E7
+
+// LinkURI is a parsed link URI in the format used by cflib: radio://<dongle>/<channel>/<datarate>/<address>
+// The datarate (250K, 1M or 2M) and the hexadecimal address are optional, defaulting to 2M and E7E7E7E7E7.
+// The dongle index is kept for compatibility, the scheduler chooses which dongle serves a channel.
+// usb://<index> is a Crazyflie connected with a USB cable, the index (kept in Dongle) counting the Crazyflies on the bus.
+// udp://<host>:<port> is a Crazyflie, typically simulated, exchanging CRTP packets over UDP.
+// share://<host>:<port>/<channel>/<datarate>/<address> is a Crazyflie reached through the radio-share server at host:port.
+type LinkURI struct {
+	Scheme   string
+	Dongle   int
+	Channel  uint8
+	Datarate crazyradio.RadioDatarate
+	Address  uint64
+	Host     string // host:port of a udp link or radio-share server
+}
+
+func ParseURI(uri string) (LinkURI, error) {
+	linkURI := LinkURI{Datarate: crazyradio.RadioDatarate_2MPS, Address: defaultAddress}
+
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) != 2 {
+		return linkURI, ErrorInvalidURI
+	}
+	linkURI.Scheme = parts[0]
+
+	if linkURI.Scheme == "usb" {
+		// usb://<index> addresses a Crazyflie connected with a USB cable
+		index, err := strconv.ParseUint(strings.TrimSuffix(parts[1], "/"), 10, 8)
+		if err != nil {
+			return linkURI, ErrorInvalidURI
+		}
+		linkURI.Dongle = int(index)
+		return linkURI, nil
+	}
+	if linkURI.Scheme == "udp" {
+		host := strings.TrimSuffix(parts[1], "/")
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return linkURI, ErrorInvalidURI
+		}
+		linkURI.Host = host
+		return linkURI, nil
+	}
+	if linkURI.Scheme != "radio" && linkURI.Scheme != "share" {
+		return linkURI, ErrorInvalidURI
+	}
+
+	fields := strings.Split(strings.TrimSuffix(parts[1], "/"), "/")
+	if len(fields) < 2 || len(fields) > 4 {
+		return linkURI, ErrorInvalidURI
+	}
+
+	if linkURI.Scheme == "share" {
+		// share://<host>:<port>/... reaches the Crazyflie through the Crazyradios of a remote radio-share server
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return linkURI, ErrorInvalidURI
+		}
+		linkURI.Host = fields[0]
+	} else {
+		dongle, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return linkURI, ErrorInvalidURI
+		}
+		linkURI.Dongle = int(dongle)
+	}
+
+	channel, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil || channel > 125 {
+		return linkURI, ErrorInvalidURI
+	}
+	linkURI.Channel = uint8(channel)
+
+	if len(fields) > 2 {
+		datarate, err := crazyradio.ParseDatarate(fields[2])
+		if err != nil {
+			return linkURI, ErrorInvalidURI
+		}
+		linkURI.Datarate = datarate
+	}
+
+	if len(fields) > 3 {
+		address, err := strconv.ParseUint(strings.TrimPrefix(fields[3], "0x"), 16, 64)
+		if err != nil || address > 0xFFFFFFFFFF {
+			return linkURI, ErrorInvalidURI
+		}
+		linkURI.Address = address
+	}
+
+	return linkURI, nil
+}
+
+func (uri LinkURI) String() string {
+	switch uri.Scheme {
+	case "usb":
+		return fmt.Sprintf("usb://%d", uri.Dongle)
+	case "udp":
+		return fmt.Sprintf("udp://%s", uri.Host)
+	case "share":
+		return fmt.Sprintf("share://%s/%d/%s/%010X", uri.Host, uri.Channel, uri.Datarate, uri.Address)
+	}
+	return fmt.Sprintf("%s://%d/%d/%s/%010X", uri.Scheme, uri.Dongle, uri.Channel, uri.Datarate, uri.Address)
+}
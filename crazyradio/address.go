@@ -0,0 +1,69 @@
+package crazyradio
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the largest radio address, which is 5 bytes long
+const maxAddress = 1<<40 - 1
+
+// the most addresses a list may expand to, since each of them is probed when scanning
+const maxAddresses = 4096
+
+// ParseAddresses parses a comma separated list of hexadecimal addresses, where each element may also be a range
+// written with only the changing low digits after a dash, eg. "E7E7E7E701-07,E7E7E7E7E7".
+// The returned addresses are unique and sorted, and there are at most 4096 of them.
+func ParseAddresses(addresses string) ([]uint64, error) {
+	// a set to hold the unique addresses
+	addressSet := make(map[uint64]bool)
+
+	for _, address := range strings.Split(addresses, ",") {
+		addressrange := strings.Split(strings.TrimSpace(address), "-") // eg we handle the case E7E7E7E701-07, if there is no -, this should still work.
+
+		lowaddressstring := strings.TrimPrefix(addressrange[0], "0x") // trim any leading hex prefix
+
+		lowaddress, err := strconv.ParseUint(lowaddressstring, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing address %s", lowaddressstring)
+		}
+
+		highaddresslowpart := strings.TrimPrefix(addressrange[len(addressrange)-1], "0x") // eg 07
+		if len(highaddresslowpart) > len(lowaddressstring) {
+			return nil, fmt.Errorf("error parsing address range %s", address)
+		}
+		highaddresshighpart := lowaddressstring[0 : len(lowaddressstring)-len(highaddresslowpart)] // eg E7E7E7E7 | 01
+		highaddress, err := strconv.ParseUint(highaddresshighpart+highaddresslowpart, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing address %s", highaddresshighpart+highaddresslowpart)
+		}
+
+		if lowaddress > maxAddress || highaddress > maxAddress {
+			return nil, fmt.Errorf("address %s is longer than 5 bytes", address)
+		}
+		if highaddress < lowaddress {
+			return nil, fmt.Errorf("address range %s ends before it starts", address)
+		}
+		if highaddress-lowaddress >= maxAddresses {
+			return nil, fmt.Errorf("address range %s has more than %d addresses", address, maxAddresses)
+		}
+
+		for i := lowaddress; i <= highaddress; i++ {
+			addressSet[i] = true
+		}
+		if len(addressSet) > maxAddresses {
+			return nil, fmt.Errorf("more than %d addresses", maxAddresses)
+		}
+	}
+
+	// now convert the set into a slice for easier processing
+	addressSlice := make([]uint64, 0, len(addressSet))
+	for k := range addressSet {
+		addressSlice = append(addressSlice, k)
+	}
+	sort.Slice(addressSlice, func(i, j int) bool { return addressSlice[i] < addressSlice[j] })
+
+	return addressSlice, nil
+}
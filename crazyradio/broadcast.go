@@ -0,0 +1,62 @@
+package crazyradio
+
+// BroadcastAddress is the address on which the Crazyflie firmware listens for broadcast packets
+const BroadcastAddress uint64 = 0xFFE7E7E7E7
+
+// BroadcastSend transmits packet, without acknowledgement, to every crazyflie listening on channel, datarate and address.
+// Since the crazyflies do not acknowledge broadcasts, the packet is transmitted repeats times to make its reception likely.
+// The broadcast borrows the first radio, pausing the crazyflies it serves for the duration of the transmissions.
+// A radio whose acknowledgements cannot be enabled again afterwards is retired.
+func (manager *Manager) BroadcastSend(channel uint8, datarate RadioDatarate, address uint64, packet []byte, repeats int) error {
+	radio, err := manager.radioBorrow()
+	if err != nil {
+		return err
+	}
+
+	radio.Lock()
+	if radio.Retired() {
+		radio.Unlock()
+		return ErrorDeviceNotFound
+	}
+	err = broadcastTransmit(radio, channel, datarate, address, packet, repeats)
+	ackErr := radio.SetAckEnable(1) // the radio thread relies on acknowledgements
+	radio.Unlock()
+
+	if ackErr != nil {
+		// a radio left without acknowledgements cannot serve its crazyflies
+		manager.radioRetire(radio, ackErr)
+		if err == nil {
+			err = ackErr
+		}
+	}
+	return err
+}
+
+// broadcastTransmit sets up radio for the broadcast and transmits it, leaving the acknowledgements disabled.
+// Should be called with the radio lock held.
+func broadcastTransmit(radio *RadioDevice, channel uint8, datarate RadioDatarate, address uint64, packet []byte, repeats int) error {
+	if radio.Datarate() != datarate {
+		if err := radio.SetDatarate(datarate); err != nil {
+			return err
+		}
+	}
+	if err := radio.SetChannel(channel); err != nil {
+		return err
+	}
+	if err := radio.SetAddress(address); err != nil {
+		return err
+	}
+
+	if err := radio.SetAckEnable(0); err != nil {
+		return err
+	}
+
+	for i := 0; i < repeats; i++ {
+		// with acknowledgements disabled the radio does not report a status, so there is nothing to read back
+		if err := radio.SendPacket(packet); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package crazyradio
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// the records waiting to be written, beyond which records are dropped rather than slowing down the radios
+const captureBacklog = 4096
+
+// CaptureBytes is a packet in a capture, written as hexadecimal
+type CaptureBytes []byte
+
+func (b CaptureBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *CaptureBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	*b = data
+	return err
+}
+
+// CaptureRecord is one radio exchange: a packet sent and, if the crazyflie acknowledged it, the payload of the acknowledgement.
+// A capture is a stream of records, one JSON object per line.
+type CaptureRecord struct {
+	Time          time.Time     `json:"time"`
+	Dongle        int           `json:"dongle"` // see RadioDevice.Index
+	Channel       uint8         `json:"channel"`
+	Datarate      RadioDatarate `json:"datarate"`
+	Address       uint64        `json:"address"`
+	Packet        CaptureBytes  `json:"packet"`
+	Acked         bool          `json:"acked"`
+	Retries       uint8         `json:"retries"`
+	PowerDetector bool          `json:"powerDetector"`
+	Response      CaptureBytes  `json:"response"`
+	Error         string        `json:"error,omitempty"` // the usb error of the exchange, if any
+}
+
+type capture struct {
+	records chan CaptureRecord
+	done    chan error
+	dropped uint64
+}
+
+// CaptureStart records every exchange of the radio threads with the registered crazyflies to w until CaptureStop is called.
+// The broadcasts and scans are not recorded.
+func (manager *Manager) CaptureStart(w io.Writer) error {
+	manager.captureLock.Lock()
+	defer manager.captureLock.Unlock()
+
+	if manager.activeCapture != nil {
+		return ErrorCaptureRunning
+	}
+
+	manager.activeCapture = &capture{
+		records: make(chan CaptureRecord, captureBacklog),
+		done:    make(chan error),
+	}
+	go manager.activeCapture.writeThread(w)
+
+	return nil
+}
+
+// CaptureStop ends the capture, returning once every record has been written, along with the number of
+// records dropped because the writer could not keep up
+func (manager *Manager) CaptureStop() (uint64, error) {
+	manager.captureLock.Lock()
+	c := manager.activeCapture
+	manager.activeCapture = nil
+	manager.captureLock.Unlock()
+
+	if c == nil {
+		return 0, nil
+	}
+
+	close(c.records)
+	err := <-c.done
+	return c.dropped, err
+}
+
+func (c *capture) writeThread(w io.Writer) {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+
+	var err error
+	for record := range c.records {
+		if err == nil {
+			err = encoder.Encode(record)
+		}
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	c.done <- err
+}
+
+// captureExchange records an exchange if a capture is running
+func (manager *Manager) captureExchange(radio *RadioDevice, channel uint8, datarate RadioDatarate, address uint64, packet []byte, ack Ack, err error) {
+	manager.captureLock.Lock()
+	defer manager.captureLock.Unlock()
+
+	if manager.activeCapture == nil {
+		return
+	}
+
+	record := CaptureRecord{
+		Time:          time.Now(),
+		Dongle:        radio.index,
+		Channel:       channel,
+		Datarate:      datarate,
+		Address:       address,
+		Packet:        append(CaptureBytes{}, packet...),
+		Acked:         ack.Received,
+		Retries:       ack.Retries,
+		PowerDetector: ack.PowerDetector,
+		Response:      append(CaptureBytes{}, ack.Data...),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	select {
+	case manager.activeCapture.records <- record:
+	default:
+		manager.activeCapture.dropped++
+	}
+}
+
+// CaptureReader reads back the records of a capture
+type CaptureReader struct {
+	decoder *json.Decoder
+}
+
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{json.NewDecoder(r)}
+}
+
+// Next returns the next record of the capture, or io.EOF at the end of the capture
+func (reader *CaptureReader) Next() (CaptureRecord, error) {
+	var record CaptureRecord
+	err := reader.decoder.Decode(&record)
+	return record, err
+}
@@ -0,0 +1,46 @@
+package crazyradio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	manager := NewManager()
+	var buffer bytes.Buffer
+	if err := manager.CaptureStart(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.CaptureStart(&buffer); err != ErrorCaptureRunning {
+		t.Fatalf("started a second capture: %v", err)
+	}
+
+	radio := &RadioDevice{index: 2}
+	manager.captureExchange(radio, testChannel, RadioDatarate_250KPS, testAddress, []byte{0xFF}, Ack{Received: true, Retries: 3, Data: []byte{0x1C, 0x41}}, nil)
+	manager.captureExchange(radio, testChannel, RadioDatarate_250KPS, testAddress, []byte{0x3C, 1}, Ack{}, ErrorReadLength)
+	if dropped, err := manager.CaptureStop(); err != nil || dropped != 0 {
+		t.Fatalf("%d records dropped (%v)", dropped, err)
+	}
+
+	reader := NewCaptureReader(&buffer)
+	record, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Dongle != 2 || record.Datarate != RadioDatarate_250KPS || record.Address != testAddress || !record.Acked || record.Retries != 3 || !bytes.Equal(record.Response, []byte{0x1C, 0x41}) {
+		t.Fatalf("read %+v", record)
+	}
+
+	record, err = reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Acked || record.Error != ErrorReadLength.Error() || !bytes.Equal(record.Packet, []byte{0x3C, 1}) {
+		t.Fatalf("read %+v", record)
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("read past the end of the capture: %v", err)
+	}
+}
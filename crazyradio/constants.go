@@ -1,14 +1,48 @@
 package crazyradio
 
+import "strings"
+
 // Transmission datarate enum
-type radioDatarate uint16
+type RadioDatarate uint16
 
 const (
-	RadioDatarate_250KPS radioDatarate = iota
+	RadioDatarate_250KPS RadioDatarate = iota
 	RadioDatarate_1MPS
 	RadioDatarate_2MPS
 )
 
+var radioDatarateString = map[RadioDatarate]string{
+	RadioDatarate_250KPS: "250K",
+	RadioDatarate_1MPS:   "1M",
+	RadioDatarate_2MPS:   "2M",
+}
+
+func (datarate RadioDatarate) String() string {
+	return radioDatarateString[datarate]
+}
+
+// MarshalText encodes the datarate as its string in JSON
+func (datarate RadioDatarate) MarshalText() ([]byte, error) {
+	return []byte(datarate.String()), nil
+}
+
+// UnmarshalText decodes a datarate encoded by MarshalText
+func (datarate *RadioDatarate) UnmarshalText(text []byte) error {
+	parsed, err := ParseDatarate(string(text))
+	*datarate = parsed
+	return err
+}
+
+// ParseDatarate parses a datarate as written by RadioDatarate.String, eg. 250K, 1M or 2M
+func ParseDatarate(s string) (RadioDatarate, error) {
+	for datarate, str := range radioDatarateString {
+		if strings.EqualFold(s, str) {
+			return datarate, nil
+		}
+	}
+	return 0, ErrorInvalidDatarate
+}
+
 // Transmission power enum
 type radioPower uint16
 
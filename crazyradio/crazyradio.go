@@ -2,42 +2,109 @@ package crazyradio
 
 import (
 	"container/list"
+	"context"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/kylelemons/gousb/usb"
 )
 
 type packetQueue struct {
+	datarate       RadioDatarate
 	standardQueue  *list.List
 	priorityQueue  *list.List
 	lock           *sync.Mutex
 	packetDequeued chan bool
+	removed        chan bool // closed when the crazyflie is removed
+	stats          LinkStats
+
+	// adaptive polling of idle crazyflies
+	idleCount    int
+	pollInterval time.Duration
+	nextPoll     time.Time
+
+	// the unsent packet of each coalescing slot in the priority queue, see PacketSendLatest
+	latest map[uint8]*list.Element
+
+	// the most packets the standard queue holds, see PacketQueueSetDepth
+	depth int
+
+	// the queued packet being transmitted by the radio thread, which stays queued until it is acknowledged
+	transmitting *list.Element
+
+	// exactly-once delivery, see safelink.go
+	safelink         safelinkState
+	safelinkAttempts int
+	safelinkUp       byte
+	safelinkDown     byte
+	inflight         *inflightPacket
+
+	// token bucket limiting the standard queue, see PacketQueueSetBudget
+	budget        float64 // packets per second, 0 for no limit
+	budgetBurst   float64
+	budgetTokens  float64
+	budgetUpdated time.Time
 }
 
-var radios []*RadioDevice
-var radioWorkQueue chan uint8
+// how long CrazyflieRegister waits for the crazyflie to respond when the context has no deadline
+const registerTimeout = 5 * time.Second
+
+// a crazyflie that has answered this many consecutive pings with nothing to report is polled less frequently
+const idleThreshold = 10
 
-var packetQueues map[uint8]map[uint64]*packetQueue
-var callbacks map[uint64]func([]byte)
+// the longest interval between pings of an idle crazyflie, well within the crazyflie status timeout
+const maxIdlePollInterval = 50 * time.Millisecond
 
-var radioThreadShouldStop chan bool
-var globalWaitGroup *sync.WaitGroup
-var workWaitGroup *sync.WaitGroup
+// how long a radio pauses when a whole round was skipped because every crazyflie it serves was idle
+const idleRoundSleep = 1 * time.Millisecond
+
+// how long a radio without channels waits before checking its schedule again
+const unscheduledSleep = 10 * time.Millisecond
 
 var defaultPacket = []byte{0xFF}
 
-func callbackRegister(address uint64, callback func([]byte)) {
-	callbacks[address] = callback
+func (manager *Manager) callbackRegister(channel uint8, address uint64, callback func([]byte)) {
+	manager.packetQueuesLock.Lock()
+	defer manager.packetQueuesLock.Unlock()
+	if _, ok := manager.callbacks[channel]; !ok {
+		manager.callbacks[channel] = make(map[uint64]func([]byte))
+	}
+	manager.callbacks[channel][address] = callback
 }
 
-func callbackRemove(address uint64) {
-	delete(callbacks, address)
+func (manager *Manager) callbackRemove(channel uint8, address uint64) {
+	manager.packetQueuesLock.Lock()
+	defer manager.packetQueuesLock.Unlock()
+	delete(manager.callbacks[channel], address)
+	if len(manager.callbacks[channel]) == 0 {
+		delete(manager.callbacks, channel)
+	}
 }
 
-func CrazyflieRegister(channel uint8, address uint64, responseCallback func([]byte)) error {
+func (manager *Manager) callbackGet(channel uint8, address uint64) (func([]byte), bool) {
+	manager.packetQueuesLock.RLock()
+	defer manager.packetQueuesLock.RUnlock()
+	callback, ok := manager.callbacks[channel][address]
+	return callback, ok
+}
+
+// CrazyflieRegister starts communicating with a crazyflie, returning once it has responded.
+// If ctx has no deadline, the crazyflie is given 5 seconds to respond.
+func (manager *Manager) CrazyflieRegister(ctx context.Context, channel uint8, datarate RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	if datarate > RadioDatarate_2MPS {
+		return ErrorInvalidDatarate
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, registerTimeout)
+		defer cancel()
+	}
 
 	// setup a temporary callback for the crazyflie such that this thread is notified when
 	cfCommunicating := make(chan bool)
-	callbackRegister(address, func(resp []byte) {
+	manager.callbackRegister(channel, address, func(resp []byte) {
 		select {
 		case cfCommunicating <- true:
 		default:
@@ -46,215 +113,408 @@ func CrazyflieRegister(channel uint8, address uint64, responseCallback func([]by
 
 	// initialize the packet queues for the crazyflie
 	// this will cause it to be pinged in the next round (and our callback will be called)
-	packetQueueGet(channel, address)
+	queue := manager.packetQueueGet(channel, address)
+	queue.lock.Lock()
+	queue.datarate = datarate
+	queue.lock.Unlock()
 
 	// wait for the crazyflie to respond, or to time out
 
 	select {
-	case <-time.After(5 * time.Second):
-		packetQueueRemove(channel, address)
-		callbackRemove(address)
-		return ErrorNoResponse
+	case <-ctx.Done():
+		manager.packetQueueRemove(channel, address)
+		manager.callbackRemove(channel, address)
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrorNoResponse
+		}
+		return ctx.Err()
 	case <-cfCommunicating:
-		callbackRegister(address, responseCallback)
+		queue.lock.Lock()
+		queue.safelinkNegotiate()
+		queue.lock.Unlock()
+		manager.callbackRegister(channel, address, responseCallback)
 		return nil
 	}
 }
 
-func CrazyflieRemove(channel uint8, address uint64) {
-	callbackRemove(address)
-	packetQueueRemove(channel, address)
+func (manager *Manager) CrazyflieRemove(channel uint8, address uint64) {
+	manager.callbackRemove(channel, address)
+	manager.packetQueueRemove(channel, address)
 }
 
-func packetQueueGet(channel uint8, address uint64) *packetQueue {
-	if _, ok := packetQueues[channel]; !ok {
-		packetQueues[channel] = make(map[uint64]*packetQueue)
+func (manager *Manager) packetQueueGet(channel uint8, address uint64) *packetQueue {
+	manager.packetQueuesLock.Lock()
+
+	if _, ok := manager.packetQueues[channel]; !ok {
+		manager.packetQueues[channel] = make(map[uint64]*packetQueue)
+	}
+	channelQueues := manager.packetQueues[channel]
+
+	queue, ok := channelQueues[address]
+	if !ok {
+		queue = &packetQueue{
+			datarate:       RadioDatarate_2MPS,
+			standardQueue:  list.New(),
+			priorityQueue:  list.New(),
+			lock:           new(sync.Mutex),
+			packetDequeued: make(chan bool, 1),
+			removed:        make(chan bool),
+			latest:         make(map[uint8]*list.Element),
+			depth:          defaultQueueDepth,
+		}
+		channelQueues[address] = queue
 	}
-	channelQueues := packetQueues[channel]
 
-	if _, ok := channelQueues[address]; !ok {
-		channelQueues[address] = &packetQueue{list.New(), list.New(), new(sync.Mutex), make(chan bool)}
+	manager.packetQueuesLock.Unlock()
+
+	if !ok {
+		manager.scheduleRebalance() // a new crazyflie, which may unbalance the radios
 	}
 
-	return channelQueues[address]
+	return queue
+}
+
+// packetQueueLookup returns the packet queue of a crazyflie without creating it
+func (manager *Manager) packetQueueLookup(channel uint8, address uint64) (*packetQueue, bool) {
+	manager.packetQueuesLock.RLock()
+	defer manager.packetQueuesLock.RUnlock()
+	queue, ok := manager.packetQueues[channel][address]
+	return queue, ok
 }
 
-func packetQueueRemove(channel uint8, address uint64) {
-	delete(packetQueues[channel], address)
-	if len(packetQueues[channel]) == 0 {
-		delete(packetQueues, channel)
+func (manager *Manager) packetQueueRemove(channel uint8, address uint64) {
+	manager.packetQueuesLock.Lock()
+	if queue, ok := manager.packetQueues[channel][address]; ok {
+		close(queue.removed)
 	}
+	delete(manager.packetQueues[channel], address)
+	if len(manager.packetQueues[channel]) == 0 {
+		delete(manager.packetQueues, channel)
+	}
+	manager.packetQueuesLock.Unlock()
+
+	manager.scheduleRebalance()
 }
 
-func PacketSend(channel uint8, address uint64, packet []byte) {
-	queue := packetQueueGet(channel, address)
+// PacketSend queues a packet. While the standard queue of the crazyflie is full (see PacketQueueSetDepth), the packet
+// is dropped, counted in its LinkStats and ErrorQueueFull is returned, such that a transfer which relies on every packet
+// arriving (eg. flashing) fails rather than silently corrupting its data.
+func (manager *Manager) PacketSend(channel uint8, address uint64, packet []byte) error {
+	queue := manager.packetQueueGet(channel, address)
 
 	packetCopy := make([]byte, len(packet))
 	copy(packetCopy, packet)
 
 	queue.lock.Lock()
-	queue.standardQueue.PushBack(packetCopy)
-	queue.lock.Unlock()
+	defer queue.lock.Unlock()
+
+	if queue.depth > 0 && queue.standardQueue.Len() >= queue.depth {
+		queue.stats.Dropped++
+		return ErrorQueueFull
+	}
+	queue.standardQueue.PushBack(&queuedPacket{data: packetCopy})
+	return nil
 }
 
-func PacketSendPriority(channel uint8, address uint64, packet []byte) {
-	queue := packetQueueGet(channel, address)
+func (manager *Manager) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	queue := manager.packetQueueGet(channel, address)
 
 	packetCopy := make([]byte, len(packet))
 	copy(packetCopy, packet)
 
 	queue.lock.Lock()
-	queue.priorityQueue.PushBack(packetCopy)
+	queue.priorityQueue.PushBack(&queuedPacket{data: packetCopy})
 	queue.lock.Unlock()
 }
 
-func PacketQueueWaitForEmpty(channel uint8, address uint64) {
-	queue := packetQueueGet(channel, address)
+// PacketQueueWaitForEmpty waits for the packet queues of a crazyflie to be empty.
+// It returns early when the crazyflie is removed, or with the error of ctx when ctx is done.
+func (manager *Manager) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	queue, ok := manager.packetQueueLookup(channel, address)
+	if !ok {
+		return nil // nothing is queued for a crazyflie which is not registered
+	}
 
 	for {
-		if queue.priorityQueue.Front() == nil && queue.standardQueue.Front() == nil {
-			break
-		} else {
-			<-queue.packetDequeued // block here until the radioThread indicates one of our packets has been dequeued (after which we again check for empty)
+		queue.lock.Lock()
+		empty := queue.priorityQueue.Front() == nil && queue.standardQueue.Front() == nil
+		queue.lock.Unlock()
+
+		if empty {
+			return nil
+		}
+
+		select {
+		case <-queue.packetDequeued: // the radioThread indicates one of our packets has been dequeued (after which we again check for empty)
+		case <-queue.removed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-func Start() error {
-	callbacks = make(map[uint64]func([]byte))
-	packetQueues = make(map[uint8]map[uint64]*packetQueue)
-
-	radioThreadShouldStop = make(chan bool)
-	globalWaitGroup = &sync.WaitGroup{}
-	workWaitGroup = &sync.WaitGroup{}
+// Start opens the Crazyradios and starts serving the registered crazyflies.
+// Dongles plugged in later are picked up, so if none is found ErrorDeviceNotFound is returned but the
+// radios keep being watched for, and Stop must still be called.
+func (manager *Manager) Start() error {
+	manager.lifecycle.Lock()
+	defer manager.lifecycle.Unlock()
 
-	radios, err := OpenAllRadios()
-	if err != nil {
-		return err
+	if manager.shouldStop != nil {
+		return ErrorManagerRunning
 	}
+	manager.shouldStop = make(chan bool)
 
-	// the queue on which radios receive their work
-	radioWorkQueue = make(chan uint8, 256)
+	manager.usbContext = usb.NewContext()
+	manager.usbContext.Debug(0)
 
-	// start a thread per radio
-	for _, r := range radios {
-		globalWaitGroup.Add(1)
-		go radioThread(r)
-	}
+	// open the radios, starting a thread per radio
+	manager.radiosLock.Lock()
+	manager.radiosOpened = 0
+	manager.retired = make(map[usbID]time.Time)
+	manager.radiosLock.Unlock()
+	found := manager.radiosAddNew()
 
-	// start the thread to coordinate the radios
-	globalWaitGroup.Add(1)
-	go coordinatorThread()
+	// start the thread watching for radios being plugged in or unplugged
+	manager.waitGroup.Add(1)
+	go manager.hotplugThread()
 
+	if found == 0 {
+		return ErrorDeviceNotFound
+	}
 	return nil
 }
 
-func Stop() {
-	close(radioThreadShouldStop)
-	globalWaitGroup.Wait()
+// Stop stops the radio threads and closes the Crazyradios. The crazyflies stay registered, and are served again
+// if the manager is restarted.
+func (manager *Manager) Stop() {
+	manager.lifecycle.Lock()
+	defer manager.lifecycle.Unlock()
+
+	if manager.shouldStop == nil {
+		return // not started
+	}
+	close(manager.shouldStop)
+	manager.waitGroup.Wait()
+	manager.shouldStop = nil
 
-	for _, r := range radios {
+	manager.radiosLock.Lock()
+	for _, r := range manager.radios {
 		r.Close()
 	}
+	manager.radios = nil
+	manager.radiosLock.Unlock()
+
+	manager.scheduleRebalance() // the channels wait for the radios of the next start
+
+	manager.usbContext.Close()
+	manager.usbContext = nil
 }
 
-func radioThread(radio *RadioDevice) {
-	defer globalWaitGroup.Done()
+// radioThread serves, round after round, the channels the radio owns, independently of the other radios
+func (manager *Manager) radioThread(radio *RadioDevice) {
+	defer manager.waitGroup.Done()
 
 	for {
-		var channel uint8
-
 		select {
-		case <-radioThreadShouldStop:
-			return // here no need to workWaitGroup.Done() since we haven't received work
-		case channel = <-radioWorkQueue:
+		case <-manager.shouldStop:
+			return
+		case <-radio.retired:
+			return // the channels have been handed to the remaining radios
+		default:
 		}
 
-	addressLoop:
-		for address, queue := range packetQueues[channel] {
-			// quit if we should quit
+		channels := manager.scheduleChannels(radio)
+		if len(channels) == 0 {
 			select {
-			case <-radioThreadShouldStop:
-				break addressLoop // prematurely finish the work
-			default:
+			case <-manager.shouldStop:
+			case <-radio.retired:
+			case <-time.After(unscheduledSleep):
 			}
+			continue
+		}
 
-			queue.lock.Lock()
-
-			var packetQueue *list.List = nil
-			var packetElement *list.Element = nil
-			var packet []byte
-
-			if queue.priorityQueue.Front() != nil {
-				packetQueue = queue.priorityQueue
-				packetElement = packetQueue.Front()
-				packet = packetElement.Value.([]byte)
-			} else if queue.standardQueue.Front() != nil {
-				packetQueue = queue.standardQueue
-				packetElement = packetQueue.Front()
-				packet = packetElement.Value.([]byte)
-			} else {
-				packet = defaultPacket
-			}
+		start := time.Now()
+		transmissions := 0
+		for _, channel := range channels {
+			transmissions += manager.radioServeChannel(radio, channel)
+		}
+
+		if transmissions == 0 {
+			<-time.After(idleRoundSleep) // every crazyflie is idle, do not spin
+			continue
+		}
 
+		radio.Lock()
+		radio.rounds++
+		radio.roundTime += time.Since(start)
+		radio.Unlock()
+	}
+}
+
+type scheduledQueue struct {
+	address uint64
+	queue   *packetQueue
+	urgency time.Time
+}
+
+// radioServeChannel transmits one packet to each crazyflie on a channel, returning the number of packets transmitted
+func (manager *Manager) radioServeChannel(radio *RadioDevice, channel uint8) int {
+	manager.packetQueuesLock.RLock()
+	schedule, ok := manager.channelSchedules[channel]
+	if !ok || schedule.radio != radio {
+		manager.packetQueuesLock.RUnlock()
+		return 0 // the channel was handed to another radio since the round started
+	}
+	queues := make([]scheduledQueue, 0, len(manager.packetQueues[channel]))
+	for address, queue := range manager.packetQueues[channel] {
+		queues = append(queues, scheduledQueue{address: address, queue: queue})
+	}
+	manager.packetQueuesLock.RUnlock()
+
+	schedule.serving.Lock()
+	defer schedule.serving.Unlock()
+
+	// serve the crazyflies with urgent packets first, earliest deadline first, then the others grouped by datarate
+	// such that the radio switches datarate as little as possible
+	// (datarate is only written by CrazyflieRegister before the crazyflie starts communicating)
+	now := time.Now()
+	for i := range queues {
+		queues[i].queue.lock.Lock()
+		queues[i].urgency = queues[i].queue.urgency(now)
+		queues[i].queue.lock.Unlock()
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		ui, uj := queues[i].urgency, queues[j].urgency
+		if !ui.Equal(uj) {
+			return !ui.IsZero() && (uj.IsZero() || ui.Before(uj))
+		}
+		di, dj := queues[i].queue.datarate, queues[j].queue.datarate
+		return di < dj || (di == dj && queues[i].address < queues[j].address)
+	})
+
+	transmissions := 0
+
+	for _, scheduled := range queues {
+		address, queue := scheduled.address, scheduled.queue
+
+		// quit if we should quit
+		select {
+		case <-manager.shouldStop:
+			return transmissions // prematurely finish the work
+		default:
+		}
+
+		queue.lock.Lock()
+
+		datarate := queue.datarate
+		packet, packetQueue, packetElement, due := queue.nextTransmission(time.Now())
+		if !due {
 			queue.lock.Unlock()
+			continue // the crazyflie is idle (or over budget) and not yet due to be polled
+		}
+		queue.transmitting = packetElement
 
-			radio.SetChannel(channel)
-			radio.SetAddress(address)
-			err := radio.SendPacket(packet)
-			if err != nil {
-				continue
-			}
+		queue.lock.Unlock()
+		transmissions++
 
+		radio.Lock() // the radio may be borrowed, eg. for a scan
+		if radio.Retired() {
+			radio.Unlock()
+			return transmissions // the channel is handed to another radio
+		}
+		if radio.Datarate() != datarate {
+			radio.SetDatarate(datarate)
+		}
+		radio.SetChannel(channel)
+		radio.SetAddress(address)
+		var ack Ack
+		err := radio.SendPacket(packet)
+		if err == nil {
 			// read the response, which we then distribute to the relevant handler
-			ackReceived, resp, err := radio.ReadResponse()
+			ack, err = radio.ReadAck()
+		}
+		radio.stats.Update(ack, err)
+		if err != nil {
+			radio.failures++
+			radio.usbErrors++
+		} else {
+			radio.failures = 0
+		}
+		failures := radio.failures
+		radio.Unlock()
 
-			if err != nil || !ackReceived {
-				continue // if there is an error, something is wrong... should try and retransmit the packet
-			}
+		manager.captureExchange(radio, channel, datarate, address, packet, ack, err)
+
+		if failures >= radioFailureThreshold {
+			manager.radioRetire(radio, err) // the dongle is unplugged or broken
+		}
 
+		queue.lock.Lock()
+		queue.transmitting = nil
+		queue.stats.Update(ack, err)
+		if err != nil || !ack.Received {
+			queue.safelinkUnacknowledged(packet, packetQueue, packetElement)
 			if packetQueue != nil {
-				queue.lock.Lock()
-				packetQueue.Remove(packetElement) // remove the acknowledged packet, since it was successfully transmitted
-				queue.lock.Unlock()
+				queue.packetUnsent(packetQueue, packetElement)
 			}
+			queue.lock.Unlock()
+			continue // the packet stays queued and is retransmitted in the next round
+		}
+		if packetQueue != nil {
+			queue.packetSent(packetQueue, packetElement) // remove the acknowledged packet, since it was successfully transmitted
+		}
+		resp, fresh := queue.safelinkAcknowledged(ack.Data)
+		queue.updatePolling(packetQueue != nil, resp)
+		queue.lock.Unlock()
 
-			select { // if possible (eg. if not already triggered), trigger the packetDequeued channel (used only in function WaitForEmptyPacketQueue)
-			case queue.packetDequeued <- true:
-				break
-			default: // if it has already been triggered, do nothing
-			}
+		select { // if possible (eg. if not already triggered), trigger the packetDequeued channel (used only in function WaitForEmptyPacketQueue)
+		case queue.packetDequeued <- true:
+			break
+		default: // if it has already been triggered, do nothing
+		}
 
-			// now call the crazyflie's callback (resp will have len 0 if the packet was acked with no data)
-			if callback, ok := callbacks[address]; ok {
-				go callback(resp)
-			}
+		if !fresh {
+			continue // a duplicate of a response already delivered
 		}
 
-		workWaitGroup.Done() // signal to the coordinatorThread that we're done with the work
+		// now call the crazyflie's callback (resp will have len 0 if the packet was acked with no data),
+		// from the radio thread such that the responses are delivered in order
+		if callback, ok := manager.callbackGet(channel, address); ok {
+			callback(resp)
+		}
 	}
-}
 
-func coordinatorThread() {
-	defer globalWaitGroup.Done()
+	return transmissions
+}
 
-	for {
-		// quit if we should quit
-		select {
-		case <-radioThreadShouldStop:
-			return
-		default:
-		}
+// updatePolling backs off the polling of a crazyflie which has nothing to send or receive,
+// and snaps back to polling every round as soon as there is traffic in either direction.
+// Should be called with the queue lock held.
+func (queue *packetQueue) updatePolling(sentData bool, resp []byte) {
+	// an acknowledgement without payload, or with only a null packet header (0xF3/0xF7), means the crazyflie had nothing to report
+	emptyResponse := len(resp) == 0 || (len(resp) == 1 && resp[0]&0xF3 == 0xF3)
+
+	if sentData || !emptyResponse {
+		queue.idleCount = 0
+		queue.pollInterval = 0
+		queue.nextPoll = time.Time{}
+		return
+	}
 
-		if len(packetQueues) == 0 {
-			<-time.After(10 * time.Millisecond)
-			continue
-		}
+	queue.idleCount++
+	if queue.idleCount < idleThreshold {
+		return
+	}
 
-		for channel := range packetQueues { // loop through all channels
-			workWaitGroup.Add(1)
-			radioWorkQueue <- channel
+	if queue.pollInterval == 0 {
+		queue.pollInterval = time.Millisecond
+	} else if queue.pollInterval < maxIdlePollInterval {
+		queue.pollInterval *= 2
+		if queue.pollInterval > maxIdlePollInterval {
+			queue.pollInterval = maxIdlePollInterval
 		}
-		workWaitGroup.Wait() // wait for all work to be processed, ensures that only one radio operates per channel
 	}
+	queue.nextPoll = time.Now().Add(queue.pollInterval)
 }
@@ -18,6 +18,12 @@ const (
 	ErrorInvalidArdTime
 	ErrorInvalidArdBytes
 	ErrorWriteLength
+	ErrorReadLength
+	ErrorCaptureRunning
+	ErrorNotSupported
+	ErrorManagerRunning
+	ErrorNotRegistered
+	ErrorQueueFull
 )
 
 var radioErrorString = map[radioError]string{
@@ -30,4 +36,10 @@ var radioErrorString = map[radioError]string{
 	ErrorInvalidArdTime:  "invalid ARD time",
 	ErrorInvalidArdBytes: "invalid ARD bytes",
 	ErrorWriteLength:     "incorrect number of bytes written to endpoint",
+	ErrorReadLength:      "no status byte read from endpoint",
+	ErrorCaptureRunning:  "a capture is already running",
+	ErrorNotSupported:    "not supported by the dongle firmware",
+	ErrorManagerRunning:  "the manager is already started",
+	ErrorNotRegistered:   "the crazyflie is not registered",
+	ErrorQueueFull:       "the packet queue of the crazyflie is full",
 }
@@ -0,0 +1,198 @@
+package crazyradio
+
+import (
+	"time"
+
+	"github.com/kylelemons/gousb/usb"
+)
+
+// how often the usb bus is checked for dongles being plugged in or unplugged
+const hotplugPeriod = 1 * time.Second
+
+// a dongle whose transfers fail this many times in a row is retired, its channels are then handed to the other dongles
+const radioFailureThreshold = 10
+
+// how long a dongle retired for failing is left closed while it stays plugged in, before it is given another chance
+const retiredBackoff = 30 * time.Second
+
+// usbID identifies a dongle by its usb bus and device address
+type usbID struct{ bus, address uint8 }
+
+type RadioEventType uint8
+
+const (
+	RadioAdded RadioEventType = iota
+	RadioRemoved
+)
+
+var radioEventTypeString = map[RadioEventType]string{
+	RadioAdded:   "added",
+	RadioRemoved: "removed",
+}
+
+func (t RadioEventType) String() string {
+	return radioEventTypeString[t]
+}
+
+// RadioEvent reports a Crazyradio being added to or removed from service
+type RadioEvent struct {
+	Type    RadioEventType
+	Dongle  int   // the number of the dongle, see RadioDevice.Index
+	Bus     uint8 // usb bus of the dongle
+	Address uint8 // usb device address of the dongle
+	Radios  int   // the number of dongles in service after the event
+	Err     error // for a removal, the error which retired the dongle (nil if it was unplugged)
+}
+
+// RadioEventsRegister registers a callback which is called whenever a Crazyradio is added or removed
+func (manager *Manager) RadioEventsRegister(callback func(RadioEvent)) {
+	manager.eventCallbacksLock.Lock()
+	defer manager.eventCallbacksLock.Unlock()
+	manager.eventCallbacks = append(manager.eventCallbacks, callback)
+}
+
+func (manager *Manager) radioEventSend(event RadioEvent) {
+	manager.eventCallbacksLock.Lock()
+	defer manager.eventCallbacksLock.Unlock()
+	for _, callback := range manager.eventCallbacks {
+		go callback(event)
+	}
+}
+
+// RadioCount returns the number of Crazyradios in service
+func (manager *Manager) RadioCount() int {
+	manager.radiosLock.RLock()
+	defer manager.radiosLock.RUnlock()
+	return len(manager.radios)
+}
+
+// radioBorrow returns the first radio in service, for operations (eg. scanning) which take over a radio
+func (manager *Manager) radioBorrow() (*RadioDevice, error) {
+	manager.radiosLock.RLock()
+	defer manager.radiosLock.RUnlock()
+
+	if len(manager.radios) == 0 {
+		return nil, ErrorDeviceNotFound
+	}
+	return manager.radios[0], nil
+}
+
+// radiosAddNew opens the dongles which are plugged in but not yet in service, starting a radio thread for each.
+// A dongle retired for failing is skipped until it is unplugged, or for retiredBackoff.
+func (manager *Manager) radiosAddNew() int {
+	manager.radiosLock.Lock()
+	now := time.Now()
+	newRadios := openRadios(manager.usbContext, func(desc *usb.Descriptor) bool {
+		if retired, ok := manager.retired[usbID{desc.Bus, desc.Address}]; ok && now.Sub(retired) < retiredBackoff {
+			return false
+		}
+		return manager.radioFind(desc.Bus, desc.Address) == nil
+	})
+	for _, radio := range newRadios {
+		delete(manager.retired, usbID{radio.usbBus, radio.usbAddress})
+		radio.index = manager.radiosOpened
+		manager.radiosOpened++
+		manager.radios = append(manager.radios, radio)
+		manager.waitGroup.Add(1)
+		go manager.radioThread(radio)
+	}
+	count := len(manager.radios)
+	manager.radiosLock.Unlock()
+
+	if len(newRadios) > 0 {
+		manager.scheduleRebalance() // spread the channels over the new radios
+	}
+
+	for _, radio := range newRadios {
+		manager.radioEventSend(RadioEvent{Type: RadioAdded, Dongle: radio.index, Bus: radio.usbBus, Address: radio.usbAddress, Radios: count})
+	}
+
+	return len(newRadios)
+}
+
+// radioFind returns the radio in service at a usb bus and address. Should be called with the radios lock held.
+func (manager *Manager) radioFind(bus uint8, address uint8) *RadioDevice {
+	for _, radio := range manager.radios {
+		if radio.usbBus == bus && radio.usbAddress == address {
+			return radio
+		}
+	}
+	return nil
+}
+
+// radioRetire removes a radio from service and closes it. Its radio thread stops, and the channels
+// it owned are rebalanced over the remaining radios. A radio retired for an error is remembered, such that
+// it is not reopened straight away while it stays plugged in.
+func (manager *Manager) radioRetire(radio *RadioDevice, err error) {
+	manager.radiosLock.Lock()
+	found := false
+	for i, r := range manager.radios {
+		if r == radio {
+			manager.radios = append(manager.radios[:i], manager.radios[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found && err != nil && manager.retired != nil {
+		manager.retired[usbID{radio.usbBus, radio.usbAddress}] = time.Now()
+	}
+	count := len(manager.radios)
+	manager.radiosLock.Unlock()
+
+	if !found {
+		return // already retired
+	}
+
+	radio.Lock()
+	close(radio.retired)
+	radio.Close()
+	radio.Unlock()
+
+	manager.scheduleRebalance() // hand the channels of the radio to the remaining ones
+
+	manager.radioEventSend(RadioEvent{Type: RadioRemoved, Dongle: radio.index, Bus: radio.usbBus, Address: radio.usbAddress, Radios: count, Err: err})
+}
+
+// hotplugThread periodically retires the dongles which have been unplugged and opens those which have been plugged in
+func (manager *Manager) hotplugThread() {
+	defer manager.waitGroup.Done()
+
+	ticker := time.NewTicker(hotplugPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-manager.shouldStop:
+			return
+		case <-ticker.C:
+		}
+
+		present := make(map[usbID]bool)
+		manager.usbContext.ListDevices(func(desc *usb.Descriptor) bool {
+			if isRadio(desc) {
+				present[usbID{desc.Bus, desc.Address}] = true
+			}
+			return false // only listing, nothing is opened
+		})
+
+		manager.radiosLock.Lock()
+		unplugged := make([]*RadioDevice, 0)
+		for _, radio := range manager.radios {
+			if !present[usbID{radio.usbBus, radio.usbAddress}] {
+				unplugged = append(unplugged, radio)
+			}
+		}
+		for id := range manager.retired {
+			if !present[id] {
+				delete(manager.retired, id) // unplugged, it is opened as soon as it is plugged in again
+			}
+		}
+		manager.radiosLock.Unlock()
+
+		for _, radio := range unplugged {
+			manager.radioRetire(radio, nil)
+		}
+
+		manager.radiosAddNew()
+	}
+}
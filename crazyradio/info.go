@@ -0,0 +1,140 @@
+package crazyradio
+
+import (
+	"fmt"
+
+	"github.com/kylelemons/gousb/usb"
+)
+
+// firmware versions (in hundredths) from which the Crazyradio supports a feature
+const (
+	versionRetransmitSettings = 40 // ARC, ARD and disabling acknowledgements
+	versionFirmwareScan       = 50 // SCANN_CHANNELS, older dongles are scanned channel by channel
+)
+
+// the usb string descriptor holding the serial number of the dongle
+const serialDescriptorIndex = 3
+
+func (radio *RadioDevice) versionAtLeast(version int) bool {
+	return radio.version >= version
+}
+
+// Version returns the firmware version of the dongle, eg. 0.53
+func (radio *RadioDevice) Version() string {
+	return fmt.Sprintf("%d.%02d", radio.version/100, radio.version%100)
+}
+
+// Serial returns the serial number of the dongle
+func (radio *RadioDevice) Serial() string {
+	return radio.serial
+}
+
+// scanChannelsSoftware scans like ScanChannels, for dongles whose firmware cannot
+func (radio *RadioDevice) scanChannelsSoftware(start uint8, stop uint8, packet []byte) ([]uint8, error) {
+	channels := make([]uint8, 0)
+
+	for channel := start; channel <= stop; channel++ {
+		err := radio.SetChannel(channel)
+		if err != nil {
+			return nil, err
+		}
+		err = radio.SendPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+		ack, err := radio.ReadAck()
+		if err != nil {
+			return nil, err
+		}
+		if ack.Received {
+			channels = append(channels, channel)
+		}
+	}
+
+	return channels, nil
+}
+
+// LaunchBootloader restarts the dongle in its bootloader, for its firmware to be updated.
+// The dongle then disappears from the bus and is retired.
+func (radio *RadioDevice) LaunchBootloader() error {
+	_, err := radio.device.Control(usb.REQUEST_TYPE_VENDOR, uint8(LAUNCH_BOOTLOADER), 0, 0, nil)
+	return err
+}
+
+// RadioInfo describes a Crazyradio in service
+type RadioInfo struct {
+	Index      int       `json:"index"`
+	Serial     string    `json:"serial"`
+	Version    string    `json:"version"`
+	Bus        uint8     `json:"bus"`
+	Address    uint8     `json:"address"`
+	Channels   []uint8   `json:"channels"`   // the channels the dongle serves
+	Crazyflies int       `json:"crazyflies"` // the number of crazyflies on those channels
+	Stats      LinkStats `json:"stats"`      // statistics of every exchange made by the dongle
+	UsbErrors  uint64    `json:"usbErrors"`  // failed usb transfers
+	Rounds     uint64    `json:"rounds"`     // scheduler rounds in which the dongle transmitted
+	RoundTime  float64   `json:"roundTime"`  // total time spent in those rounds in seconds, RoundTime/Rounds being the mean round time
+}
+
+// Radios returns the Crazyradios in service
+func (manager *Manager) Radios() []RadioInfo {
+	manager.radiosLock.RLock()
+	inService := append([]*RadioDevice{}, manager.radios...)
+	manager.radiosLock.RUnlock()
+
+	infos := make([]RadioInfo, 0, len(inService))
+	for _, radio := range inService {
+		info := RadioInfo{
+			Index:    radio.index,
+			Serial:   radio.serial,
+			Version:  radio.Version(),
+			Bus:      radio.usbBus,
+			Address:  radio.usbAddress,
+			Channels: manager.scheduleChannels(radio),
+		}
+
+		manager.packetQueuesLock.RLock()
+		for _, channel := range info.Channels {
+			info.Crazyflies += len(manager.packetQueues[channel])
+		}
+		manager.packetQueuesLock.RUnlock()
+
+		radio.Lock()
+		info.Stats = radio.stats
+		info.UsbErrors = radio.usbErrors
+		info.Rounds = radio.rounds
+		info.RoundTime = radio.roundTime.Seconds()
+		radio.Unlock()
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// RadioBootloader restarts the Crazyradio with the given serial number in its bootloader, retiring it.
+// Its channels are handed to the remaining radios.
+func (manager *Manager) RadioBootloader(serial string) error {
+	manager.radiosLock.RLock()
+	var radio *RadioDevice
+	for _, r := range manager.radios {
+		if r.serial == serial {
+			radio = r
+		}
+	}
+	manager.radiosLock.RUnlock()
+
+	if radio == nil {
+		return ErrorDeviceNotFound
+	}
+
+	radio.Lock()
+	err := radio.LaunchBootloader()
+	radio.Unlock()
+	if err != nil {
+		return err
+	}
+
+	manager.radioRetire(radio, nil)
+	return nil
+}
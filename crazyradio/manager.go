@@ -0,0 +1,134 @@
+package crazyradio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kylelemons/gousb/usb"
+)
+
+// Manager owns a set of Crazyradios, the packet queues of the crazyflies they serve and the threads serving them.
+// Managers are independent of each other: each opens its own usb context, so several can run side by side,
+// and a manager can be stopped and started again.
+type Manager struct {
+	lifecycle  sync.Mutex // serializes Start and Stop
+	usbContext *usb.Context
+	shouldStop chan bool // closed by Stop, nil while the manager is stopped
+	waitGroup  sync.WaitGroup
+
+	radios       []*RadioDevice
+	radiosLock   sync.RWMutex        // protects radios (and retired), which changes as dongles are plugged in and retired
+	radiosOpened int                 // the number of dongles opened since the manager started, used to number them
+	retired      map[usbID]time.Time // the failing dongles retired while still plugged in, see radiosAddNew
+
+	packetQueues     map[uint8]map[uint64]*packetQueue
+	callbacks        map[uint8]map[uint64]func([]byte)
+	channelSchedules map[uint8]*channelSchedule
+	packetQueuesLock sync.RWMutex // protects packetQueues, callbacks and channelSchedules, which the radio threads read concurrently
+
+	eventCallbacks     []func(RadioEvent)
+	eventCallbacksLock sync.Mutex
+
+	activeCapture *capture
+	captureLock   sync.Mutex
+}
+
+// NewManager returns a manager without radios, crazyflies can be registered before it is started
+func NewManager() *Manager {
+	return &Manager{
+		packetQueues:     make(map[uint8]map[uint64]*packetQueue),
+		callbacks:        make(map[uint8]map[uint64]func([]byte)),
+		channelSchedules: make(map[uint8]*channelSchedule),
+	}
+}
+
+// DefaultManager is the manager used by the package level functions
+var DefaultManager = NewManager()
+
+// Start starts the DefaultManager, see Manager.Start
+func Start() error {
+	return DefaultManager.Start()
+}
+
+// Stop stops the DefaultManager, see Manager.Stop
+func Stop() {
+	DefaultManager.Stop()
+}
+
+func CrazyflieRegister(ctx context.Context, channel uint8, datarate RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	return DefaultManager.CrazyflieRegister(ctx, channel, datarate, address, responseCallback)
+}
+
+func CrazyflieRemove(channel uint8, address uint64) {
+	DefaultManager.CrazyflieRemove(channel, address)
+}
+
+func PacketSend(channel uint8, address uint64, packet []byte) error {
+	return DefaultManager.PacketSend(channel, address, packet)
+}
+
+func PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	DefaultManager.PacketSendPriority(channel, address, packet)
+}
+
+func PacketSendDeadline(channel uint8, address uint64, packet []byte, deadline time.Time) {
+	DefaultManager.PacketSendDeadline(channel, address, packet, deadline)
+}
+
+func PacketSendLatest(channel uint8, address uint64, slot uint8, packet []byte, deadline time.Time) {
+	DefaultManager.PacketSendLatest(channel, address, slot, packet, deadline)
+}
+
+func PacketQueueSetDepth(channel uint8, address uint64, depth int) error {
+	return DefaultManager.PacketQueueSetDepth(channel, address, depth)
+}
+
+func PacketQueueSetBudget(channel uint8, address uint64, packetsPerSecond float64) error {
+	return DefaultManager.PacketQueueSetBudget(channel, address, packetsPerSecond)
+}
+
+func PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	return DefaultManager.PacketQueueWaitForEmpty(ctx, channel, address)
+}
+
+func LinkStatsGet(channel uint8, address uint64) LinkStats {
+	return DefaultManager.LinkStatsGet(channel, address)
+}
+
+func RadioEventsRegister(callback func(RadioEvent)) {
+	DefaultManager.RadioEventsRegister(callback)
+}
+
+func RadioCount() int {
+	return DefaultManager.RadioCount()
+}
+
+func Radios() []RadioInfo {
+	return DefaultManager.Radios()
+}
+
+func RadioBootloader(serial string) error {
+	return DefaultManager.RadioBootloader(serial)
+}
+
+func Scan(addresses []uint64) ([]ScanResult, error) {
+	return DefaultManager.Scan(addresses)
+}
+
+func Survey(datarate RadioDatarate, address uint64, packetsPerChannel int) ([]ChannelSurvey, error) {
+	return DefaultManager.Survey(datarate, address, packetsPerChannel)
+}
+
+func BroadcastSend(channel uint8, datarate RadioDatarate, address uint64, packet []byte, repeats int) error {
+	return DefaultManager.BroadcastSend(channel, datarate, address, packet, repeats)
+}
+
+func CaptureStart(w io.Writer) error {
+	return DefaultManager.CaptureStart(w)
+}
+
+func CaptureStop() (uint64, error) {
+	return DefaultManager.CaptureStop()
+}
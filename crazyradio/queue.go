@@ -0,0 +1,234 @@
+package crazyradio
+
+import (
+	"container/list"
+	"time"
+)
+
+// queuedPacket is a packet waiting in a packet queue. A packet with a deadline is dropped rather than sent late.
+type queuedPacket struct {
+	data     []byte
+	deadline time.Time // zero for no deadline
+	slot     uint8     // the coalescing slot of a packet sent with PacketSendLatest
+	latest   bool      // whether the packet occupies its coalescing slot
+}
+
+func (p *queuedPacket) expired(now time.Time) bool {
+	return !p.deadline.IsZero() && now.After(p.deadline)
+}
+
+// the default depth of the standard queue of a crazyflie, enough for the pages written while flashing
+const defaultQueueDepth = 1024
+
+// the burst a budgeted crazyflie may send after idling, as a fraction of its budget per second
+const budgetBurstFraction = 0.1
+
+// PacketSendDeadline queues a packet with priority which is dropped if it cannot be sent before deadline,
+// eg. a setpoint which is superseded by the next one. Within a round, the crazyflies with the most urgent
+// packets are served first.
+func (manager *Manager) PacketSendDeadline(channel uint8, address uint64, packet []byte, deadline time.Time) {
+	queue := manager.packetQueueGet(channel, address)
+
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+
+	queue.lock.Lock()
+	queue.priorityQueue.PushBack(&queuedPacket{data: packetCopy, deadline: deadline})
+	queue.lock.Unlock()
+}
+
+// PacketSendLatest queues a packet as PacketSendDeadline, in a coalescing slot of the crazyflie: a packet still
+// waiting in the same slot is replaced, such that only the latest value (eg. of a setpoint or position streamed
+// faster than the link can carry) is sent. The slots are numbered by the caller, one for each kind of message.
+func (manager *Manager) PacketSendLatest(channel uint8, address uint64, slot uint8, packet []byte, deadline time.Time) {
+	queue := manager.packetQueueGet(channel, address)
+
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if previous, ok := queue.latest[slot]; ok && !queue.inTransit(previous) {
+		queue.priorityQueue.Remove(previous)
+		queue.stats.Superseded++
+	}
+	// a packet being transmitted stays queued until it is acknowledged, it only loses its slot (see packetUnsent)
+	queue.latest[slot] = queue.priorityQueue.PushBack(&queuedPacket{data: packetCopy, deadline: deadline, slot: slot, latest: true})
+}
+
+// PacketQueueSetDepth limits the standard queue of a crazyflie to depth packets (0 for no limit), the packets
+// sent while it is full are dropped (see PacketSend). The default depth is 1024 packets.
+// It returns ErrorNotRegistered if the crazyflie is not registered.
+func (manager *Manager) PacketQueueSetDepth(channel uint8, address uint64, depth int) error {
+	queue, ok := manager.packetQueueLookup(channel, address)
+	if !ok {
+		return ErrorNotRegistered
+	}
+
+	queue.lock.Lock()
+	queue.depth = depth
+	queue.lock.Unlock()
+	return nil
+}
+
+// inTransit reports whether a queued packet is being transmitted, or awaits its retransmission on a safelink.
+// Should be called with the queue lock held.
+func (queue *packetQueue) inTransit(element *list.Element) bool {
+	return element == queue.transmitting || (queue.inflight != nil && queue.inflight.element == element)
+}
+
+// packetRemove removes a packet from one of the queues, freeing its coalescing slot.
+// Should be called with the queue lock held.
+func (queue *packetQueue) packetRemove(packets *list.List, element *list.Element) {
+	packets.Remove(element)
+	if p := element.Value.(*queuedPacket); p.latest && queue.latest[p.slot] == element {
+		delete(queue.latest, p.slot)
+	}
+}
+
+// packetUnsent drops a packet which failed to transmit after a newer packet took its coalescing slot,
+// unless the safelink retransmits it. Should be called with the queue lock held.
+func (queue *packetQueue) packetUnsent(packets *list.List, element *list.Element) {
+	p := element.Value.(*queuedPacket)
+	if !p.latest || queue.latest[p.slot] == element || queue.inTransit(element) {
+		return
+	}
+	packets.Remove(element)
+	queue.stats.Superseded++
+}
+
+// PacketQueueSetBudget limits the packets from the standard queue of a crazyflie to packetsPerSecond (0 for no limit),
+// such that bulk transfers (eg. TOC downloads or flashing) leave airtime for the other crazyflies on the channel.
+// Priority packets and pings are not budgeted. It returns ErrorNotRegistered if the crazyflie is not registered.
+func (manager *Manager) PacketQueueSetBudget(channel uint8, address uint64, packetsPerSecond float64) error {
+	queue, ok := manager.packetQueueLookup(channel, address)
+	if !ok {
+		return ErrorNotRegistered
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.budget = packetsPerSecond
+	queue.budgetBurst = packetsPerSecond * budgetBurstFraction
+	if queue.budgetBurst < 1 {
+		queue.budgetBurst = 1
+	}
+	queue.budgetTokens = queue.budgetBurst
+	queue.budgetUpdated = time.Now()
+	return nil
+}
+
+// dropExpired removes the packets whose deadline has passed. Should be called with the queue lock held.
+func (queue *packetQueue) dropExpired(now time.Time) {
+	for _, packets := range []*list.List{queue.priorityQueue, queue.standardQueue} {
+		for e := packets.Front(); e != nil; {
+			next := e.Next()
+			if e.Value.(*queuedPacket).expired(now) {
+				queue.packetRemove(packets, e)
+				queue.stats.Expired++
+			}
+			e = next
+		}
+	}
+}
+
+// urgency returns the time by which the crazyflie should be served: the earliest deadline of its priority packets,
+// now if it has priority packets without deadline, or the zero time if nothing is urgent.
+// Should be called with the queue lock held.
+func (queue *packetQueue) urgency(now time.Time) time.Time {
+	urgency := time.Time{}
+	for e := queue.priorityQueue.Front(); e != nil; e = e.Next() {
+		deadline := e.Value.(*queuedPacket).deadline
+		if deadline.IsZero() {
+			deadline = now
+		}
+		if urgency.IsZero() || deadline.Before(urgency) {
+			urgency = deadline
+		}
+	}
+	return urgency
+}
+
+// budgetAvailable refills the token bucket and reports whether a standard packet may be sent.
+// Should be called with the queue lock held.
+func (queue *packetQueue) budgetAvailable(now time.Time) bool {
+	if queue.budget <= 0 {
+		return true
+	}
+
+	if now.After(queue.budgetUpdated) {
+		queue.budgetTokens += now.Sub(queue.budgetUpdated).Seconds() * queue.budget
+		if queue.budgetTokens > queue.budgetBurst {
+			queue.budgetTokens = queue.budgetBurst
+		}
+		queue.budgetUpdated = now
+	}
+
+	return queue.budgetTokens >= 1
+}
+
+// nextPacket selects the packet to transmit: the most urgent priority packet, then the next standard packet
+// if the budget allows it. It returns nil if there is nothing to send. Should be called with the queue lock held.
+func (queue *packetQueue) nextPacket(now time.Time) (*list.List, *list.Element) {
+	queue.dropExpired(now)
+
+	if queue.priorityQueue.Front() != nil {
+		// the earliest deadline first, packets without deadline in order (they are considered due now)
+		var selected *list.Element
+		var selectedDeadline time.Time
+		for e := queue.priorityQueue.Front(); e != nil; e = e.Next() {
+			deadline := e.Value.(*queuedPacket).deadline
+			if deadline.IsZero() {
+				deadline = now
+			}
+			if selected == nil || deadline.Before(selectedDeadline) {
+				selected, selectedDeadline = e, deadline
+			}
+		}
+		return queue.priorityQueue, selected
+	}
+
+	if queue.standardQueue.Front() != nil && queue.budgetAvailable(now) {
+		return queue.standardQueue, queue.standardQueue.Front()
+	}
+
+	return nil, nil
+}
+
+// nextTransmission selects what to transmit to the crazyflie in this round: the packet left unacknowledged on a safelink,
+// the safelink negotiation, the next queued packet (see nextPacket) or a ping. It returns false if there is nothing to send
+// and the crazyflie is not yet due to be polled. Should be called with the queue lock held.
+func (queue *packetQueue) nextTransmission(now time.Time) ([]byte, *list.List, *list.Element, bool) {
+	if queue.inflight != nil {
+		return queue.inflight.data, queue.inflight.packets, queue.inflight.element, true
+	}
+	if queue.safelink == safelinkNegotiating {
+		return safelinkEnablePacket, nil, nil, true
+	}
+
+	var packet []byte
+	packets, element := queue.nextPacket(now)
+	if element != nil {
+		packet = element.Value.(*queuedPacket).data
+	} else if now.Before(queue.nextPoll) {
+		return nil, nil, nil, false
+	} else {
+		packet = defaultPacket
+	}
+
+	if queue.safelink == safelinkEnabled {
+		packet = queue.safelinkStamp(packet)
+	}
+	return packet, packets, element, true
+}
+
+// packetSent removes an acknowledged packet from its queue and charges the budget
+// Should be called with the queue lock held.
+func (queue *packetQueue) packetSent(packets *list.List, element *list.Element) {
+	queue.packetRemove(packets, element)
+	if packets == queue.standardQueue && queue.budget > 0 {
+		queue.budgetTokens--
+	}
+}
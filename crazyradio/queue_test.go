@@ -0,0 +1,215 @@
+package crazyradio
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testChannel = 80
+	testAddress = 0xE7E7E7E701
+)
+
+// transmit selects the next packet of a queue as the radio thread does, and returns its first byte (-1 for none)
+func transmit(queue *packetQueue, now time.Time, acknowledged bool) int {
+	packets, element := queue.nextPacket(now)
+	if element == nil {
+		return -1
+	}
+	if acknowledged {
+		queue.packetSent(packets, element)
+	}
+	return int(element.Value.(*queuedPacket).data[0])
+}
+
+func TestPacketSendQueueFull(t *testing.T) {
+	manager := NewManager()
+	manager.PacketSend(testChannel, testAddress, []byte{0}) // registers the queue
+	if err := manager.PacketQueueSetDepth(testChannel, testAddress, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < 3; i++ {
+		if err := manager.PacketSend(testChannel, testAddress, []byte{byte(i)}); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	for i := 3; i < 5; i++ {
+		if err := manager.PacketSend(testChannel, testAddress, []byte{byte(i)}); err != ErrorQueueFull {
+			t.Fatalf("packet %d sent to the full queue: %v", i, err)
+		}
+	}
+
+	stats := manager.LinkStatsGet(testChannel, testAddress)
+	if stats.Queued != 3 || stats.Dropped != 2 {
+		t.Fatalf("%d queued and %d dropped, expecting 3 and 2", stats.Queued, stats.Dropped)
+	}
+
+	// the priority packets are not limited by the depth
+	manager.PacketSendPriority(testChannel, testAddress, []byte{5})
+
+	queue, _ := manager.packetQueueLookup(testChannel, testAddress)
+	for _, expected := range []int{5, 0, 1, 2} {
+		if sent := transmit(queue, time.Now(), true); sent != expected {
+			t.Fatalf("sent %d, expecting %d", sent, expected)
+		}
+	}
+	if err := manager.PacketSend(testChannel, testAddress, []byte{6}); err != nil {
+		t.Fatalf("packet sent to the drained queue: %v", err)
+	}
+}
+
+func TestPacketSendLatest(t *testing.T) {
+	const slotSetpoint, slotPosition = 0, 1
+	deadline := time.Now().Add(time.Second)
+
+	for _, test := range []struct {
+		name       string
+		inTransit  bool // the first setpoint is being transmitted when it is superseded
+		acked      bool // and its transmission is acknowledged
+		sent       []int
+		superseded uint64
+	}{
+		{"waiting", false, false, []int{3, 2}, 1},
+		{"acknowledged in transit", true, true, []int{1, 3, 2}, 0},
+		{"lost in transit", true, false, []int{3, 2}, 1},
+	} {
+		manager := NewManager()
+		manager.PacketSendLatest(testChannel, testAddress, slotSetpoint, []byte{1}, deadline)
+		manager.PacketSendLatest(testChannel, testAddress, slotPosition, []byte{2}, deadline.Add(time.Millisecond))
+		queue, _ := manager.packetQueueLookup(testChannel, testAddress)
+
+		sent := []int{}
+		if test.inTransit {
+			packets, element := queue.nextPacket(time.Now())
+			queue.transmitting = element
+			manager.PacketSendLatest(testChannel, testAddress, slotSetpoint, []byte{3}, deadline)
+			queue.transmitting = nil
+			if test.acked {
+				queue.packetSent(packets, element)
+				sent = append(sent, int(element.Value.(*queuedPacket).data[0]))
+			} else {
+				queue.packetUnsent(packets, element)
+			}
+		} else {
+			manager.PacketSendLatest(testChannel, testAddress, slotSetpoint, []byte{3}, deadline)
+		}
+
+		for {
+			packet := transmit(queue, time.Now(), true)
+			if packet < 0 {
+				break
+			}
+			sent = append(sent, packet)
+		}
+
+		if len(sent) != len(test.sent) {
+			t.Fatalf("%s: sent %v, expecting %v", test.name, sent, test.sent)
+		}
+		for i := range sent {
+			if sent[i] != test.sent[i] {
+				t.Fatalf("%s: sent %v, expecting %v", test.name, sent, test.sent)
+			}
+		}
+		if queue.stats.Superseded != test.superseded {
+			t.Fatalf("%s: %d superseded, expecting %d", test.name, queue.stats.Superseded, test.superseded)
+		}
+		if len(queue.latest) != 0 {
+			t.Fatalf("%s: slots left occupied", test.name)
+		}
+	}
+}
+
+func TestNextPacketDeadline(t *testing.T) {
+	manager := NewManager()
+	now := time.Now()
+	manager.PacketSend(testChannel, testAddress, []byte{1})
+	manager.PacketSendDeadline(testChannel, testAddress, []byte{2}, now.Add(-time.Millisecond)) // expired
+	manager.PacketSendDeadline(testChannel, testAddress, []byte{3}, now.Add(20*time.Millisecond))
+	manager.PacketSendDeadline(testChannel, testAddress, []byte{4}, now.Add(10*time.Millisecond))
+	queue, _ := manager.packetQueueLookup(testChannel, testAddress)
+
+	if urgency := queue.urgency(now); !urgency.Equal(now.Add(-time.Millisecond)) {
+		t.Fatalf("urgency %v, expecting the expired deadline", urgency.Sub(now))
+	}
+
+	// the earliest deadline first, then the standard packets
+	for _, expected := range []int{4, 3, 1, -1} {
+		if sent := transmit(queue, now, true); sent != expected {
+			t.Fatalf("sent %d, expecting %d", sent, expected)
+		}
+	}
+	if queue.stats.Expired != 1 {
+		t.Fatalf("%d expired, expecting 1", queue.stats.Expired)
+	}
+	if urgency := queue.urgency(now); !urgency.IsZero() {
+		t.Fatalf("urgency %v without priority packets", urgency.Sub(now))
+	}
+
+	// a priority packet without deadline is due now
+	manager.PacketSendPriority(testChannel, testAddress, []byte{5})
+	if urgency := queue.urgency(now); !urgency.Equal(now) {
+		t.Fatalf("urgency %v, expecting now", urgency.Sub(now))
+	}
+}
+
+func TestBudget(t *testing.T) {
+	manager := NewManager()
+	manager.PacketSend(testChannel, testAddress, []byte{0})
+	if err := manager.PacketQueueSetBudget(testChannel, testAddress, 10); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 4; i++ {
+		manager.PacketSend(testChannel, testAddress, []byte{byte(i)})
+	}
+	manager.PacketSendPriority(testChannel, testAddress, []byte{4})
+	queue, _ := manager.packetQueueLookup(testChannel, testAddress)
+	now := queue.budgetUpdated
+
+	// the burst of 10 packets per second is a single packet, and the priority packets are not budgeted
+	for _, expected := range []int{4, 0, -1} {
+		if sent := transmit(queue, now, true); sent != expected {
+			t.Fatalf("sent %d, expecting %d", sent, expected)
+		}
+	}
+
+	// a packet every 100ms, the tokens not accumulating beyond the burst
+	if sent := transmit(queue, now.Add(50*time.Millisecond), true); sent != -1 {
+		t.Fatalf("sent %d before the budget was refilled", sent)
+	}
+	if sent := transmit(queue, now.Add(time.Second), true); sent != 1 {
+		t.Fatalf("sent %d, expecting 1", sent)
+	}
+	if sent := transmit(queue, now.Add(time.Second), true); sent != -1 {
+		t.Fatalf("sent %d beyond the burst", sent)
+	}
+
+	// a packet which was not acknowledged is not charged
+	if sent := transmit(queue, now.Add(1100*time.Millisecond), false); sent != 2 {
+		t.Fatalf("sent %d, expecting 2", sent)
+	}
+	if sent := transmit(queue, now.Add(1100*time.Millisecond), true); sent != 2 {
+		t.Fatalf("sent %d, expecting 2 again", sent)
+	}
+
+	// without a budget, the queue is drained at once
+	if err := manager.PacketQueueSetBudget(testChannel, testAddress, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sent := transmit(queue, now.Add(1100*time.Millisecond), true); sent != 3 {
+		t.Fatalf("sent %d, expecting 3", sent)
+	}
+}
+
+func TestPacketQueueSetNotRegistered(t *testing.T) {
+	manager := NewManager()
+	if err := manager.PacketQueueSetDepth(testChannel, testAddress, 3); err != ErrorNotRegistered {
+		t.Fatalf("set the depth of an unregistered crazyflie: %v", err)
+	}
+	if err := manager.PacketQueueSetBudget(testChannel, testAddress, 10); err != ErrorNotRegistered {
+		t.Fatalf("set the budget of an unregistered crazyflie: %v", err)
+	}
+	if _, ok := manager.packetQueueLookup(testChannel, testAddress); ok {
+		t.Fatal("the queue of an unregistered crazyflie was created")
+	}
+}
@@ -9,14 +9,30 @@ import (
 )
 
 type RadioDevice struct {
-	device  *usb.Device
-	lock    *sync.Mutex
-	dataOut usb.Endpoint
-	dataIn  usb.Endpoint
-	address uint64
+	device   *usb.Device
+	lock     *sync.Mutex
+	dataOut  usb.Endpoint
+	dataIn   usb.Endpoint
+	address  uint64
+	channel  uint8
+	datarate RadioDatarate
+
+	// the usb bus and device address identify the dongle while it stays plugged in
+	usbBus     uint8
+	usbAddress uint8
+	index      int // the number of the dongle, in the order the dongles were opened
+	serial     string
+	version    int           // firmware version from the usb descriptor, in hundredths (eg. 53 for 0.53)
+	stats      LinkStats     // statistics of every exchange made by the dongle
+	failures   int           // consecutive failed usb transfers, see radioThread
+	usbErrors  uint64        // failed usb transfers since the dongle was opened
+	rounds     uint64        // scheduler rounds in which the dongle transmitted
+	roundTime  time.Duration // total time spent in those rounds
+	retired    chan bool     // closed once the dongle has been removed from service
 }
 
-var usbContext *usb.Context
+// the channel a radio is considered to be on until it has been set, forcing the first SetChannel to go through
+const unknownChannel = 0xFF
 
 func OpenRadio(dev *usb.Device) (*RadioDevice, error) {
 	// open the endpoint for transfers out
@@ -45,34 +61,52 @@ func OpenRadio(dev *usb.Device) (*RadioDevice, error) {
 	radio.device = dev
 	radio.dataOut = dOut
 	radio.dataIn = dIn
+	radio.usbBus = dev.Bus
+	radio.usbAddress = dev.Address
+	radio.retired = make(chan bool)
+	radio.channel = unknownChannel
+	radio.version = dev.Device.Int()
+	radio.serial, _ = dev.GetStringDescriptor(serialDescriptorIndex)
 
 	// can initialize the default states!
 	radio.SetDatarate(RadioDatarate_2MPS)
 	radio.SetChannel(80)
 	radio.SetAddress(0xE7E7E7E7E7)
 	radio.SetPower(RadioPower_0DBM)
-	radio.SetArc(3)
-	radio.SetArdBytes(32)
+	if radio.versionAtLeast(versionRetransmitSettings) {
+		radio.SetArc(3)
+		radio.SetArdBytes(32)
+		radio.SetAckEnable(1)
+	}
 	return radio, nil
 }
 
 func OpenAllRadios() ([]*RadioDevice, error) {
-	usbContext := usb.NewContext()
-	usbContext.Debug(0)
+	context := usb.NewContext()
+	context.Debug(0)
 
-	radioDevices, _ := usbContext.ListDevices(
-		func(desc *usb.Descriptor) bool {
-			if desc.Vendor == 0x1915 && desc.Product == 0x7777 {
-				return true
-			}
-			return false
-		})
+	radios := openRadios(context, func(desc *usb.Descriptor) bool { return true })
 
-	if len(radioDevices) == 0 {
-		usbContext.Close()
+	if len(radios) == 0 {
+		context.Close()
 		return nil, ErrorDeviceNotFound
 	}
 
+	return radios, nil
+}
+
+// isRadio reports whether a usb device is a Crazyradio
+func isRadio(desc *usb.Descriptor) bool {
+	return desc.Vendor == 0x1915 && desc.Product == 0x7777
+}
+
+// openRadios opens every Crazyradio for which open returns true
+func openRadios(context *usb.Context, open func(desc *usb.Descriptor) bool) []*RadioDevice {
+	radioDevices, _ := context.ListDevices(
+		func(desc *usb.Descriptor) bool {
+			return isRadio(desc) && open(desc)
+		})
+
 	radios := make([]*RadioDevice, 0, len(radioDevices))
 
 	for _, radioDevice := range radioDevices {
@@ -82,18 +116,29 @@ func OpenAllRadios() ([]*RadioDevice, error) {
 		}
 	}
 
-	if len(radios) == 0 {
-		usbContext.Close()
-		return nil, ErrorDeviceNotFound
-	}
+	return radios
+}
 
-	return radios, nil
+// Index returns the number of the dongle, dongles are numbered in the order they were opened
+func (radio *RadioDevice) Index() int {
+	return radio.index
 }
 
 func (radio *RadioDevice) Close() {
 	radio.device.Close()
 }
 
+// Retired reports whether the dongle has been removed from service (unplugged or failing), after which it is closed.
+// Check it after taking the radio lock, before using the radio.
+func (radio *RadioDevice) Retired() bool {
+	select {
+	case <-radio.retired:
+		return true
+	default:
+		return false
+	}
+}
+
 func (radio *RadioDevice) Lock() {
 	radio.lock.Lock()
 }
@@ -107,19 +152,36 @@ func (radio *RadioDevice) SetChannel(channel uint8) error {
 		return ErrorInvalidChannel
 	}
 
+	if radio.channel == channel {
+		return nil // already set, save the control transfer
+	}
+
 	_, err := radio.device.Control(usb.REQUEST_TYPE_VENDOR, uint8(SET_RADIO_CHANNEL), uint16(channel), 0, nil)
+	if err == nil {
+		radio.channel = channel
+	} else {
+		radio.channel = unknownChannel
+	}
 	return err
 }
 
-func (radio *RadioDevice) SetDatarate(datarate radioDatarate) error {
+func (radio *RadioDevice) SetDatarate(datarate RadioDatarate) error {
 	if datarate > RadioDatarate_2MPS {
 		return ErrorInvalidDatarate
 	}
 
 	_, err := radio.device.Control(usb.REQUEST_TYPE_VENDOR, uint8(SET_DATA_RATE), uint16(datarate), 0, nil)
+	if err == nil {
+		radio.datarate = datarate
+	}
 	return err
 }
 
+// Datarate returns the datarate the radio was last successfully set to
+func (radio *RadioDevice) Datarate() RadioDatarate {
+	return radio.datarate
+}
+
 func (radio *RadioDevice) SetPower(power radioPower) error {
 	if power > RadioPower_0DBM {
 		return ErrorInvalidPower
@@ -167,6 +229,10 @@ func (radio *RadioDevice) SetArdBytes(nbytes uint8) error {
 }
 
 func (radio *RadioDevice) SetAckEnable(enable uint8) error {
+	if !radio.versionAtLeast(versionRetransmitSettings) {
+		return ErrorNotSupported
+	}
+
 	_, err := radio.device.Control(usb.REQUEST_TYPE_VENDOR, uint8(SET_ACK_ENABLE), uint16(enable), 0, nil)
 	return err
 }
@@ -190,13 +256,41 @@ func (radio *RadioDevice) SetAddress(address uint64) error {
 		0,
 		a)
 
-	if err != nil {
+	if err == nil {
 		radio.address = address
 	}
 
 	return err
 }
 
+// ScanChannels sends packet on every channel from start to stop (inclusive) at the current address and
+// datarate, returning the channels on which it was acknowledged. The sweep is performed by the dongle firmware.
+func (radio *RadioDevice) ScanChannels(start uint8, stop uint8, packet []byte) ([]uint8, error) {
+	if start > 125 || stop > 125 {
+		return nil, ErrorInvalidChannel
+	}
+
+	if !radio.versionAtLeast(versionFirmwareScan) {
+		return radio.scanChannelsSoftware(start, stop, packet)
+	}
+
+	radio.channel = unknownChannel // the scan leaves the radio on an arbitrary channel
+
+	_, err := radio.device.Control(usb.REQUEST_TYPE_VENDOR, uint8(SCANN_CHANNELS), uint16(start), uint16(stop), packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// the result is read back with a device to host request
+	result := make([]byte, 64)
+	length, err := radio.device.Control(usb.REQUEST_TYPE_VENDOR|uint8(usb.ENDPOINT_DIR_IN), uint8(SCANN_CHANNELS), 0, 0, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result[:length], nil
+}
+
 func (radio *RadioDevice) SendPacket(data []byte) error {
 	// write the outgoing packet
 	length, err := radio.dataOut.Write(data)
@@ -209,22 +303,43 @@ func (radio *RadioDevice) SendPacket(data []byte) error {
 	return nil
 }
 
-func (radio *RadioDevice) ReadResponse() (bool, []byte, error) {
+// Ack is the acknowledgement read back from the radio after transmitting a packet
+type Ack struct {
+	Received      bool   // whether the crazyflie acknowledged the packet
+	PowerDetector bool   // whether the received power was above -64dBm
+	Retries       uint8  // the number of retransmissions needed
+	Data          []byte // the payload of the acknowledgement
+}
+
+func (radio *RadioDevice) ReadAck() (Ack, error) {
 	// read the acknowledgement
 	resp := make([]byte, 40) // largest packet size
 	length, err := radio.dataIn.Read(resp)
 	if err != nil {
-		return false, nil, err
+		return Ack{}, err
+	}
+	if length == 0 {
+		return Ack{}, ErrorReadLength
 	}
-	//if length {
-	//	return false, nil, ERROR_READ_LENGTH
-	//}
 	// ACK structure:
 	// uint8_t resp : 1
 	// uint8_t power detector : 1
 	// uint8_t reserved : 2
 	// uint8_t retransmission count : 4
 	// uint8_t ackdata[1:32 bytes]
-	ackReceived := (resp[0] & 0x01) != 0
-	return ackReceived, resp[1:length], nil // return just the data portion of the acknowledgement
+	ack := Ack{
+		Received:      (resp[0] & 0x01) != 0,
+		PowerDetector: (resp[0] & 0x02) != 0,
+		Retries:       (resp[0] >> 4) & 0x0F,
+		Data:          resp[1:length], // just the data portion of the acknowledgement
+	}
+	return ack, nil
+}
+
+func (radio *RadioDevice) ReadResponse() (bool, []byte, error) {
+	ack, err := radio.ReadAck()
+	if err != nil {
+		return false, nil, err
+	}
+	return ack.Received, ack.Data, nil
 }
@@ -0,0 +1,98 @@
+package crazyradio
+
+import (
+	"bytes"
+	"container/list"
+)
+
+// Safelink makes the delivery of packets exactly-once in both directions. Bits 3 (up) and 2 (down) of the CRTP header
+// carry alternating sequence bits: the crazyflie drops a packet whose up bit is the same as the previous one's, which
+// is a retransmission of a packet it has already received but whose acknowledgement was lost, and the up bit is
+// toggled on every acknowledgement. Likewise, the down bit of a response is toggled for every new packet the
+// crazyflie sends, and a response carrying the previous down bit is a duplicate.
+// The mode is enabled by sending safelinkEnablePacket on the link port, which the crazyflie echoes if it supports it.
+
+type safelinkState uint8
+
+const (
+	safelinkOff         safelinkState = iota // plain acknowledgements, eg. the crazyflie does not support safelink
+	safelinkNegotiating                      // the enable packet is sent until the crazyflie echoes it or the attempts run out
+	safelinkEnabled
+)
+
+var safelinkEnablePacket = []byte{0xFF, 0x05, 0x01}
+
+// how many acknowledged enable packets the crazyflie has to echo one, older firmware never does
+const safelinkAttempts = 10
+
+const (
+	safelinkUpBit   = 0x08
+	safelinkDownBit = 0x04
+)
+
+// inflightPacket is a packet sent on a safelink which has not been acknowledged. The crazyflie may have received it,
+// so it is retransmitted as is (even if it has expired or been superseded in the meantime) until it is acknowledged,
+// otherwise the next packet would carry the same up bit and be dropped as a duplicate.
+type inflightPacket struct {
+	data    []byte
+	packets *list.List // the queue of the packet, nil for a ping
+	element *list.Element
+}
+
+// safelinkNegotiate starts the negotiation of safelink with a crazyflie, before any other packet is sent to it.
+// Should be called with the queue lock held.
+func (queue *packetQueue) safelinkNegotiate() {
+	queue.safelink = safelinkNegotiating
+	queue.safelinkAttempts = 0
+	queue.safelinkUp, queue.safelinkDown = 0, 0
+	queue.inflight = nil
+	queue.stats.Safelink = false
+}
+
+// safelinkStamp returns a copy of packet with the sequence bits of the link in the header.
+// Should be called with the queue lock held.
+func (queue *packetQueue) safelinkStamp(packet []byte) []byte {
+	stamped := make([]byte, len(packet))
+	copy(stamped, packet)
+	stamped[0] = stamped[0]&^(safelinkUpBit|safelinkDownBit) | queue.safelinkUp<<3 | queue.safelinkDown<<2
+	return stamped
+}
+
+// safelinkUnacknowledged records that packet was sent without being acknowledged.
+// Should be called with the queue lock held.
+func (queue *packetQueue) safelinkUnacknowledged(packet []byte, packets *list.List, element *list.Element) {
+	if queue.safelink == safelinkEnabled && queue.inflight == nil {
+		queue.inflight = &inflightPacket{packet, packets, element}
+	}
+}
+
+// safelinkAcknowledged updates the link with an acknowledgement, returning the response to deliver to the crazyflie's
+// callback, and false if there is none: the response is a duplicate, or the echo of the enable packet.
+// Should be called with the queue lock held.
+func (queue *packetQueue) safelinkAcknowledged(resp []byte) ([]byte, bool) {
+	switch queue.safelink {
+	case safelinkNegotiating:
+		if bytes.Equal(resp, safelinkEnablePacket) {
+			queue.safelink = safelinkEnabled
+			queue.stats.Safelink = true
+			return nil, false
+		}
+		queue.safelinkAttempts++
+		if queue.safelinkAttempts >= safelinkAttempts {
+			queue.safelink = safelinkOff
+		}
+
+	case safelinkEnabled:
+		queue.inflight = nil
+		queue.safelinkUp ^= 1
+		if len(resp) > 0 {
+			if resp[0]&safelinkDownBit != queue.safelinkDown<<2 {
+				queue.stats.Duplicates++
+				return nil, false
+			}
+			queue.safelinkDown ^= 1
+		}
+	}
+
+	return resp, true
+}
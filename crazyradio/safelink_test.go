@@ -0,0 +1,84 @@
+package crazyradio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSafelinkNegotiate(t *testing.T) {
+	manager := NewManager()
+	queue := manager.packetQueueGet(testChannel, testAddress)
+	queue.safelinkNegotiate()
+	manager.PacketSend(testChannel, testAddress, []byte{0x20, 1})
+
+	// the enable packet is sent before the queued packets, until the crazyflie echoes it
+	packet, _, _, ok := queue.nextTransmission(time.Now())
+	if !ok || !bytes.Equal(packet, safelinkEnablePacket) {
+		t.Fatalf("sent %x, expecting the enable packet", packet)
+	}
+	if _, deliver := queue.safelinkAcknowledged(safelinkEnablePacket); deliver || queue.safelink != safelinkEnabled || !queue.stats.Safelink {
+		t.Fatal("safelink not enabled by the echo")
+	}
+
+	// an older firmware never echoes it, and the link falls back to plain acknowledgements
+	queue.safelinkNegotiate()
+	for i := 0; i < safelinkAttempts; i++ {
+		if queue.safelink != safelinkNegotiating {
+			t.Fatalf("gave up after %d attempts, expecting %d", i, safelinkAttempts)
+		}
+		if _, deliver := queue.safelinkAcknowledged(nil); !deliver {
+			t.Fatal("acknowledgement not delivered while negotiating")
+		}
+	}
+	if queue.safelink != safelinkOff {
+		t.Fatal("safelink still negotiated after the attempts ran out")
+	}
+	packet, _, _, _ = queue.nextTransmission(time.Now())
+	if !bytes.Equal(packet, []byte{0x20, 1}) {
+		t.Fatalf("sent %x without safelink, expecting it unstamped", packet)
+	}
+}
+
+func TestSafelinkSequence(t *testing.T) {
+	manager := NewManager()
+	queue := manager.packetQueueGet(testChannel, testAddress)
+	queue.safelinkNegotiate()
+	queue.safelinkAcknowledged(safelinkEnablePacket)
+	manager.PacketSend(testChannel, testAddress, []byte{0x20, 1})
+	manager.PacketSend(testChannel, testAddress, []byte{0x20, 2})
+
+	// an unacknowledged packet is sent again as is, with the same sequence bits
+	packet, packets, element, _ := queue.nextTransmission(time.Now())
+	if !bytes.Equal(packet, []byte{0x20, 1}) {
+		t.Fatalf("sent %x, expecting 2001", packet)
+	}
+	queue.safelinkUnacknowledged(packet, packets, element)
+	retransmitted, packets, element, _ := queue.nextTransmission(time.Now())
+	if !bytes.Equal(retransmitted, packet) {
+		t.Fatalf("sent %x, expecting the retransmission of %x", retransmitted, packet)
+	}
+
+	queue.packetSent(packets, element)
+	if resp, deliver := queue.safelinkAcknowledged([]byte{0x20, 9}); !deliver || resp[1] != 9 {
+		t.Fatal("response not delivered")
+	}
+
+	// the acknowledgement and the response toggled the up and down bits
+	packet, packets, element, _ = queue.nextTransmission(time.Now())
+	if !bytes.Equal(packet, []byte{0x20 | safelinkUpBit | safelinkDownBit, 2}) {
+		t.Fatalf("sent %x, expecting 2c02", packet)
+	}
+	queue.packetSent(packets, element)
+
+	// a response carrying the previous down bit is a duplicate
+	if _, deliver := queue.safelinkAcknowledged([]byte{0x20, 9}); deliver {
+		t.Fatal("duplicate response delivered")
+	}
+	if queue.stats.Duplicates != 1 {
+		t.Fatalf("%d duplicates, expecting 1", queue.stats.Duplicates)
+	}
+	if resp, deliver := queue.safelinkAcknowledged([]byte{0x20 | safelinkDownBit, 10}); !deliver || resp[1] != 10 {
+		t.Fatal("response not delivered after the duplicate")
+	}
+}
@@ -0,0 +1,53 @@
+package crazyradio
+
+// ScanResult is a Crazyflie that acknowledged a packet during a scan
+type ScanResult struct {
+	Channel  uint8
+	Datarate RadioDatarate
+	Address  uint64
+}
+
+var scanPacket = []byte{0xFF} // an empty packet, as used to ping the crazyflies
+
+var scanDatarates = []RadioDatarate{RadioDatarate_250KPS, RadioDatarate_1MPS, RadioDatarate_2MPS}
+
+// Scan sweeps channels 0-125 at every datarate for each of the addresses and returns the combinations that acknowledged.
+// The scan borrows the first radio, so any crazyflies it is serving are paused until the scan completes.
+func (manager *Manager) Scan(addresses []uint64) ([]ScanResult, error) {
+	radio, err := manager.radioBorrow()
+	if err != nil {
+		return nil, err
+	}
+	radio.Lock()
+	defer radio.Unlock()
+	if radio.Retired() {
+		return nil, ErrorDeviceNotFound
+	}
+
+	results := make([]ScanResult, 0)
+
+	for _, datarate := range scanDatarates {
+		err = radio.SetDatarate(datarate)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, address := range addresses {
+			err = radio.SetAddress(address)
+			if err != nil {
+				return nil, err
+			}
+
+			channels, err := radio.ScanChannels(0, 125, scanPacket)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, channel := range channels {
+				results = append(results, ScanResult{channel, datarate, address})
+			}
+		}
+	}
+
+	return results, nil
+}
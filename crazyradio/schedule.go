@@ -0,0 +1,132 @@
+package crazyradio
+
+import (
+	"sort"
+	"sync"
+)
+
+// channelSchedule records which radio owns a channel. A radio serves the channels it owns in its own loop,
+// such that radios do not wait on each other and rarely need to change channel.
+type channelSchedule struct {
+	radio *RadioDevice
+	// held while a radio serves the channel, such that a channel handed to another radio is never served twice at once
+	serving *sync.Mutex
+}
+
+// scheduleRebalance assigns every channel with crazyflies to a radio. Channels keep their radio where possible,
+// those without one go to the least loaded radio, and channels are then moved from the most to the least loaded radio
+// for as long as this evens out the number of crazyflies served by each radio.
+// Called whenever crazyflies or radios come and go.
+func (manager *Manager) scheduleRebalance() {
+	manager.radiosLock.RLock()
+	defer manager.radiosLock.RUnlock()
+	manager.packetQueuesLock.Lock()
+	defer manager.packetQueuesLock.Unlock()
+
+	for channel := range manager.channelSchedules {
+		if _, ok := manager.packetQueues[channel]; !ok {
+			delete(manager.channelSchedules, channel)
+		}
+	}
+
+	// the load of a radio is the number of crazyflies on the channels it owns
+	load := make(map[*RadioDevice]int, len(manager.radios))
+	for _, radio := range manager.radios {
+		load[radio] = 0
+	}
+
+	// place the busiest channels first, such that the least loaded radio is a good fit for the remaining ones
+	channels := make([]uint8, 0, len(manager.packetQueues))
+	for channel := range manager.packetQueues {
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		ni, nj := len(manager.packetQueues[channels[i]]), len(manager.packetQueues[channels[j]])
+		return ni > nj || (ni == nj && channels[i] < channels[j])
+	})
+
+	for _, channel := range channels {
+		schedule, ok := manager.channelSchedules[channel]
+		if !ok {
+			schedule = &channelSchedule{serving: new(sync.Mutex)}
+			manager.channelSchedules[channel] = schedule
+		}
+
+		if _, inService := load[schedule.radio]; !inService {
+			schedule.radio = nil // the radio was retired, or the channel is new
+		}
+		if schedule.radio != nil {
+			load[schedule.radio] += len(manager.packetQueues[channel])
+		}
+	}
+
+	if len(manager.radios) == 0 {
+		return // the channels wait for a radio to be plugged in
+	}
+
+	for _, channel := range channels {
+		schedule := manager.channelSchedules[channel]
+		if schedule.radio == nil {
+			schedule.radio = manager.leastLoadedRadio(load)
+			load[schedule.radio] += len(manager.packetQueues[channel])
+		}
+	}
+
+	for {
+		most, least := manager.mostLoadedRadio(load), manager.leastLoadedRadio(load)
+
+		// moving a channel with fewer crazyflies than the difference in load narrows the difference
+		var move *channelSchedule
+		moveLoad := 0
+		for _, channel := range channels {
+			schedule := manager.channelSchedules[channel]
+			n := len(manager.packetQueues[channel])
+			if schedule.radio == most && n < load[most]-load[least] && n > moveLoad {
+				move, moveLoad = schedule, n
+			}
+		}
+		if move == nil {
+			return
+		}
+
+		move.radio = least
+		load[most] -= moveLoad
+		load[least] += moveLoad
+	}
+}
+
+// the radios are ranked by load, then by their order in radios, such that the assignment is deterministic
+func (manager *Manager) leastLoadedRadio(load map[*RadioDevice]int) *RadioDevice {
+	var best *RadioDevice
+	for _, radio := range manager.radios {
+		if best == nil || load[radio] < load[best] {
+			best = radio
+		}
+	}
+	return best
+}
+
+func (manager *Manager) mostLoadedRadio(load map[*RadioDevice]int) *RadioDevice {
+	var best *RadioDevice
+	for _, radio := range manager.radios {
+		if best == nil || load[radio] > load[best] {
+			best = radio
+		}
+	}
+	return best
+}
+
+// scheduleChannels returns the channels owned by a radio
+func (manager *Manager) scheduleChannels(radio *RadioDevice) []uint8 {
+	manager.packetQueuesLock.RLock()
+	defer manager.packetQueuesLock.RUnlock()
+
+	channels := make([]uint8, 0)
+	for channel, schedule := range manager.channelSchedules {
+		if schedule.radio == radio {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i] < channels[j] })
+	return channels
+}
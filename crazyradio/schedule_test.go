@@ -0,0 +1,61 @@
+package crazyradio
+
+import (
+	"sync"
+	"testing"
+)
+
+// scheduleLoad returns the number of crazyflies served by each radio
+func scheduleLoad(manager *Manager) map[*RadioDevice]int {
+	load := make(map[*RadioDevice]int)
+	for channel, schedule := range manager.channelSchedules {
+		load[schedule.radio] += len(manager.packetQueues[channel])
+	}
+	return load
+}
+
+func TestScheduleRebalance(t *testing.T) {
+	manager := NewManager()
+	first := &RadioDevice{lock: new(sync.Mutex)}
+	second := &RadioDevice{lock: new(sync.Mutex)}
+
+	// channels 0, 10, 20 and 30 with 1, 2, 3 and 4 crazyflies, all on the only radio
+	manager.radios = []*RadioDevice{first}
+	for channel := uint8(0); channel < 40; channel += 10 {
+		for address := uint64(0); address <= uint64(channel/10); address++ {
+			manager.packetQueueGet(channel, address)
+		}
+	}
+	if load := scheduleLoad(manager); load[first] != 10 {
+		t.Fatalf("the radio serves %d crazyflies, expecting 10", load[first])
+	}
+
+	// a second radio takes over channels such that both serve 5 crazyflies
+	manager.radios = append(manager.radios, second)
+	manager.scheduleRebalance()
+	if load := scheduleLoad(manager); load[first] != 5 || load[second] != 5 {
+		t.Fatalf("the radios serve %d and %d crazyflies, expecting 5 each", load[first], load[second])
+	}
+
+	// a channel is no longer scheduled once its last crazyflie leaves
+	manager.packetQueueRemove(0, 0)
+	if _, ok := manager.channelSchedules[0]; ok {
+		t.Fatal("the channel without crazyflies is still scheduled")
+	}
+
+	// the channels of a retired radio are handed over
+	manager.radios = manager.radios[1:]
+	manager.scheduleRebalance()
+	if channels := manager.scheduleChannels(second); len(channels) != 3 {
+		t.Fatalf("the remaining radio owns channels %v, expecting all 3", channels)
+	}
+
+	// without radios, the channels wait for one
+	manager.radios = nil
+	manager.scheduleRebalance()
+	for channel, schedule := range manager.channelSchedules {
+		if schedule.radio != nil {
+			t.Fatalf("channel %d scheduled on a radio which was retired", channel)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package crazyradio
+
+// the weight of the newest packet in the rolling link quality, roughly a window of the last 50 packets
+const linkQualityWeight = 0.02
+
+// LinkStats are the link quality statistics of a Crazyflie, gathered from the acknowledgements of its packets
+type LinkStats struct {
+	Sent               uint64     `json:"sent"`               // packets transmitted
+	Acked              uint64     `json:"acked"`              // packets acknowledged
+	Lost               uint64     `json:"lost"`               // packets which failed to transmit, or were not acknowledged after all retries
+	Expired            uint64     `json:"expired"`            // packets dropped because their deadline passed before they could be sent
+	Superseded         uint64     `json:"superseded"`         // packets replaced in their coalescing slot by a newer packet before they could be sent
+	Dropped            uint64     `json:"dropped"`            // packets dropped because the standard queue was full
+	Safelink           bool       `json:"safelink"`           // whether delivery is exactly-once, see safelink.go
+	Duplicates         uint64     `json:"duplicates"`         // responses dropped on a safelink because they had already been received
+	Retries            [16]uint64 `json:"retries"`            // histogram of the retransmission count of acknowledged packets
+	PowerDetector      uint64     `json:"powerDetector"`      // acknowledgements received with the power detector set
+	PowerDetectorRatio float64    `json:"powerDetectorRatio"` // the fraction of acknowledgements received with the power detector set
+	Quality            float64    `json:"quality"`            // rolling link quality in percent
+	Queued             int        `json:"queued"`             // packets waiting in the standard queue (in a snapshot, see LinkStatsGet)
+	PriorityQueued     int        `json:"priorityQueued"`     // packets waiting in the priority queue (in a snapshot, see LinkStatsGet)
+	Undelivered        uint64     `json:"undelivered"`        // responses dropped by a radio-share server because the remote link did not keep up
+}
+
+// Update records the outcome of a transmission in the statistics, err being the error of the USB transfer (if any)
+func (stats *LinkStats) Update(ack Ack, err error) {
+	stats.Sent++
+
+	quality := 0.0
+	if err != nil || !ack.Received {
+		stats.Lost++
+	} else {
+		stats.Acked++
+		stats.Retries[ack.Retries&0x0F]++
+		if ack.PowerDetector {
+			stats.PowerDetector++
+		}
+		stats.PowerDetectorRatio = float64(stats.PowerDetector) / float64(stats.Acked)
+
+		// every retransmission costs airtime, so a packet which needed retries contributes less than a perfect one
+		quality = 100.0 / float64(1+ack.Retries)
+	}
+
+	if stats.Sent == 1 {
+		stats.Quality = quality
+	} else {
+		stats.Quality += linkQualityWeight * (quality - stats.Quality)
+	}
+}
+
+// LinkStatsGet returns a snapshot of the link statistics of the crazyflie at channel and address
+func (manager *Manager) LinkStatsGet(channel uint8, address uint64) LinkStats {
+	queue, ok := manager.packetQueueLookup(channel, address)
+	if !ok {
+		return LinkStats{}
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	stats := queue.stats
+	stats.Queued = queue.standardQueue.Len()
+	stats.PriorityQueued = queue.priorityQueue.Len()
+	return stats
+}
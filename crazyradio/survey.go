@@ -0,0 +1,87 @@
+package crazyradio
+
+import "sort"
+
+// ChannelSurvey is the interference measured on a channel. The power detector reports energy on the channel
+// during a transmission (another transmitter, wifi, ...), and retransmissions show packets which did not get through.
+// Without a crazyflie listening on the surveyed address no packet is acknowledged, only the power detector is meaningful.
+type ChannelSurvey struct {
+	Channel            uint8         `json:"channel"`
+	Datarate           RadioDatarate `json:"datarate"`
+	Sent               int           `json:"sent"`
+	Acked              int           `json:"acked"`
+	PowerDetector      int           `json:"powerDetector"`      // packets during which the power detector was set
+	PowerDetectorRatio float64       `json:"powerDetectorRatio"` // the fraction of packets during which the power detector was set
+	MeanRetries        float64       `json:"meanRetries"`        // mean retransmissions of the acknowledged packets
+}
+
+var surveyPacket = []byte{0xFF} // an empty packet, as used to ping the crazyflies
+
+// Survey sends packetsPerChannel test packets on each channel (0-125) to address at datarate, and returns the channels
+// ranked from the quietest to the noisiest: by power detector ratio, then by mean retransmissions.
+// The survey borrows the first radio, so any crazyflies it is serving are paused until the survey completes.
+func (manager *Manager) Survey(datarate RadioDatarate, address uint64, packetsPerChannel int) ([]ChannelSurvey, error) {
+	radio, err := manager.radioBorrow()
+	if err != nil {
+		return nil, err
+	}
+	radio.Lock()
+	defer radio.Unlock()
+	if radio.Retired() {
+		return nil, ErrorDeviceNotFound
+	}
+
+	if err = radio.SetDatarate(datarate); err != nil {
+		return nil, err
+	}
+	if err = radio.SetAddress(address); err != nil {
+		return nil, err
+	}
+
+	results := make([]ChannelSurvey, 0, 126)
+
+	for channel := uint8(0); channel <= 125; channel++ {
+		if err = radio.SetChannel(channel); err != nil {
+			return nil, err
+		}
+
+		result := ChannelSurvey{Channel: channel, Datarate: datarate}
+		retries := 0
+
+		for i := 0; i < packetsPerChannel; i++ {
+			if err = radio.SendPacket(surveyPacket); err != nil {
+				return nil, err
+			}
+			ack, err := radio.ReadAck()
+			if err != nil {
+				return nil, err
+			}
+
+			result.Sent++
+			if ack.PowerDetector {
+				result.PowerDetector++
+			}
+			if ack.Received {
+				result.Acked++
+				retries += int(ack.Retries)
+			}
+		}
+
+		if result.Sent > 0 {
+			result.PowerDetectorRatio = float64(result.PowerDetector) / float64(result.Sent)
+		}
+		if result.Acked > 0 {
+			result.MeanRetries = float64(retries) / float64(result.Acked)
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].PowerDetectorRatio != results[j].PowerDetectorRatio {
+			return results[i].PowerDetectorRatio < results[j].PowerDetectorRatio
+		}
+		return results[i].MeanRetries < results[j].MeanRetries
+	})
+
+	return results, nil
+}
@@ -0,0 +1,144 @@
+package crazyradio
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kylelemons/gousb/usb"
+)
+
+// the vendor request switching a Crazyflie 2 between CRTP over USB and its USB serial console
+const usbCrazyflieEnableCRTP = 0x01
+
+// UsbCrazyflie is a Crazyflie 2 connected with a USB cable. It speaks CRTP directly: packets are written and read
+// on the bulk endpoints, without the acknowledgements and polling of the radio.
+type UsbCrazyflie struct {
+	context *usb.Context
+	device  *usb.Device
+	lock    *sync.Mutex
+	dataOut usbEndpoint
+	dataIn  usbEndpoint
+}
+
+// usbEndpoint is the part of a usb.Endpoint used to exchange the packets
+type usbEndpoint interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+}
+
+func isUsbCrazyflie(desc *usb.Descriptor) bool {
+	return desc.Vendor == 0x0483 && desc.Product == 0x5740
+}
+
+// OpenUsbCrazyflie opens the index-th Crazyflie connected over USB (in usb bus and address order) and enables CRTP over USB
+func OpenUsbCrazyflie(index int) (*UsbCrazyflie, error) {
+	context := usb.NewContext()
+	context.Debug(0)
+
+	// list the crazyflies without opening them, to open only the index-th
+	type usbID struct{ bus, address uint8 }
+	ids := make([]usbID, 0)
+	context.ListDevices(func(desc *usb.Descriptor) bool {
+		if isUsbCrazyflie(desc) {
+			ids = append(ids, usbID{desc.Bus, desc.Address})
+		}
+		return false
+	})
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].bus < ids[j].bus || (ids[i].bus == ids[j].bus && ids[i].address < ids[j].address)
+	})
+
+	if index < 0 || index >= len(ids) {
+		context.Close()
+		return nil, ErrorDeviceNotFound
+	}
+
+	devices, _ := context.ListDevices(func(desc *usb.Descriptor) bool {
+		return isUsbCrazyflie(desc) && desc.Bus == ids[index].bus && desc.Address == ids[index].address
+	})
+	if len(devices) != 1 {
+		for _, dev := range devices {
+			dev.Close()
+		}
+		context.Close()
+		return nil, ErrorDeviceNotFound
+	}
+	dev := devices[0]
+
+	dOut, err := dev.OpenEndpoint(1, 0, 0, 0x01)
+	if err != nil {
+		dev.Close()
+		context.Close()
+		return nil, err
+	}
+
+	dIn, err := dev.OpenEndpoint(1, 0, 0, 0x81)
+	if err != nil {
+		dev.Close()
+		context.Close()
+		return nil, err
+	}
+
+	dev.ControlTimeout = 250 * time.Millisecond
+	dev.ReadTimeout = 50 * time.Millisecond
+	dev.WriteTimeout = 50 * time.Millisecond
+
+	_, err = dev.Control(usb.REQUEST_TYPE_VENDOR, usbCrazyflieEnableCRTP, 1, 1, nil)
+	if err != nil {
+		dev.Close()
+		context.Close()
+		return nil, err
+	}
+
+	return &UsbCrazyflie{context, dev, new(sync.Mutex), dOut, dIn}, nil
+}
+
+// Close returns the Crazyflie to its USB serial console and closes the device
+func (cf *UsbCrazyflie) Close() {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	cf.device.Control(usb.REQUEST_TYPE_VENDOR, usbCrazyflieEnableCRTP, 0, 1, nil)
+	cf.device.Close()
+	cf.context.Close()
+}
+
+func (cf *UsbCrazyflie) SendPacket(data []byte) error {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	length, err := cf.dataOut.Write(data)
+	if err != nil {
+		return err
+	}
+	if length != len(data) {
+		return ErrorWriteLength
+	}
+	return nil
+}
+
+// ReadPacket reads the next packet sent by the Crazyflie. It returns an empty packet, and no error,
+// if the Crazyflie had nothing to send within the read timeout.
+func (cf *UsbCrazyflie) ReadPacket() ([]byte, error) {
+	buffer := make([]byte, 64)
+	length, err := cf.dataIn.Read(buffer)
+	if usbTimeout(err) {
+		return []byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:length], nil
+}
+
+// usbTimeout returns whether err is a transfer which timed out: the bulk transfers fail with the status of
+// the transfer, rather than with a libusb error code as the control transfers do
+func usbTimeout(err error) bool {
+	switch err := err.(type) {
+	case usb.TransferStatus:
+		return err == usb.LIBUSB_TRANSFER_TIMED_OUT
+	default:
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+package crazyradio
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/gousb/usb"
+)
+
+// fakeEndpoint reads the packets, or the errors, queued by the test
+type fakeEndpoint struct {
+	reads []interface{}
+}
+
+func (ep *fakeEndpoint) Read(b []byte) (int, error) {
+	read := ep.reads[0]
+	ep.reads = ep.reads[1:]
+	if err, ok := read.(error); ok {
+		return 0, err
+	}
+	return copy(b, read.([]byte)), nil
+}
+
+func (ep *fakeEndpoint) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestUsbCrazyflieReadPacket(t *testing.T) {
+	dataIn := &fakeEndpoint{[]interface{}{
+		[]byte{0x30, 1, 2},
+		usb.LIBUSB_TRANSFER_TIMED_OUT,
+		usb.LIBUSB_TRANSFER_NO_DEVICE,
+	}}
+	cf := &UsbCrazyflie{lock: new(sync.Mutex), dataOut: new(fakeEndpoint), dataIn: dataIn}
+
+	packet, err := cf.ReadPacket()
+	if err != nil || len(packet) != 3 || packet[0] != 0x30 {
+		t.Fatalf("read %v, %v", packet, err)
+	}
+
+	// nothing to send within the read timeout
+	packet, err = cf.ReadPacket()
+	if err != nil || packet == nil || len(packet) != 0 {
+		t.Fatalf("read %v, %v after a timeout, expecting an empty packet", packet, err)
+	}
+
+	if _, err = cf.ReadPacket(); err != usb.LIBUSB_TRANSFER_NO_DEVICE {
+		t.Fatalf("read error %v, expecting the transfer status", err)
+	}
+}
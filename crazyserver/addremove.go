@@ -1,6 +1,7 @@
 package crazyserver
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/mikehamer/crazyserver/crazyflie"
+	"github.com/mikehamer/crazyserver/crazyradio"
 )
 
 func addremoveInitRoute(r *mux.Router) {
@@ -17,6 +19,7 @@ func addremoveInitRoute(r *mux.Router) {
 }
 
 type fleetAddRequest struct {
+	URI     *string `json:"uri"`
 	Address *string `json:"address"`
 	Channel *uint8  `json:"channel"`
 }
@@ -28,26 +31,32 @@ type fleetAddResponse struct {
 func fleetAddHandler(w http.ResponseWriter, r *http.Request) {
 	var req fleetAddRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.Address == nil {
+	if err != nil || (req.URI == nil && (req.Address == nil || req.Channel == nil)) {
 		respondError(w, r, http.StatusBadRequest, "Bad request!")
 		return
 	}
 
-	channel := *req.Channel
-	address := uint64(0)
-	if req.Address != nil {
+	// the crazyflie is either given by its link URI, or by its address and channel (at the default datarate)
+	var uri string
+	if req.URI != nil {
+		uri = *req.URI
+	} else {
+		address := uint64(0)
 		fmt.Sscanf(*req.Address, "%x", &address)
 		if address == 0 || len(*req.Address) != 10 {
 			respondError(w, r, http.StatusBadRequest, "Bad request! Address invalid")
 			return
 		}
-	} else {
-		address = 0xe7e7e7e7e7
+		uri = crazyflie.LinkURI{Scheme: "radio", Channel: *req.Channel, Datarate: crazyradio.RadioDatarate_2MPS, Address: address}.String()
 	}
 
-	crazyfliesLock.Lock()
-	cfid, err := AddCrazyflie(address, channel)
-	crazyfliesLock.Unlock()
+	if _, err := crazyflie.ParseURI(uri); err != nil {
+		respondError(w, r, http.StatusBadRequest, "Bad request! URI invalid")
+		return
+	}
+
+	// the connection is abandoned if the client goes away
+	cfid, err := AddCrazyflie(r.Context(), uri)
 
 	if err != nil {
 		str := fmt.Sprintf("Cannot connect to Crazyflie: %q", err)
@@ -98,9 +107,10 @@ func Stop() {
 	}
 }
 
-// AddCrazyflie connects to a Crazyfle at address and channel and add it to the crazyflie list.
-// Returns the index of the connected Crazyflie.
-func AddCrazyflie(address uint64, channel uint8) (int, error) {
+// AddCrazyflie connects to a Crazyfle at the link URI and add it to the crazyflie list.
+// Returns the index of the connected Crazyflie, or an error if ctx is done before it is connected.
+// Several Crazyflies can be added at the same time.
+func AddCrazyflie(ctx context.Context, uri string) (int, error) {
 	if !isStarted {
 		err := Start()
 		if err != nil {
@@ -109,17 +119,48 @@ func AddCrazyflie(address uint64, channel uint8) (int, error) {
 	}
 
 	// connect to the crazyflie
-	cf, err := crazyflie.Connect(address, channel)
+	cf, err := crazyflie.Connect(ctx, uri)
 	if err != nil {
 		log.Printf("Error adding crazyflie: %s", err)
 		return -1, err
 	}
 
-	cf.ParamTOCGetList()
+	return addConnectedCrazyflie(ctx, cf)
+}
+
+// AddCrazyflieLink connects to a Crazyfle at address, channel and datarate over link and add it to the crazyflie list.
+// Returns the index of the connected Crazyflie, or an error if ctx is done before it is connected.
+func AddCrazyflieLink(ctx context.Context, link crazyflie.Link, address uint64, channel uint8, datarate crazyradio.RadioDatarate) (int, error) {
+	if !isStarted {
+		err := Start()
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	// connect to the crazyflie
+	cf, err := crazyflie.ConnectLink(ctx, link, address, channel, datarate)
+	if err != nil {
+		log.Printf("Error adding crazyflie: %s", err)
+		return -1, err
+	}
+
+	return addConnectedCrazyflie(ctx, cf)
+}
+
+// addConnectedCrazyflie downloads the TOCs of cf and adds it to the list. Only the list is locked,
+// so that several Crazyflies can be connected at the same time.
+func addConnectedCrazyflie(ctx context.Context, cf *crazyflie.Crazyflie) (int, error) {
+	if err := cf.TOCGetLists(ctx); err != nil && ctx.Err() != nil {
+		cf.DisconnectImmediately()
+		return -1, err
+	}
 	// do other management stuff
 	//...
 
 	// Add to the list and return the index
+	crazyfliesLock.Lock()
+	defer crazyfliesLock.Unlock()
 	crazyflies[crazyfliesMaxIndex] = cf
 	crazyfliesMaxIndex += 1
 	return crazyfliesMaxIndex - 1, nil
@@ -0,0 +1,96 @@
+package crazyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikehamer/crazyserver/crazyflie"
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+func broadcastInitRoute(r *mux.Router) {
+	r.HandleFunc("/fleet/broadcast", fleetBroadcastHandler).Methods("POST")
+}
+
+type broadcastPosition struct {
+	ID uint8   `json:"id"`
+	X  float32 `json:"x"`
+	Y  float32 `json:"y"`
+	Z  float32 `json:"z"`
+}
+
+type fleetBroadcastRequest struct {
+	Channel    uint8               `json:"channel"`
+	Datarate   string              `json:"datarate"`
+	Command    string              `json:"command"`
+	GroupMask  uint8               `json:"groupMask"`
+	Height     float32             `json:"height"`
+	Duration   float32             `json:"duration"`
+	Trajectory uint8               `json:"trajectory"`
+	Timescale  float32             `json:"timescale"`
+	Relative   bool                `json:"relative"`
+	Reversed   bool                `json:"reversed"`
+	Positions  []broadcastPosition `json:"positions"`
+}
+
+// fleetBroadcastHandler sends a command to every Crazyflie listening on a channel at once, without acknowledgement.
+func fleetBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	var req fleetBroadcastRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, "Bad request!")
+		return
+	}
+
+	datarate := crazyradio.RadioDatarate_2MPS
+	if req.Datarate != "" {
+		datarate, err = crazyradio.ParseDatarate(req.Datarate)
+		if err != nil {
+			respondError(w, r, http.StatusBadRequest, fmt.Sprint(err))
+			return
+		}
+	}
+
+	broadcaster := crazyflie.NewBroadcaster(req.Channel, datarate)
+	duration := time.Duration(req.Duration * float32(time.Second))
+
+	switch req.Command {
+	case "emergencyStop":
+		err = broadcaster.EmergencyStop()
+	case "takeoff":
+		err = broadcaster.Takeoff(req.GroupMask, req.Height, duration)
+	case "land":
+		err = broadcaster.Land(req.GroupMask, req.Height, duration)
+	case "stop":
+		err = broadcaster.Stop(req.GroupMask)
+	case "startTrajectory":
+		timescale := req.Timescale
+		if timescale == 0 {
+			timescale = 1
+		}
+		err = broadcaster.StartTrajectory(req.GroupMask, req.Trajectory, timescale, req.Relative, req.Reversed)
+	case "positions":
+		positions := make([]crazyflie.PackedPosition, len(req.Positions))
+		for i, p := range req.Positions {
+			positions[i] = crazyflie.PackedPosition{ID: p.ID, X: p.X, Y: p.Y, Z: p.Z}
+		}
+		err = broadcaster.ExternalPositionsSend(positions)
+	default:
+		respondError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown command %q", req.Command))
+		return
+	}
+
+	if err != nil {
+		respondError(w, r, http.StatusServiceUnavailable, fmt.Sprint(err))
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "{}")
+}
@@ -1,6 +1,7 @@
 package crazyserver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -8,6 +9,8 @@ import (
 	"net/http"
 
 	"github.com/mikehamer/crazyserver/crazyflie"
+	"github.com/mikehamer/crazyserver/crazyradio"
+	"github.com/mikehamer/crazyserver/crazysim"
 
 	"github.com/gorilla/mux"
 	"github.com/urfave/cli"
@@ -28,13 +31,39 @@ var ServeCommand cli.Command = cli.Command{
 			Value: "",
 			Usage: "Optional static folder. Served on /static with index.html accessible on /",
 		},
+		cli.UintFlag{
+			Name:  "sim",
+			Value: 0,
+			Usage: "Connect this number of simulated Crazyflies (no Crazyradio needed)",
+		},
 	},
 }
 
 func serveCommandHandler(ctx *cli.Context) error {
 	port := ctx.Uint("port")
-	staticPath := ctx.String("static")
+	r := newRouter(ctx.String("static"))
+
+	// Export the router in a module variable to allow sockets to use it
+	rootSocketRouter = r
+
+	if simCount := ctx.Uint("sim"); simCount > 0 {
+		err := addSimulatedCrazyflies(simCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	go linkStatsThread()
+	crazyradio.RadioEventsRegister(radioEventSend)
+
+	fmt.Println("Starting the server ...")
+	fmt.Printf("Listening on 127.0.0.1:%d\n", port)
+	http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", port), r)
+	return nil
+}
 
+// newRouter returns the router of the API, and of the static folder at staticPath if it is not empty
+func newRouter(staticPath string) *mux.Router {
 	r := mux.NewRouter()
 
 	rv1 := r.PathPrefix("/v1").Subrouter()                           // API base router
@@ -43,9 +72,14 @@ func serveCommandHandler(ctx *cli.Context) error {
 	// Initialize routes
 	rv1.HandleFunc("/fleet", fleetIndexHandler).Methods("GET")
 	addremoveInitRoute(rv1)
+	scanInitRoute(rv1)
+	broadcastInitRoute(rv1)
+	radiosInitRoute(rv1)
 	socketsInitRoute(rv1)
 	paramInitRoute(rcf)
 	commanderInitRoute(rcf)
+	linkInitRoute(rcf)
+	metricsInitRoute(r)
 
 	// Optional static file server (for making standalone client)
 	if len(staticPath) > 0 {
@@ -54,12 +88,30 @@ func serveCommandHandler(ctx *cli.Context) error {
 		r.Handle("/favicon.ico", http.FileServer(http.Dir(staticPath)))
 	}
 
-	// Export the router in a module variable to allow sockets to use it
-	rootSocketRouter = r
+	return r
+}
+
+// addSimulatedCrazyflies powers on count simulated Crazyflies on channel 80 and adds them to the fleet.
+func addSimulatedCrazyflies(count uint) error {
+	simLink := crazysim.NewLink()
+
+	for i := uint(0); i < count; i++ {
+		address := uint64(0xE7E7E7E700) + uint64(i)
+		channel := uint8(80)
+
+		_, err := simLink.CrazyflieAdd(channel, crazyradio.RadioDatarate_2MPS, address)
+		if err != nil {
+			return err
+		}
+
+		cfid, err := AddCrazyflieLink(context.Background(), simLink, address, channel, crazyradio.RadioDatarate_2MPS)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Simulated Crazyflie 0x%X connected as crazyflie%d\n", address, cfid)
+	}
 
-	fmt.Println("Starting the server ...")
-	fmt.Printf("Listening on 127.0.0.1:%d\n", port)
-	http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", port), r)
 	return nil
 }
 
@@ -96,6 +148,7 @@ func fleetIndexHandler(w http.ResponseWriter, r *http.Request) {
 	i := 0
 	for cfid, _ := range crazyflies {
 		response.Connected[i] = fmt.Sprintf("crazyflie%d", cfid)
+		i++
 	}
 	crazyfliesLock.Unlock()
 
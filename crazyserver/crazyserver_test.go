@@ -0,0 +1,165 @@
+package crazyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mikehamer/crazyserver/cache"
+)
+
+// the TOC caches are written to a temporary home, rather than to the one of the user running the tests
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "crazyserver-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	if err := cache.Init(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// simAdd adds count simulated crazyflies to the fleet for the duration of the test, and returns their ids
+func simAdd(t *testing.T, count uint) []int {
+	crazyfliesLock.Lock()
+	first := crazyfliesMaxIndex
+	crazyfliesLock.Unlock()
+
+	if err := addSimulatedCrazyflies(count); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]int, count)
+	for i := range ids {
+		ids[i] = first + i
+	}
+	t.Cleanup(func() {
+		crazyfliesLock.Lock()
+		defer crazyfliesLock.Unlock()
+		for _, cfid := range ids {
+			RemoveCrazyflie(cfid) // unless the test removed it
+		}
+	})
+	return ids
+}
+
+// request serves a request with router, and decodes the JSON response into response if it is not nil
+func request(t *testing.T, router *mux.Router, method string, path string, body string, response interface{}) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if response != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(response); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestFleet(t *testing.T) {
+	router := newRouter("")
+	ids := simAdd(t, 2)
+
+	var fleet fleetIndexResponse
+	if code := request(t, router, "GET", "/v1/fleet", "", &fleet); code != http.StatusOK {
+		t.Fatalf("fleet answered %d", code)
+	}
+	sort.Strings(fleet.Connected)
+	if len(fleet.Connected) != 2 || fleet.Connected[0] != fmt.Sprintf("crazyflie%d", ids[0]) || fleet.Connected[1] != fmt.Sprintf("crazyflie%d", ids[1]) {
+		t.Fatalf("fleet %v, expecting crazyflie%d and crazyflie%d", fleet.Connected, ids[0], ids[1])
+	}
+
+	path := fmt.Sprintf("/v1/fleet/crazyflie%d", ids[0])
+	if code := request(t, router, "DELETE", path, "", nil); code != http.StatusOK {
+		t.Fatalf("remove answered %d", code)
+	}
+	if code := request(t, router, "DELETE", path, "", nil); code != http.StatusNotFound {
+		t.Fatalf("remove of a removed crazyflie answered %d", code)
+	}
+	if code := request(t, router, "GET", "/v1/fleet", "", &fleet); code != http.StatusOK || len(fleet.Connected) != 1 {
+		t.Fatalf("fleet %v (%d) after the removal", fleet.Connected, code)
+	}
+}
+
+func TestFleetAddBadRequest(t *testing.T) {
+	router := newRouter("")
+	for _, body := range []string{
+		`{`,
+		`{"channel": 80}`,
+		`{"address": "E7E7", "channel": 80}`,
+		`{"uri": "radio://0/200"}`,
+	} {
+		if code := request(t, router, "POST", "/v1/fleet", body, nil); code != http.StatusBadRequest {
+			t.Fatalf("add %s answered %d", body, code)
+		}
+	}
+}
+
+func TestParamAccess(t *testing.T) {
+	router := newRouter("")
+	ids := simAdd(t, 1)
+	path := fmt.Sprintf("/v1/fleet/crazyflie%d/param", ids[0])
+
+	var toc paramTocIndexResponse
+	if code := request(t, router, "GET", path+"/toc", "", &toc); code != http.StatusOK {
+		t.Fatalf("toc answered %d", code)
+	}
+	found := false
+	for _, item := range toc.Toc {
+		found = found || (item.Group == "pid_rate" && item.Name == "roll_kp")
+	}
+	if !found {
+		t.Fatal("pid_rate.roll_kp not in the TOC")
+	}
+
+	var param paramAccessFormat
+	if code := request(t, router, "PUT", path+"/params/pid_rate/roll_kp", `{"value": 3}`, &param); code != http.StatusOK || param.Value != 3 {
+		t.Fatalf("write answered %v (%d), expecting 3", param.Value, code)
+	}
+	if code := request(t, router, "GET", path+"/params/pid_rate/roll_kp", "", &param); code != http.StatusOK || param.Value != 3 {
+		t.Fatalf("read answered %v (%d), expecting 3", param.Value, code)
+	}
+
+	if code := request(t, router, "GET", path+"/params/no/such", "", nil); code != http.StatusNotFound {
+		t.Fatalf("read of an unknown parameter answered %d", code)
+	}
+	if code := request(t, router, "PUT", path+"/params/no/such", `{"value": 3}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("write of an unknown parameter answered %d", code)
+	}
+	if code := request(t, router, "GET", "/v1/fleet/crazyflie999/param/toc", "", nil); code != http.StatusNotFound {
+		t.Fatalf("toc of an unknown crazyflie answered %d", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	router := newRouter("")
+	ids := simAdd(t, 1)
+
+	if code := request(t, router, "GET", fmt.Sprintf("/v1/fleet/crazyflie%d/link", ids[0]), "", nil); code != http.StatusOK {
+		t.Fatalf("link answered %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, expected := range []string{
+		fmt.Sprintf(`crazyflie_connected{crazyflie="%d"} 1`, ids[0]),
+		fmt.Sprintf(`crazyflie_transactions_total{crazyflie="%d",request="param/0"}`, ids[0]),
+		`method="GET",route="/v1/fleet/crazyflie{id:[0-9]+}/link"`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("metrics without %s:\n%s", expected, metrics)
+		}
+	}
+}
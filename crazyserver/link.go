@@ -0,0 +1,97 @@
+package crazyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikehamer/crazyserver/crazyflie"
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// how often the link statistics are pushed to the sockets
+const linkStatsPeriod = 1 * time.Second
+
+func linkInitRoute(r *mux.Router) {
+	r.HandleFunc("/link", crazyflieHandleFunc(linkStatsGet)).Methods("GET")
+	r.HandleFunc("/link", crazyflieHandleFunc(linkSet)).Methods("PUT")
+}
+
+type linkSetRequest struct {
+	Budget *float64 `json:"budget"` // packets per second, 0 for no limit
+	Depth  *int     `json:"depth"`  // queued packets, 0 for no limit
+}
+
+func linkSet(w http.ResponseWriter, r *http.Request, cf *crazyflie.Crazyflie) {
+	var req linkSetRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || (req.Budget == nil && req.Depth == nil) || (req.Budget != nil && *req.Budget < 0) || (req.Depth != nil && *req.Depth < 0) {
+		respondError(w, r, http.StatusBadRequest, "Bad request!")
+		return
+	}
+
+	if req.Budget != nil {
+		err = cf.SetBandwidthBudget(*req.Budget)
+		if err != nil {
+			respondError(w, r, http.StatusBadRequest, fmt.Sprint(err))
+			return
+		}
+	}
+
+	if req.Depth != nil {
+		err = cf.SetQueueDepth(*req.Depth)
+		if err != nil {
+			respondError(w, r, http.StatusBadRequest, fmt.Sprint(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "{}")
+}
+
+func linkStatsGet(w http.ResponseWriter, r *http.Request, cf *crazyflie.Crazyflie) {
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(cf.LinkStats())
+}
+
+// linkStatsThread periodically sends the link statistics of every Crazyflie to the sockets
+func linkStatsThread() {
+	for range time.Tick(linkStatsPeriod) {
+		crazyfliesLock.Lock()
+		stats := make(map[int]crazyradio.LinkStats, len(crazyflies))
+		for cfid, cf := range crazyflies {
+			stats[cfid] = cf.LinkStats()
+		}
+		crazyfliesLock.Unlock()
+
+		for cfid, s := range stats {
+			socketSendData(fmt.Sprintf("/v1/fleet/crazyflie%d/link", cfid), s)
+		}
+	}
+}
+
+type radioEventMessage struct {
+	Event   string `json:"event"`
+	Dongle  int    `json:"dongle"`
+	Bus     uint8  `json:"bus"`
+	Address uint8  `json:"address"`
+	Radios  int    `json:"radios"`
+	Error   string `json:"error,omitempty"`
+}
+
+// radioEventSend forwards Crazyradios being plugged in, unplugged or failing to the sockets
+func radioEventSend(event crazyradio.RadioEvent) {
+	msg := radioEventMessage{Event: event.Type.String(), Dongle: event.Dongle, Bus: event.Bus, Address: event.Address, Radios: event.Radios}
+	if event.Err != nil {
+		msg.Error = event.Err.Error()
+	}
+	socketSendData("/v1/radios", msg)
+}
@@ -0,0 +1,256 @@
+package crazyserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/mikehamer/crazyserver/crazyflie"
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// the upper bounds (in seconds) of the buckets of the HTTP request latency histogram
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type latencyKey struct {
+	method string
+	route  string
+}
+
+type latencyHistogram struct {
+	buckets []uint64 // cumulative, one per latency bucket
+	count   uint64
+	sum     float64
+}
+
+var latenciesLock sync.Mutex
+var latencies = map[latencyKey]*latencyHistogram{}
+
+func metricsInitRoute(r *mux.Router) {
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	r.Use(latencyMiddleware)
+}
+
+// latencyMiddleware records the latency of the requests, by method and route template (eg. /v1/fleet/crazyflie{id:[0-9]+}/link)
+func latencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r) // a websocket is served for as long as the client stays, which is no latency
+			return
+		}
+
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		latency := time.Since(start).Seconds()
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		latenciesLock.Lock()
+		defer latenciesLock.Unlock()
+
+		key := latencyKey{r.Method, route}
+		histogram, ok := latencies[key]
+		if !ok {
+			histogram = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+			latencies[key] = histogram
+		}
+		for i, bound := range latencyBuckets {
+			if latency <= bound {
+				histogram.buckets[i]++
+			}
+		}
+		histogram.count++
+		histogram.sum += latency
+	})
+}
+
+// metricsHandler exposes the metrics of the dongles, the Crazyflies and the API in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "text/plain; version=0.0.4; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	radioMetrics(w)
+	crazyflieMetrics(w)
+	apiMetrics(w)
+}
+
+func metricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func radioMetrics(w io.Writer) {
+	radios := crazyradio.Radios()
+
+	metricHeader(w, "crazyradio_packets_total", "counter", "Packets transmitted by the Crazyradio.")
+	for _, radio := range radios {
+		fmt.Fprintf(w, "crazyradio_packets_total{radio=\"%d\",serial=%q} %d\n", radio.Index, radio.Serial, radio.Stats.Sent)
+	}
+
+	metricHeader(w, "crazyradio_lost_packets_total", "counter", "Packets transmitted by the Crazyradio which were not acknowledged.")
+	for _, radio := range radios {
+		fmt.Fprintf(w, "crazyradio_lost_packets_total{radio=\"%d\",serial=%q} %d\n", radio.Index, radio.Serial, radio.Stats.Lost)
+	}
+
+	metricHeader(w, "crazyradio_usb_errors_total", "counter", "Failed USB transfers with the Crazyradio.")
+	for _, radio := range radios {
+		fmt.Fprintf(w, "crazyradio_usb_errors_total{radio=\"%d\",serial=%q} %d\n", radio.Index, radio.Serial, radio.UsbErrors)
+	}
+
+	metricHeader(w, "crazyradio_round_seconds", "summary", "Time taken by the scheduler rounds in which the Crazyradio transmitted.")
+	for _, radio := range radios {
+		fmt.Fprintf(w, "crazyradio_round_seconds_sum{radio=\"%d\",serial=%q} %g\n", radio.Index, radio.Serial, radio.RoundTime)
+		fmt.Fprintf(w, "crazyradio_round_seconds_count{radio=\"%d\",serial=%q} %d\n", radio.Index, radio.Serial, radio.Rounds)
+	}
+}
+
+type crazyflieMetric struct {
+	id           int
+	status       crazyflie.CrazyflieStatus
+	stats        crazyradio.LinkStats
+	samples      map[int]uint64
+	transactions map[string]crazyflie.TransactionStats
+}
+
+func crazyflieMetrics(w io.Writer) {
+	crazyfliesLock.Lock()
+	fleet := make([]crazyflieMetric, 0, len(crazyflies))
+	for cfid, cf := range crazyflies {
+		fleet = append(fleet, crazyflieMetric{cfid, cf.Status(), cf.LinkStats(), cf.LogSamples(), cf.TransactionStats()})
+	}
+	crazyfliesLock.Unlock()
+	sort.Slice(fleet, func(i, j int) bool { return fleet[i].id < fleet[j].id })
+
+	metricHeader(w, "crazyflie_connected", "gauge", "Whether the Crazyflie is responding.")
+	for _, cf := range fleet {
+		connected := 0
+		if cf.status == crazyflie.StatusConnected {
+			connected = 1
+		}
+		fmt.Fprintf(w, "crazyflie_connected{crazyflie=\"%d\"} %d\n", cf.id, connected)
+	}
+
+	metricHeader(w, "crazyflie_link_quality", "gauge", "Rolling link quality of the Crazyflie in percent.")
+	for _, cf := range fleet {
+		fmt.Fprintf(w, "crazyflie_link_quality{crazyflie=\"%d\"} %g\n", cf.id, cf.stats.Quality)
+	}
+
+	metricHeader(w, "crazyflie_queue_depth", "gauge", "Packets waiting to be transmitted to the Crazyflie.")
+	for _, cf := range fleet {
+		fmt.Fprintf(w, "crazyflie_queue_depth{crazyflie=\"%d\",queue=\"standard\"} %d\n", cf.id, cf.stats.Queued)
+		fmt.Fprintf(w, "crazyflie_queue_depth{crazyflie=\"%d\",queue=\"priority\"} %d\n", cf.id, cf.stats.PriorityQueued)
+	}
+
+	metricHeader(w, "crazyflie_packets_total", "counter", "Packets transmitted to the Crazyflie.")
+	for _, cf := range fleet {
+		fmt.Fprintf(w, "crazyflie_packets_total{crazyflie=\"%d\"} %d\n", cf.id, cf.stats.Sent)
+	}
+
+	metricHeader(w, "crazyflie_log_samples_total", "counter", "Log block samples received from the Crazyflie, the rate of which is the sample rate.")
+	for _, cf := range fleet {
+		blocks := make([]int, 0, len(cf.samples))
+		for blockid := range cf.samples {
+			blocks = append(blocks, blockid)
+		}
+		sort.Ints(blocks)
+		for _, blockid := range blocks {
+			fmt.Fprintf(w, "crazyflie_log_samples_total{crazyflie=\"%d\",block=\"%d\"} %d\n", cf.id, blockid, cf.samples[blockid])
+		}
+	}
+
+	transactionMetrics(w, fleet)
+}
+
+// transactionMetrics exposes the statistics of the request/response transactions, by Crazyflie and kind of request (eg. param/1)
+func transactionMetrics(w io.Writer, fleet []crazyflieMetric) {
+	kinds := make([][]string, len(fleet))
+	for i, cf := range fleet {
+		for kind := range cf.transactions {
+			kinds[i] = append(kinds[i], kind)
+		}
+		sort.Strings(kinds[i])
+	}
+
+	metricHeader(w, "crazyflie_transactions_total", "counter", "Requests to the Crazyflie which expect an answer.")
+	for i, cf := range fleet {
+		for _, kind := range kinds[i] {
+			fmt.Fprintf(w, "crazyflie_transactions_total{crazyflie=\"%d\",request=%q} %d\n", cf.id, kind, cf.transactions[kind].Transactions)
+		}
+	}
+
+	metricHeader(w, "crazyflie_transaction_packets_total", "counter", "Request packets sent to the Crazyflie, including the retries.")
+	for i, cf := range fleet {
+		for _, kind := range kinds[i] {
+			fmt.Fprintf(w, "crazyflie_transaction_packets_total{crazyflie=\"%d\",request=%q} %d\n", cf.id, kind, cf.transactions[kind].Sent)
+		}
+	}
+
+	metricHeader(w, "crazyflie_transaction_failures_total", "counter", "Requests to the Crazyflie which were not answered.")
+	for i, cf := range fleet {
+		for _, kind := range kinds[i] {
+			fmt.Fprintf(w, "crazyflie_transaction_failures_total{crazyflie=\"%d\",request=%q} %d\n", cf.id, kind, cf.transactions[kind].Failed)
+		}
+	}
+
+	metricHeader(w, "crazyflie_transaction_duplicates_total", "counter", "Answers of the Crazyflie discarded because the request was already answered.")
+	for i, cf := range fleet {
+		for _, kind := range kinds[i] {
+			fmt.Fprintf(w, "crazyflie_transaction_duplicates_total{crazyflie=\"%d\",request=%q} %d\n", cf.id, kind, cf.transactions[kind].Duplicates)
+		}
+	}
+
+	metricHeader(w, "crazyflie_transaction_seconds", "summary", "Time taken by the Crazyflie to answer the requests.")
+	for i, cf := range fleet {
+		for _, kind := range kinds[i] {
+			stats := cf.transactions[kind]
+			fmt.Fprintf(w, "crazyflie_transaction_seconds_sum{crazyflie=\"%d\",request=%q} %g\n", cf.id, kind, stats.Latency)
+			fmt.Fprintf(w, "crazyflie_transaction_seconds_count{crazyflie=\"%d\",request=%q} %d\n", cf.id, kind, stats.Transactions-stats.Failed)
+		}
+	}
+}
+
+func apiMetrics(w io.Writer) {
+	socketsLock.Lock()
+	websockets := 0
+	for _, sk := range sockets {
+		if sk.socketType == "websocket" {
+			websockets++
+		}
+	}
+	socketsLock.Unlock()
+
+	metricHeader(w, "crazyserver_websocket_clients", "gauge", "Connected websocket clients.")
+	fmt.Fprintf(w, "crazyserver_websocket_clients %d\n", websockets)
+
+	latenciesLock.Lock()
+	defer latenciesLock.Unlock()
+
+	keys := make([]latencyKey, 0, len(latencies))
+	for key := range latencies {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].route < keys[j].route || (keys[i].route == keys[j].route && keys[i].method < keys[j].method)
+	})
+
+	metricHeader(w, "crazyserver_http_request_duration_seconds", "histogram", "Latency of the HTTP requests.")
+	for _, key := range keys {
+		histogram := latencies[key]
+		labels := fmt.Sprintf("method=%q,route=%q", key.method, key.route)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "crazyserver_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, histogram.buckets[i])
+		}
+		fmt.Fprintf(w, "crazyserver_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, histogram.count)
+		fmt.Fprintf(w, "crazyserver_http_request_duration_seconds_sum{%s} %g\n", labels, histogram.sum)
+		fmt.Fprintf(w, "crazyserver_http_request_duration_seconds_count{%s} %d\n", labels, histogram.count)
+	}
+}
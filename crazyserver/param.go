@@ -48,7 +48,10 @@ func paramIndex(w http.ResponseWriter, r *http.Request, cf *crazyflie.Crazyflie)
 
 	paramNames := cf.ParamGetList()
 	for _, name := range paramNames {
-		val, _ := cf.ParamRead(name)
+		val, _ := cf.ParamRead(r.Context(), name)
+		if r.Context().Err() != nil {
+			return // the client has gone away
+		}
 		resp.Params[name] = convertToFloat(val)
 	}
 
@@ -106,14 +109,15 @@ func paramAccess(w http.ResponseWriter, r *http.Request, cf *crazyflie.Crazyflie
 			return
 		}
 
-		err = cf.ParamWriteFromFloat64(fmt.Sprintf("%s.%s", group, name), req.Value)
+		err = cf.ParamWriteFromFloat64(r.Context(), fmt.Sprintf("%s.%s", group, name), req.Value)
 
 		if err != nil {
 			respondError(w, r, http.StatusBadRequest, fmt.Sprint(err))
+			return
 		}
 	}
 
-	val, err := cf.ParamRead(fmt.Sprintf("%s.%s", group, name))
+	val, err := cf.ParamRead(r.Context(), fmt.Sprintf("%s.%s", group, name))
 
 	if err != nil {
 		respondError(w, r, http.StatusNotFound, fmt.Sprint(err))
@@ -0,0 +1,25 @@
+package crazyserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+func radiosInitRoute(r *mux.Router) {
+	r.HandleFunc("/radios", radiosIndexHandler).Methods("GET")
+}
+
+type radiosIndexResponse struct {
+	Radios []crazyradio.RadioInfo `json:"radios"`
+}
+
+// radiosIndexHandler lists the Crazyradios in service, with the channels they serve and their statistics
+func radiosIndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(radiosIndexResponse{crazyradio.Radios()})
+}
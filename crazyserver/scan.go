@@ -0,0 +1,59 @@
+package crazyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mikehamer/crazyserver/crazyflie"
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+func scanInitRoute(r *mux.Router) {
+	r.HandleFunc("/fleet/scan", fleetScanHandler).Methods("GET")
+}
+
+type scanResultItem struct {
+	URI      string `json:"uri"`
+	Address  string `json:"address"`
+	Channel  uint8  `json:"channel"`
+	Datarate string `json:"datarate"`
+}
+
+type fleetScanResponse struct {
+	Found []scanResultItem `json:"found"`
+}
+
+// fleetScanHandler scans for Crazyflies at the addresses in the address query parameter (default E7E7E7E7E7).
+func fleetScanHandler(w http.ResponseWriter, r *http.Request) {
+	addressQuery := r.URL.Query().Get("address")
+	if addressQuery == "" {
+		addressQuery = "E7E7E7E7E7"
+	}
+
+	addresses, err := crazyradio.ParseAddresses(addressQuery)
+	if err != nil {
+		respondError(w, r, http.StatusBadRequest, fmt.Sprint(err))
+		return
+	}
+
+	results, err := crazyradio.Scan(addresses)
+	if err != nil {
+		respondError(w, r, http.StatusServiceUnavailable, fmt.Sprint(err))
+		return
+	}
+
+	resp := fleetScanResponse{Found: make([]scanResultItem, len(results))}
+	for i, result := range results {
+		resp.Found[i].URI = crazyflie.LinkURI{Scheme: "radio", Channel: result.Channel, Datarate: result.Datarate, Address: result.Address}.String()
+		resp.Found[i].Address = fmt.Sprintf("%010X", result.Address)
+		resp.Found[i].Channel = result.Channel
+		resp.Found[i].Datarate = result.Datarate.String()
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(resp)
+}
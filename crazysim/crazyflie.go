@@ -0,0 +1,251 @@
+package crazysim
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+	"github.com/mikehamer/crazyserver/internal/protocol"
+)
+
+// the CRTP protocol version of the simulated firmware, which has the v2 log and param TOCs
+const defaultProtocolVersion = 4
+
+// the largest downlink backlog a simulated crazyflie keeps before dropping packets, as the firmware queue would
+const downlinkQueueLength = 128
+
+// Crazyflie is a simulated Crazyflie. It answers the CRTP traffic sent by the crazyflie package:
+// log and param TOCs, log blocks, parameter reads and writes, console output, setpoints,
+// the reboot handshake, and (once rebooted to the bootloader) flashing.
+type Crazyflie struct {
+	lock sync.Mutex
+
+	firmwareChannel  uint8
+	firmwareDatarate crazyradio.RadioDatarate
+	firmwareAddress  uint64
+	channel          uint8
+	datarate         crazyradio.RadioDatarate
+	address          uint64
+	inBootloader     bool
+	bootTime         time.Time
+	protocolVersion  int // 0 for a firmware which predates the version request, see SetProtocolVersion
+
+	downlink [][]byte
+
+	// flight state, updated by setpoints and external positions
+	roll, pitch, yawrate float32
+	thrust               uint16
+	x, y, z              float32
+
+	logBlocks   map[uint8]*simLogBlock
+	paramValues []float64
+	paramV2     bool // the parameters are read and written with 16-bit ids, once the v2 TOC is used
+
+	flash map[byte]*simFlash
+}
+
+func newCrazyflie(channel uint8, datarate crazyradio.RadioDatarate, address uint64) *Crazyflie {
+	cf := &Crazyflie{
+		firmwareChannel:  channel,
+		firmwareDatarate: datarate,
+		firmwareAddress:  address,
+		protocolVersion:  defaultProtocolVersion,
+		flash:            newSimFlash(),
+	}
+	cf.boot(false)
+	return cf
+}
+
+// Address returns the address the simulated crazyflie currently listens on
+func (cf *Crazyflie) Address() uint64 {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	return cf.address
+}
+
+// Channel returns the channel the simulated crazyflie currently listens on
+func (cf *Crazyflie) Channel() uint8 {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	return cf.channel
+}
+
+// SetProtocolVersion changes the CRTP protocol version of the simulated firmware, eg. to 0 to simulate a firmware
+// which does not answer the version request. Below version 4, the firmware only has the v1 log and param TOCs.
+func (cf *Crazyflie) SetProtocolVersion(version int) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	cf.protocolVersion = version
+}
+
+// InBootloader reports whether the simulated crazyflie has been rebooted to its bootloader
+func (cf *Crazyflie) InBootloader() bool {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	return cf.inBootloader
+}
+
+// Flash returns a copy of the simulated flash memory of the STM32 or NRF51 (target 0xFF or 0xFE)
+func (cf *Crazyflie) Flash(target byte) []byte {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	flash, ok := cf.flash[target]
+	if !ok {
+		return nil
+	}
+	data := make([]byte, len(flash.memory))
+	copy(data, flash.memory)
+	return data
+}
+
+func (cf *Crazyflie) listensOn(channel uint8, datarate crazyradio.RadioDatarate, address uint64) bool {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	return cf.channel == channel && cf.datarate == datarate && cf.address == address
+}
+
+// boot (re)starts the simulated firmware or bootloader, losing all volatile state
+func (cf *Crazyflie) boot(bootloader bool) {
+	cf.inBootloader = bootloader
+	cf.bootTime = time.Now()
+	cf.downlink = nil
+	cf.logBlocks = make(map[uint8]*simLogBlock)
+	cf.roll, cf.pitch, cf.yawrate, cf.thrust = 0, 0, 0, 0
+
+	if bootloader {
+		cf.channel = 0
+		cf.datarate = crazyradio.RadioDatarate_2MPS
+		cf.address = cf.bootloaderAddress()
+		return
+	}
+
+	cf.channel = cf.firmwareChannel
+	cf.datarate = cf.firmwareDatarate
+	cf.address = cf.firmwareAddress
+	cf.paramSystemInit()
+	cf.paramV2 = false
+	cf.consolePrint("SYS: ----------------------------\n")
+	cf.consolePrint("SYS: Crazyflie 2.0 (simulated) is up and running!\n")
+}
+
+// the bootloader listens on an address derived from the firmware address, see the crazyflie reboot handshake
+func (cf *Crazyflie) bootloaderAddress() uint64 {
+	return (cf.firmwareAddress & 0xFFFFFFFF) | (uint64(0xB1) << 32)
+}
+
+// exchange handles one uplink packet and returns the payload of the acknowledgement
+func (cf *Crazyflie) exchange(packet []byte) []byte {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	cf.handlePacket(packet)
+	cf.logSystemUpdate()
+
+	if len(cf.downlink) == 0 {
+		return []byte{} // acknowledged with no data
+	}
+
+	resp := cf.downlink[0]
+	cf.downlink = cf.downlink[1:]
+	return resp
+}
+
+// respond queues a packet to be returned in a future acknowledgement
+func (cf *Crazyflie) respond(packet ...byte) {
+	if len(cf.downlink) >= downlinkQueueLength {
+		return
+	}
+	cf.downlink = append(cf.downlink, packet)
+}
+
+func (cf *Crazyflie) handlePacket(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+
+	if packet[0] == 0xFF {
+		if len(packet) >= 3 && packet[1] == 0xFE {
+			cf.handleReboot(packet)
+		} else if len(packet) >= 3 && cf.inBootloader {
+			cf.handleFlash(packet)
+		}
+		return // a lone 0xFF is a ping
+	}
+
+	if cf.inBootloader {
+		return // the bootloader only understands the 0xFF packets
+	}
+
+	header := crtpHeader(packet[0])
+	switch header.Port() {
+	case crtpPortLog:
+		cf.handleLog(header.Channel(), packet[1:])
+	case crtpPortParam:
+		cf.handleParam(header.Channel(), packet[1:])
+	case crtpPortSetpoint:
+		cf.handleSetpoint(packet[1:])
+	case crtpPortPosition:
+		cf.handlePosition(header.Channel(), packet[1:])
+	case crtpPortPlatform:
+		cf.handlePlatform(header.Channel(), packet[1:])
+	}
+}
+
+func (cf *Crazyflie) handlePlatform(channel byte, data []byte) {
+	if channel != 1 || len(data) == 0 || cf.protocolVersion == 0 {
+		return
+	}
+	if data[0] == 0x00 { // get protocol version
+		cf.respond(crtp(crtpPortPlatform, 1), 0x00, byte(cf.protocolVersion))
+	}
+}
+
+// tocV2 reports whether the simulated firmware has the v2 log and param TOCs
+func (cf *Crazyflie) tocV2() bool {
+	return cf.protocolVersion >= 4
+}
+
+func (cf *Crazyflie) handleSetpoint(data []byte) {
+	if len(data) < 14 {
+		return
+	}
+	cf.roll = protocol.BytesToFloat32(data[0:4]).(float32)
+	cf.pitch = protocol.BytesToFloat32(data[4:8]).(float32)
+	cf.yawrate = protocol.BytesToFloat32(data[8:12]).(float32)
+	cf.thrust = uint16(data[12]) | (uint16(data[13]) << 8)
+}
+
+func (cf *Crazyflie) handlePosition(channel byte, data []byte) {
+	switch channel {
+	case 0: // external position
+		if len(data) < 12 {
+			return
+		}
+		cf.x = protocol.BytesToFloat32(data[0:4]).(float32)
+		cf.y = protocol.BytesToFloat32(data[4:8]).(float32)
+		cf.z = protocol.BytesToFloat32(data[8:12]).(float32)
+	case 2: // packed external positions: an id (the last byte of the address) and int16 millimeters each
+		for i := 0; i+7 <= len(data); i += 7 {
+			if data[i] != byte(cf.firmwareAddress) {
+				continue
+			}
+			cf.x = float32(int16(binary.LittleEndian.Uint16(data[i+1:i+3]))) / 1000
+			cf.y = float32(int16(binary.LittleEndian.Uint16(data[i+3:i+5]))) / 1000
+			cf.z = float32(int16(binary.LittleEndian.Uint16(data[i+5:i+7]))) / 1000
+		}
+	}
+}
+
+// consolePrint splits text into console packets
+func (cf *Crazyflie) consolePrint(text string) {
+	for len(text) > 0 {
+		n := len(text)
+		if n > 30 {
+			n = 30
+		}
+		cf.respond(append([]byte{crtp(crtpPortConsole, 0)}, text[:n]...)...)
+		text = text[n:]
+	}
+}
@@ -0,0 +1,64 @@
+package crazysim
+
+import (
+	"testing"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// every prefix of a packet understood by the simulator, down to the lone header, is handled without panicking
+func TestTruncatedPackets(t *testing.T) {
+	packets := [][]byte{
+		{crtp(crtpPortLog, 0), 0x02, 0x01, 0x00},
+		{crtp(crtpPortLog, 1), 0x00, 0x01, 0x07, 0x00},
+		{crtp(crtpPortLog, 1), 0x06, 0x01, 0x07, 0x00, 0x00},
+		{crtp(crtpPortLog, 1), 0x03, 0x01, 0x02},
+		{crtp(crtpPortParam, 0), 0x02, 0x01, 0x00},
+		{crtp(crtpPortParam, 1), 0x01},
+		{crtp(crtpPortParam, 2), 0x01, 0x00, 0x00, 0x80, 0x3F},
+		{crtp(crtpPortSetpoint, 0), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{crtp(crtpPortPosition, 2), 0x01, 0, 0, 0, 0, 0, 0},
+		{crtp(crtpPortPlatform, 1), 0x00},
+	}
+
+	cf := newCrazyflie(80, crazyradio.RadioDatarate_2MPS, 0xE7E7E7E701)
+	for _, packet := range packets {
+		for n := 1; n <= len(packet); n++ {
+			cf.exchange(packet[:n])
+		}
+	}
+}
+
+// a log block create without operations is answered with an error
+func TestLogCreateWithoutOperations(t *testing.T) {
+	cf := newCrazyflie(80, crazyradio.RadioDatarate_2MPS, 0xE7E7E7E701)
+	cf.downlink = nil // the console output of the boot
+
+	for _, command := range []byte{0x00, 0x06} {
+		for _, packet := range [][]byte{{crtp(crtpPortLog, 1), command}, {crtp(crtpPortLog, 1), command, 0x01}} {
+			resp := cf.exchange(packet)
+			if len(resp) != 4 || resp[1] != command || resp[3] != logErrorNoEntry {
+				t.Fatalf("create %x answered %x, expecting the no entry error", packet, resp)
+			}
+		}
+	}
+}
+
+// every prefix of a bootloader packet, including those without a command, is handled without panicking
+func TestTruncatedFlashPackets(t *testing.T) {
+	packets := [][]byte{
+		{0xFF, 0xFF, 0x10},
+		{0xFF, 0xFF, 0x14, 0x00, 0x00, 0x00, 0x00, 0x01},
+		{0xFF, 0xFF, 0x15, 0x00, 0x00, 0x00, 0x00},
+		{0xFF, 0xFF, 0x18, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00},
+		{0xFF, 0xFF, 0x1C, 0x00, 0x00, 0x00, 0x00},
+	}
+
+	cf := newCrazyflie(80, crazyradio.RadioDatarate_2MPS, 0xE7E7E7E701)
+	cf.boot(true)
+	for _, packet := range packets {
+		for n := 1; n <= len(packet); n++ {
+			cf.handleFlash(packet[:n])
+		}
+	}
+}
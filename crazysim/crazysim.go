@@ -0,0 +1,278 @@
+package crazysim
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// how long CrazyflieRegister waits for the crazyflie to respond when the context has no deadline, as the radio does
+const registerTimeout = 5 * time.Second
+
+// the rate at which a registered crazyflie is serviced, roughly what a Crazyradio achieves
+const exchangePeriod = 1 * time.Millisecond
+
+var defaultPacket = []byte{0xFF}
+
+type registrationKey struct {
+	channel uint8
+	address uint64
+}
+
+// a registration is the link side of a crazyflie, it plays the role of the crazyradio packet queues
+type registration struct {
+	channel        uint8
+	datarate       crazyradio.RadioDatarate
+	address        uint64
+	standardQueue  *list.List
+	priorityQueue  *list.List
+	lock           *sync.Mutex
+	callback       func([]byte)
+	packetDequeued chan bool
+	stop           chan bool
+	stats          crazyradio.LinkStats
+}
+
+// Link is an in-process link to a set of simulated Crazyflies.
+// It implements the same interface as the Crazyradio link and can be passed to crazyflie.ConnectLink.
+type Link struct {
+	lock          sync.Mutex
+	crazyflies    []*Crazyflie
+	registrations map[registrationKey]*registration
+}
+
+func NewLink() *Link {
+	return &Link{registrations: make(map[registrationKey]*registration)}
+}
+
+// CrazyflieAdd powers on a simulated Crazyflie listening on channel, datarate and address
+func (link *Link) CrazyflieAdd(channel uint8, datarate crazyradio.RadioDatarate, address uint64) (*Crazyflie, error) {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	for _, cf := range link.crazyflies {
+		if cf.firmwareChannel == channel && cf.firmwareAddress == address {
+			return nil, ErrorAddressInUse
+		}
+	}
+
+	cf := newCrazyflie(channel, datarate, address)
+	link.crazyflies = append(link.crazyflies, cf)
+	return cf, nil
+}
+
+// crazyflieAt returns the simulated crazyflie currently listening on channel, datarate and address
+func (link *Link) crazyflieAt(channel uint8, datarate crazyradio.RadioDatarate, address uint64) *Crazyflie {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	for _, cf := range link.crazyflies {
+		if cf.listensOn(channel, datarate, address) {
+			return cf
+		}
+	}
+	return nil
+}
+
+func (link *Link) CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, registerTimeout)
+		defer cancel()
+	}
+
+	// as with the radio, wait for the crazyflie to acknowledge a first packet before handing over the callback
+	cfCommunicating := make(chan bool)
+	reg := link.registrationGet(channel, address)
+	reg.lock.Lock()
+	reg.datarate = datarate
+	reg.callback = func(resp []byte) {
+		select {
+		case cfCommunicating <- true:
+		default:
+		}
+	}
+	reg.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		link.CrazyflieRemove(channel, address)
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrorNoResponse
+		}
+		return ctx.Err()
+	case <-cfCommunicating:
+		reg.lock.Lock()
+		reg.callback = responseCallback
+		reg.lock.Unlock()
+		return nil
+	}
+}
+
+func (link *Link) CrazyflieRemove(channel uint8, address uint64) {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	key := registrationKey{channel, address}
+	if reg, ok := link.registrations[key]; ok {
+		close(reg.stop)
+		delete(link.registrations, key)
+	}
+}
+
+func (link *Link) registrationGet(channel uint8, address uint64) *registration {
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	key := registrationKey{channel, address}
+	reg, ok := link.registrations[key]
+	if !ok {
+		reg = &registration{
+			channel:        channel,
+			datarate:       crazyradio.RadioDatarate_2MPS,
+			address:        address,
+			standardQueue:  list.New(),
+			priorityQueue:  list.New(),
+			lock:           new(sync.Mutex),
+			packetDequeued: make(chan bool, 1),
+			stop:           make(chan bool),
+		}
+		link.registrations[key] = reg
+		go link.exchangeThread(reg)
+	}
+
+	return reg
+}
+
+func (link *Link) PacketSend(channel uint8, address uint64, packet []byte) error {
+	reg := link.registrationGet(channel, address)
+
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+
+	reg.lock.Lock()
+	reg.standardQueue.PushBack(packetCopy)
+	reg.lock.Unlock()
+	return nil
+}
+
+func (link *Link) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	reg := link.registrationGet(channel, address)
+
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+
+	reg.lock.Lock()
+	reg.priorityQueue.PushBack(packetCopy)
+	reg.lock.Unlock()
+}
+
+func (link *Link) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	link.lock.Lock()
+	reg, ok := link.registrations[registrationKey{channel, address}]
+	link.lock.Unlock()
+	if !ok {
+		return nil // nothing is queued for a crazyflie which is not registered
+	}
+
+	for {
+		reg.lock.Lock()
+		empty := reg.priorityQueue.Front() == nil && reg.standardQueue.Front() == nil
+		reg.lock.Unlock()
+
+		if empty {
+			return nil
+		}
+
+		select {
+		case <-reg.packetDequeued:
+		case <-reg.stop:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (link *Link) LinkStats(channel uint8, address uint64) crazyradio.LinkStats {
+	link.lock.Lock()
+	reg, ok := link.registrations[registrationKey{channel, address}]
+	link.lock.Unlock()
+	if !ok {
+		return crazyradio.LinkStats{}
+	}
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	stats := reg.stats
+	stats.Queued = reg.standardQueue.Len()
+	stats.PriorityQueued = reg.priorityQueue.Len()
+	return stats
+}
+
+// exchangeThread services a registration in the same way the radio thread does: every period one packet
+// is transmitted, and the acknowledgement (if the simulated crazyflie answered) is passed to the callback
+func (link *Link) exchangeThread(reg *registration) {
+	ticker := time.NewTicker(exchangePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-reg.stop:
+			return
+		case <-ticker.C:
+		}
+
+		reg.lock.Lock()
+
+		datarate := reg.datarate
+		var packetQueue *list.List = nil
+		var packetElement *list.Element = nil
+		var packet []byte
+
+		if reg.priorityQueue.Front() != nil {
+			packetQueue = reg.priorityQueue
+		} else if reg.standardQueue.Front() != nil {
+			packetQueue = reg.standardQueue
+		}
+
+		if packetQueue != nil {
+			packetElement = packetQueue.Front()
+			packet = packetElement.Value.([]byte)
+		} else {
+			packet = defaultPacket
+		}
+
+		reg.lock.Unlock()
+
+		cf := link.crazyflieAt(reg.channel, datarate, reg.address)
+		if cf == nil {
+			reg.lock.Lock()
+			reg.stats.Update(crazyradio.Ack{}, nil)
+			reg.lock.Unlock()
+			continue // nobody is listening, the packet is not acknowledged and will be retransmitted
+		}
+
+		resp := cf.exchange(packet)
+
+		reg.lock.Lock()
+		reg.stats.Update(crazyradio.Ack{Received: true, Data: resp}, nil)
+		if packetQueue != nil {
+			packetQueue.Remove(packetElement)
+		}
+		callback := reg.callback
+		reg.lock.Unlock()
+
+		select {
+		case reg.packetDequeued <- true:
+		default:
+		}
+
+		if callback != nil {
+			callback(resp) // from the exchange thread, such that the responses are delivered in order
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package crazysim
+
+import "github.com/mikehamer/crazyserver/internal/protocol"
+
+type crtpHeader = protocol.Header
+type crtpPort = protocol.Port
+
+const (
+	crtpPortConsole  = protocol.PortConsole
+	crtpPortParam    = protocol.PortParam
+	crtpPortSetpoint = protocol.PortSetpoint
+	crtpPortLog      = protocol.PortLog
+	crtpPortPosition = protocol.PortPosition
+	crtpPortPlatform = protocol.PortPlatform
+	crtpPortLink     = protocol.PortLink
+)
+
+func crtp(port crtpPort, channel byte) byte {
+	return protocol.MakeHeader(port, channel)
+}
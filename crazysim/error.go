@@ -0,0 +1,19 @@
+package crazysim
+
+import "fmt"
+
+type simError uint8
+
+func (e simError) Error() string {
+	return fmt.Sprintf("crazysim: %s", simErrorString[e])
+}
+
+const (
+	ErrorNoResponse simError = iota
+	ErrorAddressInUse
+)
+
+var simErrorString = map[simError]string{
+	ErrorNoResponse:   "no response from crazyflie",
+	ErrorAddressInUse: "a simulated crazyflie already uses this channel and address",
+}
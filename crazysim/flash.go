@@ -0,0 +1,137 @@
+package crazysim
+
+// simFlash is the flash memory of one of the Crazyflie's CPUs as seen from the bootloader
+type simFlash struct {
+	pageSize       int
+	numBuffPages   int
+	numFlashPages  int
+	startFlashPage int
+
+	buffer []byte
+	memory []byte // the flash from startFlashPage onwards, which is where firmware images are written
+
+	done      byte
+	errorCode byte
+}
+
+// bootloader write flash error codes
+const (
+	flashErrorNone       = 0
+	flashErrorFlashPage  = 2
+	flashErrorBufferPage = 3
+)
+
+func newSimFlash() map[byte]*simFlash {
+	return map[byte]*simFlash{
+		0xFF: newSimFlashCPU(1024, 10, 1024, 16), // STM32
+		0xFE: newSimFlashCPU(1024, 10, 232, 88),  // NRF51
+	}
+}
+
+func newSimFlashCPU(pageSize, numBuffPages, numFlashPages, startFlashPage int) *simFlash {
+	return &simFlash{
+		pageSize:       pageSize,
+		numBuffPages:   numBuffPages,
+		numFlashPages:  numFlashPages,
+		startFlashPage: startFlashPage,
+		buffer:         make([]byte, pageSize*numBuffPages),
+		memory:         make([]byte, pageSize*(numFlashPages-startFlashPage)),
+		done:           1,
+	}
+}
+
+func uint16At(b []byte) int {
+	return int(b[0]) | (int(b[1]) << 8)
+}
+
+func (cf *Crazyflie) handleFlash(packet []byte) {
+	if len(packet) < 3 {
+		return // without a target and command
+	}
+	target := packet[1]
+	flash, ok := cf.flash[target]
+	if !ok {
+		return
+	}
+	command := packet[2]
+	args := packet[3:]
+
+	switch command {
+	case 0x10: // get info
+		info := []byte{0xFF, target, 0x10,
+			byte(flash.pageSize), byte(flash.pageSize >> 8),
+			byte(flash.numBuffPages), byte(flash.numBuffPages >> 8),
+			byte(flash.numFlashPages), byte(flash.numFlashPages >> 8),
+			byte(flash.startFlashPage), byte(flash.startFlashPage >> 8),
+		}
+		info = append(info, make([]byte, 12)...) // cpu id
+		info = append(info, 0x10)                // protocol version
+		cf.respond(info...)
+
+	case 0x14: // load buffer
+		if len(args) < 4 {
+			return
+		}
+		offset := uint16At(args[0:2])*flash.pageSize + uint16At(args[2:4])
+		data := args[4:]
+		if offset+len(data) <= len(flash.buffer) {
+			copy(flash.buffer[offset:], data)
+		}
+
+	case 0x15: // read buffer
+		if len(args) < 4 {
+			return
+		}
+		offset := uint16At(args[0:2])*flash.pageSize + uint16At(args[2:4])
+		cf.respondMemory(target, command, args[0:4], flash.buffer, offset)
+
+	case 0x18: // write flash
+		if len(args) < 6 {
+			return
+		}
+		bufferPage, flashPage, numPages := uint16At(args[0:2]), uint16At(args[2:4]), uint16At(args[4:6])
+		flash.errorCode = flash.write(bufferPage, flashPage, numPages)
+		// the bootloader reports a failed write as not done, with its error code
+		flash.done = 0
+		if flash.errorCode == flashErrorNone {
+			flash.done = 1
+		}
+		cf.respond(0xFF, target, 0x18, flash.done, flash.errorCode)
+
+	case 0x19: // flash status
+		cf.respond(0xFF, target, 0x19, flash.done, flash.errorCode)
+
+	case 0x1C: // read flash
+		if len(args) < 4 {
+			return
+		}
+		offset := (uint16At(args[0:2])-flash.startFlashPage)*flash.pageSize + uint16At(args[2:4])
+		cf.respondMemory(target, command, args[0:4], flash.memory, offset)
+	}
+}
+
+func (flash *simFlash) write(bufferPage, flashPage, numPages int) byte {
+	if bufferPage+numPages > flash.numBuffPages {
+		return flashErrorBufferPage
+	}
+	if flashPage < flash.startFlashPage || flashPage+numPages > flash.numFlashPages {
+		return flashErrorFlashPage
+	}
+
+	source := flash.buffer[bufferPage*flash.pageSize : (bufferPage+numPages)*flash.pageSize]
+	copy(flash.memory[(flashPage-flash.startFlashPage)*flash.pageSize:], source)
+	return flashErrorNone
+}
+
+// respondMemory answers a buffer or flash read with as much data as fits in a packet
+func (cf *Crazyflie) respondMemory(target, command byte, address []byte, memory []byte, offset int) {
+	packet := append([]byte{0xFF, target, command}, address...)
+	if offset >= 0 && offset < len(memory) {
+		end := offset + 32 - len(packet)
+		if end > len(memory) {
+			end = len(memory)
+		}
+		packet = append(packet, memory[offset:end]...)
+	}
+	cf.respond(packet...)
+}
@@ -0,0 +1,242 @@
+package crazysim
+
+import (
+	"math"
+	"time"
+)
+
+// limits reported in the log TOC info, as for the real firmware
+const (
+	logMaxBlocks     = 16
+	logMaxOps        = 128
+	logMaxBlockBytes = 26
+)
+
+// log error codes, as returned by the firmware
+const (
+	logErrorNone    = 0
+	logErrorNoEntry = 2
+	logErrorTooBig  = 7
+	logErrorNoMem   = 12
+	logErrorExists  = 17
+)
+
+var logTypeToValueType = map[uint8]valueType{
+	1: typeUint8,
+	2: typeUint16,
+	3: typeUint32,
+	4: typeInt8,
+	5: typeInt16,
+	6: typeInt32,
+	7: typeFloat,
+}
+
+var valueTypeToLogType = map[valueType]uint8{
+	typeUint8:  1,
+	typeUint16: 2,
+	typeUint32: 3,
+	typeInt8:   4,
+	typeInt16:  5,
+	typeInt32:  6,
+	typeFloat:  7,
+}
+
+type logVariable struct {
+	group string
+	name  string
+	kind  valueType
+	value func(cf *Crazyflie, t float64) float64 // t is the time since boot in seconds
+}
+
+var logVariables = []logVariable{
+	{"stabilizer", "roll", typeFloat, func(cf *Crazyflie, t float64) float64 { return float64(cf.roll) + 0.1*math.Sin(7*t) }},
+	{"stabilizer", "pitch", typeFloat, func(cf *Crazyflie, t float64) float64 { return float64(cf.pitch) + 0.1*math.Cos(5*t) }},
+	{"stabilizer", "yaw", typeFloat, func(cf *Crazyflie, t float64) float64 {
+		return math.Remainder(float64(cf.yawrate)*t, 360)
+	}},
+	{"stabilizer", "thrust", typeUint16, func(cf *Crazyflie, t float64) float64 { return float64(cf.thrust) }},
+	{"acc", "x", typeFloat, func(cf *Crazyflie, t float64) float64 {
+		return math.Sin(float64(cf.pitch)*math.Pi/180) + 0.01*math.Sin(31*t)
+	}},
+	{"acc", "y", typeFloat, func(cf *Crazyflie, t float64) float64 {
+		return -math.Sin(float64(cf.roll)*math.Pi/180) + 0.01*math.Sin(37*t)
+	}},
+	{"acc", "z", typeFloat, func(cf *Crazyflie, t float64) float64 { return 1 + 0.01*math.Sin(41*t) }},
+	{"gyro", "x", typeFloat, func(cf *Crazyflie, t float64) float64 { return 0.5 * math.Sin(3*t) }},
+	{"gyro", "y", typeFloat, func(cf *Crazyflie, t float64) float64 { return 0.5 * math.Cos(3*t) }},
+	{"gyro", "z", typeFloat, func(cf *Crazyflie, t float64) float64 { return float64(cf.yawrate) }},
+	{"stateEstimate", "x", typeFloat, func(cf *Crazyflie, t float64) float64 { return float64(cf.x) }},
+	{"stateEstimate", "y", typeFloat, func(cf *Crazyflie, t float64) float64 { return float64(cf.y) }},
+	{"stateEstimate", "z", typeFloat, func(cf *Crazyflie, t float64) float64 { return float64(cf.z) }},
+	{"pm", "vbat", typeFloat, func(cf *Crazyflie, t float64) float64 { return math.Max(3.0, 4.2-t/3600) }},
+	{"pm", "state", typeInt8, func(cf *Crazyflie, t float64) float64 { return 0 }},
+	{"sys", "canfly", typeUint8, func(cf *Crazyflie, t float64) float64 { return 1 }},
+}
+
+var logCRC = func() uint32 {
+	names := make([]string, len(logVariables))
+	types := make([]uint8, len(logVariables))
+	for i, v := range logVariables {
+		names[i] = v.group + "." + v.name
+		types[i] = valueTypeToLogType[v.kind]
+	}
+	return tocCRC(names, types)
+}()
+
+type simLogBlock struct {
+	variables  []int
+	types      []valueType
+	period     time.Duration
+	running    bool
+	nextSample time.Time
+}
+
+func (cf *Crazyflie) handleLog(channel byte, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch channel {
+	case 0: // TOC access
+		switch data[0] {
+		case 0x00, 0x02: // item, v2 item
+			v2 := data[0] == 0x02
+			id, ok := tocItemID(data, v2)
+			if !ok || id >= len(logVariables) || (v2 && !cf.tocV2()) {
+				return
+			}
+			v := logVariables[id]
+			cf.respond(append([]byte{crtp(crtpPortLog, 0)}, tocItem(data[0], id, v2, valueTypeToLogType[v.kind], v.group, v.name)...)...)
+		case 0x01, 0x03: // info, v2 info
+			v2 := data[0] == 0x03
+			if v2 && !cf.tocV2() {
+				return
+			}
+			info := append([]byte{crtp(crtpPortLog, 0)}, tocInfo(data[0], len(logVariables), v2, logCRC)...)
+			cf.respond(append(info, logMaxBlocks, logMaxOps)...)
+		}
+	case 1: // control
+		cf.handleLogControl(data)
+	}
+}
+
+func (cf *Crazyflie) handleLogControl(data []byte) {
+	command := data[0]
+	blockid := uint8(0)
+	if len(data) > 1 {
+		blockid = data[1]
+	}
+	var operations []byte // a create packet without operations is answered with an error
+	if len(data) > 2 {
+		operations = data[2:]
+	}
+
+	errorCode := byte(logErrorNone)
+
+	switch command {
+	case 0x00: // create block
+		errorCode = cf.logBlockCreate(blockid, operations, false)
+	case 0x06: // create block v2, with 16-bit ids
+		if !cf.tocV2() {
+			return
+		}
+		errorCode = cf.logBlockCreate(blockid, operations, true)
+	case 0x02: // delete block
+		if _, ok := cf.logBlocks[blockid]; ok {
+			delete(cf.logBlocks, blockid)
+		} else {
+			errorCode = logErrorNoEntry
+		}
+	case 0x03: // start block
+		block, ok := cf.logBlocks[blockid]
+		if ok && len(data) > 2 {
+			block.period = time.Duration(data[2]) * 10 * time.Millisecond
+			block.running = true
+			block.nextSample = time.Now()
+		} else {
+			errorCode = logErrorNoEntry
+		}
+	case 0x04: // stop block
+		if block, ok := cf.logBlocks[blockid]; ok {
+			block.running = false
+		} else {
+			errorCode = logErrorNoEntry
+		}
+	case 0x05: // reset
+		cf.logBlocks = make(map[uint8]*simLogBlock)
+		blockid = 0
+	default:
+		return
+	}
+
+	cf.respond(crtp(crtpPortLog, 1), command, blockid, errorCode)
+}
+
+// logBlockCreate creates a block from its operations: a type and a variable id (16-bit little endian for v2) each
+func (cf *Crazyflie) logBlockCreate(blockid uint8, operations []byte, v2 bool) byte {
+	operationSize := 2
+	if v2 {
+		operationSize = 3
+	}
+	if len(operations) < operationSize || len(operations)%operationSize != 0 {
+		return logErrorNoEntry
+	}
+	if _, ok := cf.logBlocks[blockid]; ok {
+		return logErrorExists
+	}
+	if len(cf.logBlocks) >= logMaxBlocks {
+		return logErrorNoMem
+	}
+
+	block := &simLogBlock{}
+	size := 0
+	for i := 0; i < len(operations); i += operationSize {
+		id := int(operations[i+1])
+		if v2 {
+			id |= int(operations[i+2]) << 8
+		}
+		if id >= len(logVariables) {
+			return logErrorNoEntry
+		}
+
+		// the low nibble holds the type in which the value should be reported
+		kind, ok := logTypeToValueType[operations[i]&0x0F]
+		if !ok {
+			kind = logVariables[id].kind
+		}
+
+		block.variables = append(block.variables, id)
+		block.types = append(block.types, kind)
+		size += kind.size()
+	}
+	if size > logMaxBlockBytes {
+		return logErrorTooBig
+	}
+
+	cf.logBlocks[blockid] = block
+	return logErrorNone
+}
+
+// logSystemUpdate emits data for every running log block whose period has elapsed
+func (cf *Crazyflie) logSystemUpdate() {
+	now := time.Now()
+	t := now.Sub(cf.bootTime).Seconds()
+	timestamp := uint32(now.Sub(cf.bootTime) / time.Millisecond)
+
+	for blockid, block := range cf.logBlocks {
+		if !block.running || now.Before(block.nextSample) {
+			continue
+		}
+
+		packet := []byte{crtp(crtpPortLog, 2), blockid, byte(timestamp), byte(timestamp >> 8), byte(timestamp >> 16)}
+		for i, id := range block.variables {
+			packet = append(packet, valueToBytes(block.types[i], logVariables[id].value(cf, t))...)
+		}
+		cf.respond(packet...)
+
+		block.nextSample = block.nextSample.Add(block.period)
+		if block.nextSample.Before(now) {
+			block.nextSample = now.Add(block.period) // we have fallen behind, do not try to catch up
+		}
+	}
+}
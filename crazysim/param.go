@@ -0,0 +1,145 @@
+package crazysim
+
+import "encoding/binary"
+
+var valueTypeToParamType = map[valueType]uint8{
+	typeUint8:  0x8,
+	typeUint16: 0x9,
+	typeUint32: 0xA,
+	typeInt8:   0x0,
+	typeInt16:  0x1,
+	typeInt32:  0x2,
+	typeFloat:  0x6,
+}
+
+type paramVariable struct {
+	group    string
+	name     string
+	kind     valueType
+	readonly bool
+	initial  float64
+}
+
+var paramVariables = []paramVariable{
+	{"stabilizer", "estimator", typeUint8, false, 1},
+	{"stabilizer", "controller", typeUint8, false, 1},
+	{"commander", "enHighLevel", typeUint8, false, 0},
+	{"pid_rate", "roll_kp", typeFloat, false, 250},
+	{"pid_rate", "pitch_kp", typeFloat, false, 250},
+	{"pid_rate", "yaw_kp", typeFloat, false, 120},
+	{"pid_attitude", "roll_kp", typeFloat, false, 6},
+	{"pid_attitude", "pitch_kp", typeFloat, false, 6},
+	{"pid_attitude", "yaw_kp", typeFloat, false, 6},
+	{"motorPowerSet", "enable", typeUint8, false, 0},
+	{"motorPowerSet", "m1", typeUint16, false, 0},
+	{"motorPowerSet", "m2", typeUint16, false, 0},
+	{"motorPowerSet", "m3", typeUint16, false, 0},
+	{"motorPowerSet", "m4", typeUint16, false, 0},
+	{"ring", "effect", typeUint8, false, 6},
+	{"ring", "neffect", typeUint8, true, 17},
+	{"system", "selftestPassed", typeInt8, true, 1},
+	{"cpu", "flash", typeUint16, true, 1024},
+	{"firmware", "revision0", typeUint32, true, 0x1BC3F1A2},
+	{"firmware", "modified", typeUint8, true, 0},
+}
+
+var paramCRC = func() uint32 {
+	names := make([]string, len(paramVariables))
+	types := make([]uint8, len(paramVariables))
+	for i, v := range paramVariables {
+		names[i] = v.group + "." + v.name
+		types[i] = paramTocType(v)
+	}
+	return tocCRC(names, types)
+}()
+
+func paramTocType(v paramVariable) uint8 {
+	datatype := valueTypeToParamType[v.kind]
+	if v.readonly {
+		datatype |= 1 << 6
+	}
+	return datatype
+}
+
+func (cf *Crazyflie) paramSystemInit() {
+	cf.paramValues = make([]float64, len(paramVariables))
+	for i, v := range paramVariables {
+		cf.paramValues[i] = v.initial
+	}
+}
+
+func (cf *Crazyflie) handleParam(channel byte, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch channel {
+	case 0: // TOC access
+		switch data[0] {
+		case 0x00, 0x02: // item, v2 item
+			v2 := data[0] == 0x02
+			id, ok := tocItemID(data, v2)
+			if !ok || id >= len(paramVariables) || (v2 && !cf.tocV2()) {
+				return
+			}
+			cf.paramV2 = v2 // as the firmware, the reads and writes follow the version of the TOC
+			v := paramVariables[id]
+			cf.respond(append([]byte{crtp(crtpPortParam, 0)}, tocItem(data[0], id, v2, paramTocType(v), v.group, v.name)...)...)
+		case 0x01, 0x03: // info, v2 info
+			v2 := data[0] == 0x03
+			if v2 && !cf.tocV2() {
+				return
+			}
+			cf.paramV2 = v2
+			cf.respond(append([]byte{crtp(crtpPortParam, 0)}, tocInfo(data[0], len(paramVariables), v2, paramCRC)...)...)
+		}
+	case 1: // read
+		id, ok := cf.paramID(data)
+		if !ok || id >= len(paramVariables) {
+			return
+		}
+		cf.respondParam(1, id)
+	case 2: // write, read-only parameters are silently left unchanged
+		id, ok := cf.paramID(data)
+		if !ok || id >= len(paramVariables) {
+			return
+		}
+		v := paramVariables[id]
+		if value, ok := bytesToValue(v.kind, data[cf.paramIDSize():]); ok && !v.readonly {
+			cf.paramValues[id] = value
+		}
+		cf.respondParam(2, id)
+	}
+}
+
+func (cf *Crazyflie) paramIDSize() int {
+	if cf.paramV2 {
+		return 2
+	}
+	return 1
+}
+
+// paramID decodes the id of the parameter read or written, which leads data
+func (cf *Crazyflie) paramID(data []byte) (int, bool) {
+	if len(data) < cf.paramIDSize() {
+		return 0, false
+	}
+	if cf.paramV2 {
+		return int(binary.LittleEndian.Uint16(data[0:2])), true
+	}
+	return int(data[0]), true
+}
+
+// respondParam answers a read (channel 1) or write (channel 2) with the current value of a parameter
+func (cf *Crazyflie) respondParam(channel byte, id int) {
+	v := paramVariables[id]
+	packet := []byte{crtp(crtpPortParam, channel), byte(id)}
+	if cf.paramV2 {
+		packet = append(packet, byte(id>>8))
+		if channel == 1 {
+			packet = append(packet, 0) // the status of the v2 read
+		}
+	}
+	packet = append(packet, valueToBytes(v.kind, cf.paramValues[id])...)
+	cf.respond(packet...)
+}
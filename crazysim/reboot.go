@@ -0,0 +1,26 @@
+package crazysim
+
+import "time"
+
+// how long the simulated crazyflie takes to come back up after a reboot command
+const rebootDuration = 50 * time.Millisecond
+
+func (cf *Crazyflie) handleReboot(packet []byte) {
+	switch packet[2] {
+	case 0xFF: // reboot init, answer with the id from which the bootloader address is derived
+		address := uint32(cf.firmwareAddress & 0xFFFFFFFF)
+		cf.respond(0xFF, 0xFE, 0xFF, byte(address), byte(address>>8), byte(address>>16), byte(address>>24))
+	case 0xF0: // reboot, to the bootloader (0x00) or to the firmware (0x01)
+		if len(packet) < 4 {
+			return
+		}
+		toBootloader := packet[3] == 0x00
+
+		// reboot once the acknowledgement for this packet has gone out
+		time.AfterFunc(rebootDuration, func() {
+			cf.lock.Lock()
+			defer cf.lock.Unlock()
+			cf.boot(toBootloader)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package crazysim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// the value types that the simulated log variables and parameters can take
+type valueType uint8
+
+const (
+	typeUint8 valueType = iota
+	typeUint16
+	typeUint32
+	typeInt8
+	typeInt16
+	typeInt32
+	typeFloat
+)
+
+func (kind valueType) size() int {
+	switch kind {
+	case typeUint8, typeInt8:
+		return 1
+	case typeUint16, typeInt16:
+		return 2
+	}
+	return 4
+}
+
+// tocCRC computes the checksum by which the crazyflie package caches a TOC
+func tocCRC(names []string, types []uint8) uint32 {
+	hash := crc32.NewIEEE()
+	for i := range names {
+		fmt.Fprintf(hash, "%s:%d;", names[i], types[i])
+	}
+	return hash.Sum32()
+}
+
+// tocItem builds the payload describing a TOC entry: id (16-bit little endian for the v2 commands), type,
+// then the null terminated group and name
+func tocItem(command byte, id int, v2 bool, datatype byte, group, name string) []byte {
+	item := []byte{command, byte(id)}
+	if v2 {
+		item = append(item, byte(id>>8))
+	}
+	item = append(item, datatype)
+	item = append(item, group...)
+	item = append(item, 0)
+	item = append(item, name...)
+	item = append(item, 0)
+	return item
+}
+
+// tocInfo builds the payload of the info of a TOC: its item count (16-bit little endian for the v2 command) and CRC
+func tocInfo(command byte, count int, v2 bool, crc uint32) []byte {
+	info := []byte{command, byte(count)}
+	if v2 {
+		info = append(info, byte(count>>8))
+	}
+	crcBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crcBytes, crc)
+	return append(info, crcBytes...)
+}
+
+// tocItemID decodes the id of the item requested by a TOC item command, which is in data after the command
+func tocItemID(data []byte, v2 bool) (int, bool) {
+	if v2 {
+		if len(data) < 3 {
+			return 0, false
+		}
+		return int(binary.LittleEndian.Uint16(data[1:3])), true
+	}
+	if len(data) < 2 {
+		return 0, false
+	}
+	return int(data[1]), true
+}
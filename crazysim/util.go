@@ -0,0 +1,49 @@
+package crazysim
+
+import "github.com/mikehamer/crazyserver/internal/protocol"
+
+// valueToBytes encodes a value as the little endian representation of a log or param type
+func valueToBytes(kind valueType, value float64) []byte {
+	switch kind {
+	case typeUint8:
+		return protocol.Uint8ToBytes(uint8(value))
+	case typeUint16:
+		return protocol.Uint16ToBytes(uint16(value))
+	case typeUint32:
+		return protocol.Uint32ToBytes(uint32(value))
+	case typeInt8:
+		return protocol.Int8ToBytes(int8(value))
+	case typeInt16:
+		return protocol.Int16ToBytes(int16(value))
+	case typeInt32:
+		return protocol.Int32ToBytes(int32(value))
+	case typeFloat:
+		return protocol.Float32ToBytes(float32(value))
+	}
+	return nil
+}
+
+// bytesToValue decodes the little endian representation of a log or param type
+func bytesToValue(kind valueType, b []byte) (float64, bool) {
+	if len(b) < kind.size() {
+		return 0, false
+	}
+
+	switch kind {
+	case typeUint8:
+		return float64(protocol.BytesToUint8(b).(uint8)), true
+	case typeUint16:
+		return float64(protocol.BytesToUint16(b).(uint16)), true
+	case typeUint32:
+		return float64(protocol.BytesToUint32(b).(uint32)), true
+	case typeInt8:
+		return float64(protocol.BytesToInt8(b).(int32)), true
+	case typeInt16:
+		return float64(protocol.BytesToInt16(b).(int32)), true
+	case typeInt32:
+		return float64(protocol.BytesToInt32(b).(int32)), true
+	case typeFloat:
+		return float64(protocol.BytesToFloat32(b).(float32)), true
+	}
+	return 0, false
+}
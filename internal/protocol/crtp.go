@@ -0,0 +1,40 @@
+// Package protocol holds the parts of CRTP, the protocol spoken by the Crazyflie firmware, which are shared by the
+// crazyflie package and the simulator of the crazysim package: the packet header and the encoding of the values.
+package protocol
+
+// Header is the first byte of a CRTP packet, which holds its port and channel
+type Header byte
+
+// Port is the firmware subsystem a CRTP packet is addressed to
+type Port byte
+
+const (
+	PortConsole    Port = 0x00
+	PortParam      Port = 0x02
+	PortSetpoint   Port = 0x03
+	PortMem        Port = 0x04
+	PortLog        Port = 0x05
+	PortPosition   Port = 0x06
+	PortSetpointHL Port = 0x08
+	PortPlatform   Port = 0x0D
+	PortLink       Port = 0x0F
+)
+
+// MaxData is the largest payload of a CRTP packet, following its header
+const MaxData = 30
+
+// MakeHeader returns the header of a packet on port and channel
+func MakeHeader(port Port, channel byte) byte {
+	var link byte = 3
+	return ((byte(port) & 0x0F) << 4) |
+		((link & 0x03) << 2) |
+		((channel & 0x03) << 0)
+}
+
+func (header Header) Channel() byte {
+	return (byte(header) >> 0) & 0x03
+}
+
+func (header Header) Port() Port {
+	return Port((byte(header) >> 4) & 0x0F)
+}
@@ -1,4 +1,4 @@
-package crazyflie
+package protocol
 
 import "math"
 import "encoding/binary"
@@ -6,42 +6,42 @@ import "encoding/binary"
 // here we have to use interface as the return everywhere since the functions need to fit into a generic map
 // everything is little endian
 
-func bytesToUint8(b []byte) interface{} {
+func BytesToUint8(b []byte) interface{} {
 	return uint8(b[0])
 }
 
-func bytesToUint16(b []byte) interface{} {
+func BytesToUint16(b []byte) interface{} {
 	return binary.LittleEndian.Uint16(b)
 }
 
-func bytesToUint32(b []byte) interface{} {
+func BytesToUint32(b []byte) interface{} {
 	return binary.LittleEndian.Uint32(b)
 }
 
-func bytesToUint64(b []byte) interface{} {
+func BytesToUint64(b []byte) interface{} {
 	return binary.LittleEndian.Uint64(b)
 }
 
-func bytesToInt8(b []byte) interface{} {
-	return int32(b[0])
+func BytesToInt8(b []byte) interface{} {
+	return int32(int8(b[0])) // sign extended
 }
 
-func bytesToInt16(b []byte) interface{} {
+func BytesToInt16(b []byte) interface{} {
 	_ = b[1]
-	return int32(uint32(b[0]) | (uint32(b[1]) << 8))
+	return int32(int16(uint16(b[0]) | (uint16(b[1]) << 8))) // sign extended
 }
 
-func bytesToInt32(b []byte) interface{} {
+func BytesToInt32(b []byte) interface{} {
 	_ = b[3]
 	return int32(uint32(b[0]) | (uint32(b[1]) << 8) | (uint32(b[2]) << 16) | (uint32(b[3]) << 24))
 }
 
-func bytesToFloat32(b []byte) interface{} {
+func BytesToFloat32(b []byte) interface{} {
 	bits := uint32(uint32(b[0]) | (uint32(b[1]) << 8) | (uint32(b[2]) << 16) | (uint32(b[3]) << 24))
 	return math.Float32frombits(bits)
 }
 
-func bytesToFloat16(b []byte) interface{} {
+func BytesToFloat16(b []byte) interface{} {
 	_ = b[1]
 	val := uint32(uint32(b[0]) | (uint32(b[1]) << 8))
 
@@ -70,37 +70,37 @@ func bytesToFloat16(b []byte) interface{} {
 	return math.Float32frombits(fp32)
 }
 
-func uint8ToBytes(val interface{}) []byte {
+func Uint8ToBytes(val interface{}) []byte {
 	v := val.(uint8)
 	return []byte{v}
 }
 
-func uint16ToBytes(val interface{}) []byte {
+func Uint16ToBytes(val interface{}) []byte {
 	v := val.(uint16)
 	return []byte{uint8(v & 0xFF), uint8((v >> 8) & 0xFF)}
 }
 
-func uint32ToBytes(val interface{}) []byte {
+func Uint32ToBytes(val interface{}) []byte {
 	v := val.(uint32)
 	return []byte{uint8(v & 0xFF), uint8((v >> 8) & 0xFF), uint8((v >> 16) & 0xFF), uint8((v >> 24) & 0xFF)}
 }
 
-func int8ToBytes(val interface{}) []byte {
+func Int8ToBytes(val interface{}) []byte {
 	v := val.(int8)
 	return []byte{uint8(v)}
 }
 
-func int16ToBytes(val interface{}) []byte {
+func Int16ToBytes(val interface{}) []byte {
 	v := val.(int16)
 	return []byte{uint8(v & 0xFF), uint8((v >> 8) & 0xFF)}
 }
 
-func int32ToBytes(val interface{}) []byte {
+func Int32ToBytes(val interface{}) []byte {
 	v := val.(int32)
 	return []byte{uint8(v & 0xFF), uint8((v >> 8) & 0xFF), uint8((v >> 16) & 0xFF), uint8((v >> 24) & 0xFF)}
 }
 
-func float32ToBytes(val interface{}) []byte {
+func Float32ToBytes(val interface{}) []byte {
 	f := val.(float32)
 	v := math.Float32bits(f)
 	return []byte{uint8(v & 0xFF), uint8((v >> 8) & 0xFF), uint8((v >> 16) & 0xFF), uint8((v >> 24) & 0xFF)}
@@ -0,0 +1,31 @@
+package protocol
+
+import "testing"
+
+func TestValueRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		value  interface{}
+		encode func(interface{}) []byte
+		decode func([]byte) interface{}
+		expect interface{}
+	}{
+		{uint8(200), Uint8ToBytes, BytesToUint8, uint8(200)},
+		{uint16(60000), Uint16ToBytes, BytesToUint16, uint16(60000)},
+		{uint32(4000000000), Uint32ToBytes, BytesToUint32, uint32(4000000000)},
+		{int8(-3), Int8ToBytes, BytesToInt8, int32(-3)}, // the signed integers are decoded as int32
+		{int16(-300), Int16ToBytes, BytesToInt16, int32(-300)},
+		{int32(-70000), Int32ToBytes, BytesToInt32, int32(-70000)},
+		{float32(-1.5), Float32ToBytes, BytesToFloat32, float32(-1.5)},
+	} {
+		if decoded := test.decode(test.encode(test.value)); decoded != test.expect {
+			t.Fatalf("%T %v decoded as %T %v", test.value, test.value, decoded, decoded)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	header := Header(MakeHeader(PortLog, 2))
+	if header.Port() != PortLog || header.Channel() != 2 {
+		t.Fatalf("header %x is port %d channel %d", byte(header), header.Port(), header.Channel())
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"sync"
 	"time"
 
@@ -14,8 +18,8 @@ import (
 	"github.com/mikehamer/crazyserver/crazyflie"
 	"github.com/mikehamer/crazyserver/crazyradio"
 	"github.com/mikehamer/crazyserver/crazyserver"
+	"github.com/mikehamer/crazyserver/radioshare"
 
-	"strconv"
 	"strings"
 
 	"github.com/urfave/cli"
@@ -40,7 +44,7 @@ func main() {
 				cli.StringFlag{
 					Name:  "address",
 					Value: "E7E7E7E701",
-					Usage: "Set the radio address (default is address: E7E7E7E701)",
+					Usage: "Set the radio addresses or link URIs, eg. E7E7E7E701-07,radio://0/80/250K/E7E7E7E7E7,usb://0 (default is address: E7E7E7E701)",
 				},
 			},
 			Action: testCommand,
@@ -59,7 +63,7 @@ func main() {
 				cli.StringFlag{
 					Name:  "address",
 					Value: "0",
-					Usage: "Set the radio address (default is bootloader address: 0)",
+					Usage: "Set the radio addresses or link URIs (default is bootloader address: 0)",
 				},
 				cli.BoolFlag{
 					Name:  "verify, v",
@@ -68,13 +72,119 @@ func main() {
 			},
 			Action: flashCommand,
 		},
+		{
+			Name:  "scan",
+			Usage: "Scans all channels and datarates for Crazyflies",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "address",
+					Value: "E7E7E7E7E7",
+					Usage: "The radio addresses to scan for, eg. E7E7E7E701-07,E7E7E7E7E7 (default is address: E7E7E7E7E7)",
+				},
+			},
+			Action: scanCommand,
+		},
+		{
+			Name:  "radio",
+			Usage: "Manages the Crazyradio dongles",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "Lists the Crazyradios with their firmware version and serial number",
+					Action: radioListCommand,
+				},
+				{
+					Name:      "bootloader",
+					Usage:     "Restarts a Crazyradio in its bootloader, to update its firmware",
+					ArgsUsage: "<serial>",
+					Action:    radioBootloaderCommand,
+				},
+			},
+		},
+		{
+			Name:  "radio-share",
+			Usage: "Serves the local Crazyradios to remote crazyservers, which reach their Crazyflies with share://<host>:<port>/<channel> URIs",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "127.0.0.1:7777",
+					Usage: "The TCP address to listen on (default is listen: 127.0.0.1:7777)",
+				},
+				cli.BoolFlag{
+					Name:  "public",
+					Usage: "Allow listening on a non-loopback address, which gives unauthenticated control of the radios to the network",
+				},
+			},
+			Action: radioShareCommand,
+		},
+		{
+			Name:  "capture",
+			Usage: "Connects to Crazyflies and records the radio traffic to a file, until the duration elapses or the command is interrupted",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "crazyradio.capture",
+					Usage: "The file the capture is written to (default is output: crazyradio.capture)",
+				},
+				cli.UintFlag{
+					Name:  "channel",
+					Value: 80,
+					Usage: "Set the radio channel (default is channel: 80)",
+				},
+				cli.StringFlag{
+					Name:  "address",
+					Value: "E7E7E7E7E7",
+					Usage: "Set the radio addresses or link URIs, eg. E7E7E7E701-07,radio://0/80/250K/E7E7E7E7E7 (default is address: E7E7E7E7E7)",
+				},
+				cli.DurationFlag{
+					Name:  "duration",
+					Value: 10 * time.Second,
+					Usage: "How long to capture (default is duration: 10s)",
+				},
+			},
+			Action: captureCommand,
+		},
+		{
+			Name:  "survey",
+			Usage: "Measures the interference on every channel, ranking the channels from the quietest",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "datarate",
+					Value: "2M",
+					Usage: "The datarate to survey at: 250K, 1M or 2M (default is datarate: 2M)",
+				},
+				cli.StringFlag{
+					Name:  "address",
+					Value: "E7E7E7E7E7",
+					Usage: "The address of the test packets, the retransmissions are only measured if a Crazyflie answers (default is address: E7E7E7E7E7)",
+				},
+				cli.UintFlag{
+					Name:  "packets",
+					Value: 50,
+					Usage: "The number of test packets sent on each channel (default is packets: 50)",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the report as JSON",
+				},
+			},
+			Action: surveyCommand,
+		},
 		crazyserver.ServeCommand,
 	}
 
 	// Initalize the radio and cache
+	// without a radio we can still serve simulated Crazyflies, and radios plugged in later are picked up, so this is not fatal
+	crazyradio.RadioEventsRegister(func(event crazyradio.RadioEvent) {
+		if event.Err != nil {
+			log.Printf("Crazyradio %d (usb %d:%d) %s (%s), %d in service", event.Dongle, event.Bus, event.Address, event.Type, event.Err, event.Radios)
+		} else {
+			log.Printf("Crazyradio %d (usb %d:%d) %s, %d in service", event.Dongle, event.Bus, event.Address, event.Type, event.Radios)
+		}
+	})
 	err := crazyradio.Start()
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Warning: %s", err)
 	}
 	defer crazyradio.Stop()
 	cache.Init()
@@ -82,62 +192,205 @@ func main() {
 	app.Run(os.Args)
 }
 
+// interruptContext returns a context which is cancelled when the command is interrupted
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+
+	return ctx, cancel
+}
+
 func testCommand(context *cli.Context) error {
 	// connect to each crazyflie
-	channel := uint8(context.Uint("channel"))
-	addresses := strings.Split(context.String("address"), ",")
+	uris, err := parseURIs(context.String("address"), uint8(context.Uint("channel")))
+	if err != nil {
+		return err
+	}
 
-	// a set to hold the unique addresses that we need to flash
-	addressSet := make(map[uint64]bool)
-	// parse the address string, allowing for formatting
-	for _, address := range addresses {
-		addressrange := strings.Split(address, "-") // eg we handle the case E7E7E7E701-07, if there is no -, this should still work.
+	ctx, cancel := interruptContext()
+	defer cancel()
 
-		lowaddressstring := strings.TrimPrefix(addressrange[0], "0x") // trim any leading hex prefix
+	// Prepare to connect to multiple crazyflies for parallel flashing
+	for _, uri := range uris {
+		fmt.Printf("%s: ", uri)
 
-		lowaddress, err := strconv.ParseUint(lowaddressstring, 16, 64)
+		// connect to each crazyflie
+		cf, err := crazyflie.Connect(ctx, uri)
 		if err != nil {
-			log.Printf("Error parsing address %s", lowaddressstring)
+			fmt.Printf("Error (%s)\n", err)
 			continue
 		}
-
-		highaddresslowpart := strings.TrimPrefix(addressrange[len(addressrange)-1], "0x")          // eg 07
-		highaddresshighpart := lowaddressstring[0 : len(lowaddressstring)-len(highaddresslowpart)] // eg E7E7E7E7 | 01
-		highaddress, err := strconv.ParseUint(highaddresshighpart+highaddresslowpart, 16, 64)
+		err = cf.TOCGetLists(ctx)
 		if err != nil {
-			log.Printf("Error parsing address %s", highaddresshighpart+highaddresslowpart)
+			fmt.Printf("Error (%s)\n", err)
 			continue
 		}
+		fmt.Println("Success")
+	}
 
-		for i := lowaddress; i <= highaddress; i++ {
-			addressSet[i] = true
-		}
+	return nil
+}
+
+func scanCommand(context *cli.Context) error {
+	addresses, err := crazyradio.ParseAddresses(context.String("address"))
+	if err != nil {
+		return err
 	}
 
-	// now convert the set into a slice for easier processing
-	addressSlice := make([]uint64, len(addressSet))
-	addressIdx := 0
-	for k := range addressSet {
-		addressSlice[addressIdx] = k
-		addressIdx++
+	results, err := crazyradio.Scan(addresses)
+	if err != nil {
+		return err
 	}
 
-	// Prepare to connect to multiple crazyflies for parallel flashing
-	for _, address := range addressSlice {
-		fmt.Printf("0x%X: ", address)
+	for _, result := range results {
+		fmt.Println(crazyflie.LinkURI{Scheme: "radio", Channel: result.Channel, Datarate: result.Datarate, Address: result.Address})
+	}
+	fmt.Printf("Found %d Crazyflies\n", len(results))
 
-		// connect to each crazyflie
-		cf, err := crazyflie.Connect(address, channel)
-		if err != nil {
-			fmt.Printf("Error (%s)\n", address, err)
-			continue
-		}
-		err = cf.LogTOCGetList()
+	return nil
+}
+
+func radioListCommand(context *cli.Context) error {
+	radios := crazyradio.Radios()
+
+	fmt.Printf("%5s %-24s %7s %7s\n", "index", "serial", "version", "usb")
+	for _, radio := range radios {
+		fmt.Printf("%5d %-24s %7s %3d:%-3d\n", radio.Index, radio.Serial, radio.Version, radio.Bus, radio.Address)
+	}
+	fmt.Printf("Found %d Crazyradios\n", len(radios))
+
+	return nil
+}
+
+func radioBootloaderCommand(context *cli.Context) error {
+	if len(context.Args()) != 1 {
+		return fmt.Errorf("you should provide the serial number of the Crazyradio")
+	}
+
+	return crazyradio.RadioBootloader(context.Args().Get(0))
+}
+
+func radioShareCommand(context *cli.Context) error {
+	if !context.Bool("public") && !isLoopbackAddress(context.String("listen")) {
+		return fmt.Errorf("%s is reachable from the network, pass --public to serve the radios on it", context.String("listen"))
+	}
+
+	listener, err := net.Listen("tcp", context.String("listen"))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// stop serving on interrupt, so that the radios are closed cleanly
+	ctx, cancel := interruptContext()
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Printf("radio-share: serving %d Crazyradios on %s", crazyradio.RadioCount(), listener.Addr())
+	radioshare.Serve(listener)
+	return nil
+}
+
+// isLoopbackAddress reports whether the TCP address (host:port) is only reachable from this machine
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() // an empty host listens on every interface
+}
+
+func captureCommand(context *cli.Context) error {
+	uris, err := parseURIs(context.String("address"), uint8(context.Uint("channel")))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(context.String("output"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// capture from before the connection, such that the whole session is recorded
+	err = crazyradio.CaptureStart(file)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	for _, uri := range uris {
+		cf, err := crazyflie.Connect(ctx, uri)
 		if err != nil {
-			fmt.Printf("Error (%s)\n", address, err)
+			log.Printf("Error connecting to %s: %s", uri, err)
 			continue
 		}
-		fmt.Println("Success")
+		defer cf.DisconnectImmediately()
+	}
+
+	fmt.Printf("Capturing to %s ...\n", context.String("output"))
+
+	select {
+	case <-time.After(context.Duration("duration")):
+	case <-ctx.Done():
+	}
+
+	dropped, err := crazyradio.CaptureStop()
+	if dropped > 0 {
+		log.Printf("Warning: %d records dropped", dropped)
+	}
+	return err
+}
+
+func surveyCommand(context *cli.Context) error {
+	datarate, err := crazyradio.ParseDatarate(context.String("datarate"))
+	if err != nil {
+		return err
+	}
+
+	addresses, err := crazyradio.ParseAddresses(context.String("address"))
+	if err != nil {
+		return err
+	}
+	if len(addresses) != 1 {
+		return fmt.Errorf("survey a single address, not %s", context.String("address"))
+	}
+	if context.Uint("packets") == 0 {
+		return fmt.Errorf("at least one packet per channel is needed")
+	}
+
+	results, err := crazyradio.Survey(datarate, addresses[0], int(context.Uint("packets")))
+	if err != nil {
+		return err
+	}
+
+	if context.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(results)
+	}
+
+	fmt.Printf("%4s %7s %8s %8s %8s %9s\n", "rank", "channel", "datarate", "acked", "power", "retries")
+	for rank, result := range results {
+		fmt.Printf("%4d %7d %8s %7.0f%% %7.0f%% %9.2f\n", rank+1, result.Channel, result.Datarate,
+			100*float64(result.Acked)/float64(result.Sent), 100*result.PowerDetectorRatio, result.MeanRetries)
 	}
 
 	return nil
@@ -145,9 +398,6 @@ func testCommand(context *cli.Context) error {
 
 func flashCommand(context *cli.Context) error {
 
-	channel := uint8(context.Uint("channel"))
-	addresses := strings.Split(context.String("address"), ",")
-
 	// enough arguments?
 	if len(context.Args()) != 2 {
 		log.Fatal("You should provide image and target.")
@@ -167,52 +417,26 @@ func flashCommand(context *cli.Context) error {
 		return err
 	}
 
-	// a set to hold the unique addresses that we need to flash
-	addressSet := make(map[uint64]bool)
-	// parse the address string, allowing for formatting
-	for _, address := range addresses {
-		addressrange := strings.Split(address, "-") // eg we handle the case E7E7E7E701-07, if there is no -, this should still work.
-
-		lowaddressstring := strings.TrimPrefix(addressrange[0], "0x") // trim any leading hex prefix
-
-		lowaddress, err := strconv.ParseUint(lowaddressstring, 16, 64)
-		if err != nil {
-			log.Printf("Error parsing address %s", lowaddressstring)
-			continue
-		}
-
-		highaddresslowpart := strings.TrimPrefix(addressrange[len(addressrange)-1], "0x")          // eg 07
-		highaddresshighpart := lowaddressstring[0 : len(lowaddressstring)-len(highaddresslowpart)] // eg E7E7E7E7 | 01
-		highaddress, err := strconv.ParseUint(highaddresshighpart+highaddresslowpart, 16, 64)
-		if err != nil {
-			log.Printf("Error parsing address %s", highaddresshighpart+highaddresslowpart)
-			continue
-		}
-
-		for i := lowaddress; i <= highaddress; i++ {
-			addressSet[i] = true
-		}
+	uris, err := parseURIs(context.String("address"), uint8(context.Uint("channel")))
+	if err != nil {
+		return err
 	}
 
-	// now convert the set into a slice for easier processing
-	addressSlice := make([]uint64, len(addressSet))
-	addressIdx := 0
-	for k := range addressSet {
-		addressSlice[addressIdx] = k
-		addressIdx++
-	}
+	// interrupting stops the flashing, leaving the crazyflies in their bootloader
+	ctx, cancel := interruptContext()
+	defer cancel()
 
 	// Prepare to connect to multiple crazyflies for parallel flashing
-	progressBars := make([]*pb.ProgressBar, 0, len(addressSlice))
-	progressChannels := make([]chan int, 0, len(addressSlice))
-	crazyflies := make([]*crazyflie.Crazyflie, 0, len(addressSlice))
+	progressBars := make([]*pb.ProgressBar, 0, len(uris))
+	progressChannels := make([]chan int, 0, len(uris))
+	crazyflies := make([]*crazyflie.Crazyflie, 0, len(uris))
 
-	for _, address := range addressSlice {
+	for _, uri := range uris {
 
 		// connect to each crazyflie
-		cf, err := crazyflie.Connect(address, channel)
+		cf, err := crazyflie.Connect(ctx, uri)
 		if err != nil {
-			log.Printf("Error connecting to 0x%X: %s", address, err)
+			log.Printf("Error connecting to %s: %s", uri, err)
 			continue
 		}
 
@@ -220,7 +444,7 @@ func flashCommand(context *cli.Context) error {
 		crazyflies = append(crazyflies, cf)
 
 		// for each successful connection, initiate a progress bar
-		progressBar := pb.New(len(flashData)).Prefix(fmt.Sprintf("Flashing 0x%X", address))
+		progressBar := pb.New(len(flashData)).Prefix(fmt.Sprintf("Flashing 0x%X", cf.FirmwareAddress()))
 		progressBar.ShowTimeLeft = true
 		progressBar.SetUnits(pb.U_BYTES)
 		progressBars = append(progressBars, progressBar)
@@ -257,12 +481,12 @@ func flashCommand(context *cli.Context) error {
 
 			switch targetString {
 			case "stm32-fw":
-				err = cf.ReflashSTM32(flashData, context.Bool("verify"), pc)
+				err = cf.ReflashSTM32(ctx, flashData, context.Bool("verify"), pc)
 				if err != nil {
 					log.Printf("0x%X: %s", cf.FirmwareAddress(), err)
 				}
 			case "nrf51-fw":
-				err = cf.ReflashNRF51(flashData, context.Bool("verify"), pc)
+				err = cf.ReflashNRF51(ctx, flashData, context.Bool("verify"), pc)
 				if err != nil {
 					log.Printf("0x%X: %s", cf.FirmwareAddress(), err)
 				}
@@ -282,3 +506,31 @@ func flashCommand(context *cli.Context) error {
 
 	return nil
 }
+
+// parseURIs expands a comma separated list of link URIs and hexadecimal addresses or address ranges into link URIs.
+// Plain addresses are reached on channel at the default datarate.
+func parseURIs(addresses string, channel uint8) ([]string, error) {
+	uris := make([]string, 0)
+
+	for _, element := range strings.Split(addresses, ",") {
+		if strings.Contains(element, "://") {
+			_, err := crazyflie.ParseURI(element)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", err, element)
+			}
+			uris = append(uris, element)
+			continue
+		}
+
+		addressSlice, err := crazyradio.ParseAddresses(element)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, address := range addressSlice {
+			uris = append(uris, crazyflie.LinkURI{Scheme: "radio", Channel: channel, Datarate: crazyradio.RadioDatarate_2MPS, Address: address}.String())
+		}
+	}
+
+	return uris, nil
+}
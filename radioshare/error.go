@@ -0,0 +1,39 @@
+package radioshare
+
+import (
+	"fmt"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+type shareError uint8
+
+func (e shareError) Error() string {
+	return fmt.Sprintf("radioshare: %s", shareErrorString[e])
+}
+
+const (
+	ErrorDisconnected shareError = iota
+	ErrorMessageTooLong
+)
+
+var shareErrorString = map[shareError]string{
+	ErrorDisconnected:   "disconnected from the radio-share server",
+	ErrorMessageTooLong: "message too long",
+}
+
+// remoteError is an error returned by the radio-share server, eg. a crazyflie not responding
+type remoteError string
+
+func (e remoteError) Error() string {
+	return string(e)
+}
+
+// remoteErrorParse returns the error encoded by the server, as the crazyradio error it names if any,
+// such that a crazyflie not responding is reported as on a local link
+func remoteErrorParse(payload []byte) error {
+	if string(payload) == crazyradio.ErrorNoResponse.Error() {
+		return crazyradio.ErrorNoResponse
+	}
+	return remoteError(payload)
+}
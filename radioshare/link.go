@@ -0,0 +1,212 @@
+package radioshare
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// Link reaches Crazyflies through the Crazyradios of a remote crazyserver running radio-share.
+// It implements the same interface as the Crazyradio link and can be passed to crazyflie.ConnectLink.
+type Link struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	closed    chan bool
+
+	lock      sync.Mutex
+	callbacks map[crazyflieKey]func([]byte)
+	waiters   map[uint32]chan message // the requests waiting for their reply, by request id
+	nextID    uint32
+
+	// the latest link statistics received, see LinkStats
+	stats           map[crazyflieKey]crazyradio.LinkStats
+	statsRefreshing map[crazyflieKey]bool
+}
+
+// how long the link statistics are waited for, before asking again
+const statsTimeout = time.Second
+
+// Dial connects to the radio-share server at address (host:port)
+func Dial(address string) (*Link, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &Link{
+		conn:            conn,
+		closed:          make(chan bool),
+		callbacks:       make(map[crazyflieKey]func([]byte)),
+		waiters:         make(map[uint32]chan message),
+		stats:           make(map[crazyflieKey]crazyradio.LinkStats),
+		statsRefreshing: make(map[crazyflieKey]bool),
+	}
+	go link.readThread()
+
+	return link, nil
+}
+
+// Close disconnects from the radio-share server, which stops serving the crazyflies of the link
+func (link *Link) Close() {
+	link.conn.Close()
+	<-link.closed
+}
+
+// Closed is closed once the link has been disconnected from the server
+func (link *Link) Closed() <-chan bool {
+	return link.closed
+}
+
+func (link *Link) send(m message) error {
+	link.writeLock.Lock()
+	defer link.writeLock.Unlock()
+	return writeMessage(link.conn, m)
+}
+
+func (link *Link) readThread() {
+	defer close(link.closed)
+
+	for {
+		m, err := readMessage(link.conn)
+		if err != nil {
+			link.conn.Close()
+			return
+		}
+
+		link.lock.Lock()
+		switch m.kind {
+		case messageResponse:
+			if callback, ok := link.callbacks[m.key()]; ok {
+				callback(m.payload) // from the read thread, such that the responses are delivered in order
+			}
+		case messageRegistered, messageEmpty, messageStats:
+			// the reply to a request which was given up on has no waiter left
+			if reply, ok := link.waiters[m.id]; ok {
+				delete(link.waiters, m.id)
+				reply <- m
+			}
+		}
+		link.lock.Unlock()
+	}
+}
+
+// request sends m with a new request id and waits for the reply carrying the same id
+func (link *Link) request(ctx context.Context, m message) (message, error) {
+	reply := make(chan message, 1)
+
+	link.lock.Lock()
+	link.nextID++
+	m.id = link.nextID
+	link.waiters[m.id] = reply
+	link.lock.Unlock()
+
+	defer func() {
+		link.lock.Lock()
+		delete(link.waiters, m.id)
+		link.lock.Unlock()
+	}()
+
+	if err := link.send(m); err != nil {
+		return message{}, err
+	}
+
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-link.closed:
+		return message{}, ErrorDisconnected
+	case <-ctx.Done():
+		return message{}, ctx.Err()
+	}
+}
+
+func (link *Link) CrazyflieRegister(ctx context.Context, channel uint8, datarate crazyradio.RadioDatarate, address uint64, responseCallback func([]byte)) error {
+	key := crazyflieKey{channel, address}
+
+	link.lock.Lock()
+	link.callbacks[key] = responseCallback
+	link.lock.Unlock()
+
+	// the server waits at most until our deadline, such that it gives up about when we do
+	reply, err := link.request(ctx, message{kind: messageRegister, channel: channel, datarate: datarate, address: address, payload: registerTimeout(ctx.Deadline())})
+	if err == nil && len(reply.payload) > 0 {
+		err = remoteErrorParse(reply.payload)
+	}
+	if ctx.Err() != nil && err == ctx.Err() {
+		link.send(message{kind: messageRemove, channel: channel, address: address}) // cancels the registration on the server
+		if err == context.DeadlineExceeded {
+			err = crazyradio.ErrorNoResponse
+		}
+	}
+
+	if err != nil {
+		link.lock.Lock()
+		delete(link.callbacks, key)
+		link.lock.Unlock()
+	}
+	return err
+}
+
+func (link *Link) CrazyflieRemove(channel uint8, address uint64) {
+	link.lock.Lock()
+	delete(link.callbacks, crazyflieKey{channel, address})
+	delete(link.stats, crazyflieKey{channel, address})
+	link.lock.Unlock()
+
+	link.send(message{kind: messageRemove, channel: channel, address: address})
+}
+
+// PacketSend queues a packet on the server, a packet dropped there because the queue is full is counted in the LinkStats
+func (link *Link) PacketSend(channel uint8, address uint64, packet []byte) error {
+	return link.send(message{kind: messageSend, channel: channel, address: address, payload: packet})
+}
+
+func (link *Link) PacketSendPriority(channel uint8, address uint64, packet []byte) {
+	link.send(message{kind: messageSendPriority, channel: channel, address: address, payload: packet})
+}
+
+func (link *Link) PacketQueueWaitForEmpty(ctx context.Context, channel uint8, address uint64) error {
+	_, err := link.request(ctx, message{kind: messageWaitForEmpty, channel: channel, address: address})
+	return err
+}
+
+// LinkStats returns the latest link statistics received from the server without waiting for it, such that a slow
+// or unreachable server does not hold up the caller, and asks the server for newer ones. They are zero until the
+// server first answers.
+func (link *Link) LinkStats(channel uint8, address uint64) crazyradio.LinkStats {
+	key := crazyflieKey{channel, address}
+
+	link.lock.Lock()
+	stats := link.stats[key]
+	refresh := !link.statsRefreshing[key]
+	link.statsRefreshing[key] = true
+	link.lock.Unlock()
+
+	if refresh {
+		go link.statsRefresh(key)
+	}
+	return stats
+}
+
+func (link *Link) statsRefresh(key crazyflieKey) {
+	ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+	defer cancel()
+
+	reply, err := link.request(ctx, message{kind: messageLinkStats, channel: key.channel, address: key.address})
+
+	link.lock.Lock()
+	defer link.lock.Unlock()
+
+	delete(link.statsRefreshing, key)
+	if err != nil {
+		return
+	}
+	var stats crazyradio.LinkStats
+	if json.Unmarshal(reply.payload, &stats) == nil {
+		link.stats[key] = stats
+	}
+}
@@ -0,0 +1,117 @@
+package radioshare
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// Messages are framed with a fixed header: type, channel, datarate, address (8 bytes little endian),
+// request id (4 bytes little endian) and the length of the payload (2 bytes little endian), followed by the payload.
+// The requests which are answered carry an id chosen by the remote link, which the server echoes in the reply.
+const headerLength = 1 + 1 + 1 + 8 + 4 + 2
+
+type messageType uint8
+
+// requests, from the remote link to the radio-share server
+const (
+	messageRegister     messageType = 0x01 // start communicating with a crazyflie, the payload is the timeout (see registerTimeout)
+	messageRemove       messageType = 0x02 // stop communicating with a crazyflie
+	messageSend         messageType = 0x03 // queue the payload
+	messageSendPriority messageType = 0x04 // queue the payload with priority
+	messageWaitForEmpty messageType = 0x05 // answered once the packet queue of the crazyflie is empty
+	messageLinkStats    messageType = 0x06 // answered with the link statistics of the crazyflie
+)
+
+// replies and events, from the radio-share server to the remote link
+const (
+	messageRegistered messageType = 0x81 // the payload is the registration error, empty on success
+	messageResponse   messageType = 0x82 // the payload is a response (acknowledgement payload) from the crazyflie
+	messageEmpty      messageType = 0x85 // the packet queue of the crazyflie is empty
+	messageStats      messageType = 0x86 // the payload is the JSON encoded link statistics
+)
+
+// registerTimeout encodes how long the server waits for a crazyflie to respond to a registration, the time left
+// until the deadline in milliseconds (4 bytes little endian, at least 1 once the deadline has passed),
+// or nothing for the default timeout of the server
+func registerTimeout(deadline time.Time, ok bool) []byte {
+	if !ok {
+		return nil
+	}
+	milliseconds := time.Until(deadline) / time.Millisecond
+	if milliseconds < 1 {
+		milliseconds = 1
+	} else if milliseconds > math.MaxUint32 {
+		milliseconds = math.MaxUint32
+	}
+	timeout := make([]byte, 4)
+	binary.LittleEndian.PutUint32(timeout, uint32(milliseconds))
+	return timeout
+}
+
+func registerTimeoutParse(payload []byte) (time.Duration, bool) {
+	if len(payload) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.LittleEndian.Uint32(payload)) * time.Millisecond, true
+}
+
+type message struct {
+	kind     messageType
+	channel  uint8
+	datarate crazyradio.RadioDatarate
+	address  uint64
+	id       uint32 // of the request, in a request and its reply
+	payload  []byte
+}
+
+func (m message) key() crazyflieKey {
+	return crazyflieKey{m.channel, m.address}
+}
+
+type crazyflieKey struct {
+	channel uint8
+	address uint64
+}
+
+func readMessage(r io.Reader) (message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return message{}, err
+	}
+
+	m := message{
+		kind:     messageType(header[0]),
+		channel:  header[1],
+		datarate: crazyradio.RadioDatarate(header[2]),
+		address:  binary.LittleEndian.Uint64(header[3:11]),
+		id:       binary.LittleEndian.Uint32(header[11:15]),
+		payload:  make([]byte, binary.LittleEndian.Uint16(header[15:17])),
+	}
+	if _, err := io.ReadFull(r, m.payload); err != nil {
+		return message{}, err
+	}
+
+	return m, nil
+}
+
+func writeMessage(w io.Writer, m message) error {
+	if len(m.payload) > 0xFFFF {
+		return ErrorMessageTooLong
+	}
+
+	buffer := make([]byte, headerLength+len(m.payload))
+	buffer[0] = byte(m.kind)
+	buffer[1] = m.channel
+	buffer[2] = byte(m.datarate)
+	binary.LittleEndian.PutUint64(buffer[3:11], m.address)
+	binary.LittleEndian.PutUint32(buffer[11:15], m.id)
+	binary.LittleEndian.PutUint16(buffer[15:17], uint16(len(m.payload)))
+	copy(buffer[headerLength:], m.payload)
+
+	_, err := w.Write(buffer)
+	return err
+}
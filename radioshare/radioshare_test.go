@@ -0,0 +1,198 @@
+package radioshare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+const (
+	testChannel = 80
+	testAddress = 0xE7E7E7E701
+)
+
+func TestMessageFraming(t *testing.T) {
+	var buffer bytes.Buffer
+	sent := message{kind: messageSend, channel: testChannel, datarate: crazyradio.RadioDatarate_250KPS, address: testAddress, id: 7, payload: []byte{1, 2, 3}}
+	if err := writeMessage(&buffer, sent); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := readMessage(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.kind != sent.kind || received.channel != sent.channel || received.datarate != sent.datarate ||
+		received.address != sent.address || received.id != sent.id || !bytes.Equal(received.payload, sent.payload) {
+		t.Fatalf("received %+v, expecting %+v", received, sent)
+	}
+
+	if err := writeMessage(&buffer, message{payload: make([]byte, 0x10000)}); err != ErrorMessageTooLong {
+		t.Fatalf("wrote a message too long: %v", err)
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	for _, test := range []struct {
+		deadline time.Time
+		ok       bool
+		min, max time.Duration
+	}{
+		{time.Now().Add(2 * time.Second), true, time.Second, 2 * time.Second},
+		{time.Now().Add(-time.Hour), true, time.Millisecond, time.Millisecond}, // passed, rather than wrapping around
+		{time.Now().Add(100 * 24 * time.Hour), true, 49 * 24 * time.Hour, 50 * 24 * time.Hour},
+	} {
+		timeout, ok := registerTimeoutParse(registerTimeout(test.deadline, test.ok))
+		if !ok || timeout < test.min || timeout > test.max {
+			t.Fatalf("deadline in %v encoded as %v, expecting %v to %v", time.Until(test.deadline), timeout, test.min, test.max)
+		}
+	}
+
+	if _, ok := registerTimeoutParse(registerTimeout(time.Time{}, false)); ok {
+		t.Fatal("a timeout was encoded without a deadline")
+	}
+}
+
+// serve starts a radio-share server without radios on the loopback interface, and connects a link to it
+func serve(t *testing.T) *Link {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeManager(listener, crazyradio.NewManager())
+
+	link, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		link.Close()
+		listener.Close()
+	})
+	return link
+}
+
+func TestLoopback(t *testing.T) {
+	link := serve(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := link.CrazyflieRegister(ctx, testChannel, crazyradio.RadioDatarate_2MPS, testAddress, func([]byte) {}); err != crazyradio.ErrorNoResponse {
+		t.Fatalf("registered a crazyflie without radios: %v", err)
+	}
+
+	// the requests about a crazyflie which is not registered are answered straight away
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := link.PacketQueueWaitForEmpty(ctx, testChannel, testAddress); err != nil {
+		t.Fatal(err)
+	}
+	if err := link.PacketSend(testChannel, testAddress, []byte{0xFF}); err != nil {
+		t.Fatal(err)
+	}
+	link.LinkStats(testChannel, testAddress)
+
+	link.Close()
+	select {
+	case <-link.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("the link did not close")
+	}
+	if err := link.PacketQueueWaitForEmpty(context.Background(), testChannel, testAddress); err == nil {
+		t.Fatal("request answered on a closed link")
+	}
+}
+
+// a reply which arrives after its request was given up on is not taken for the reply to the next request
+func TestStaleReply(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// a slow server, answering the requests to wait for empty queues after 100ms
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		for {
+			m, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			if m.kind == messageWaitForEmpty {
+				time.AfterFunc(100*time.Millisecond, func() {
+					writeMessage(conn, message{kind: messageEmpty, channel: m.channel, address: m.address, id: m.id})
+				})
+			}
+		}
+	}()
+
+	link, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer link.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := link.PacketQueueWaitForEmpty(ctx, testChannel, testAddress); err != context.DeadlineExceeded {
+		t.Fatalf("request not given up on: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if err := link.PacketQueueWaitForEmpty(context.Background(), testChannel, testAddress); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 80*time.Millisecond {
+		t.Fatal("the reply to the first request was taken for the reply to the second")
+	}
+
+	// the statistics are served from the cached copy, without waiting for the server
+	start = time.Now()
+	link.LinkStats(testChannel, testAddress)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Fatal("the link statistics waited for the server")
+	}
+}
+
+// the responses a remote link does not keep up with are counted in its link statistics
+func TestUndelivered(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	key := crazyflieKey{testChannel, testAddress}
+	sc := &shareConnection{
+		manager:     crazyradio.NewManager(),
+		conn:        server,
+		ctx:         context.Background(),
+		responses:   make(chan message, 2),
+		crazyflies:  map[crazyflieKey]bool{key: true},
+		undelivered: make(map[crazyflieKey]uint64),
+	}
+	for i := 0; i < 5; i++ {
+		sc.respond(key, []byte{byte(i)})
+	}
+
+	go sc.handle(message{kind: messageLinkStats, channel: key.channel, address: key.address, id: 1})
+	reply, err := readMessage(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats crazyradio.LinkStats
+	if err := json.Unmarshal(reply.payload, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if reply.id != 1 || stats.Undelivered != 3 {
+		t.Fatalf("reply %d with %d undelivered, expecting reply 1 with 3", reply.id, stats.Undelivered)
+	}
+}
@@ -0,0 +1,203 @@
+package radioshare
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/mikehamer/crazyserver/crazyradio"
+)
+
+// Serve accepts remote links on listener and serves their crazyflies with the local Crazyradios (see crazyradio.Start).
+// It returns when the listener is closed.
+func Serve(listener net.Listener) error {
+	return ServeManager(listener, crazyradio.DefaultManager)
+}
+
+// ServeManager is Serve with the Crazyradios of manager
+func ServeManager(listener net.Listener, manager *crazyradio.Manager) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConnection(conn, manager)
+	}
+}
+
+// the responses waiting to be written to a remote link, beyond which they are dropped rather than stalling the radio,
+// and counted in the link statistics of the crazyflie (see LinkStats.Undelivered)
+const responseBacklog = 256
+
+// a connection from a remote link
+type shareConnection struct {
+	manager   *crazyradio.Manager
+	conn      net.Conn
+	writeLock sync.Mutex
+	ctx       context.Context // done once the remote link has gone away
+	responses chan message    // the responses of the crazyflies, in the order they were received, see responseThread
+
+	lock          sync.Mutex
+	crazyflies    map[crazyflieKey]bool               // the crazyflies registered by the remote link
+	registrations map[crazyflieKey]context.CancelFunc // the registrations in progress
+	undelivered   map[crazyflieKey]uint64             // the responses dropped because the backlog was full
+}
+
+func serveConnection(conn net.Conn, manager *crazyradio.Manager) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc := &shareConnection{
+		manager:       manager,
+		conn:          conn,
+		ctx:           ctx,
+		responses:     make(chan message, responseBacklog),
+		crazyflies:    make(map[crazyflieKey]bool),
+		registrations: make(map[crazyflieKey]context.CancelFunc),
+		undelivered:   make(map[crazyflieKey]uint64),
+	}
+	log.Printf("radio-share: %s connected", conn.RemoteAddr())
+
+	go sc.responseThread()
+
+	for {
+		m, err := readMessage(conn)
+		if err != nil {
+			break
+		}
+		sc.handle(m)
+	}
+
+	// the crazyflies of a remote link which went away are no longer served
+	cancel()
+	sc.lock.Lock()
+	for key := range sc.crazyflies {
+		sc.manager.CrazyflieRemove(key.channel, key.address)
+	}
+	sc.crazyflies = nil
+	sc.lock.Unlock()
+
+	conn.Close()
+	log.Printf("radio-share: %s disconnected", conn.RemoteAddr())
+}
+
+func (sc *shareConnection) send(m message) {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+	writeMessage(sc.conn, m) // a failed write shows as a failed read, which closes the connection
+}
+
+// respond queues a response of a crazyflie for the remote link, from the radio thread
+func (sc *shareConnection) respond(key crazyflieKey, resp []byte) {
+	select {
+	case sc.responses <- message{kind: messageResponse, channel: key.channel, address: key.address, payload: resp}:
+	default: // the remote link does not keep up
+		sc.lock.Lock()
+		sc.undelivered[key]++
+		sc.lock.Unlock()
+	}
+}
+
+// responseThread writes the responses of the crazyflies to the remote link, off the radio threads
+func (sc *shareConnection) responseThread() {
+	for {
+		select {
+		case <-sc.ctx.Done():
+			return
+		case m := <-sc.responses:
+			sc.send(m)
+		}
+	}
+}
+
+func (sc *shareConnection) handle(m message) {
+	if m.kind == messageRegister {
+		go sc.register(m)
+		return
+	}
+
+	// a remote link only reaches the crazyflies it has registered, packets for others would never be sent
+	sc.lock.Lock()
+	registered := sc.crazyflies[m.key()]
+	sc.lock.Unlock()
+
+	switch m.kind {
+	case messageRemove:
+		sc.lock.Lock()
+		if cancel, ok := sc.registrations[m.key()]; ok {
+			cancel() // the remote link gave up on the registration
+		}
+		sc.lock.Unlock()
+		if registered {
+			sc.lock.Lock()
+			delete(sc.crazyflies, m.key())
+			delete(sc.undelivered, m.key())
+			sc.lock.Unlock()
+			sc.manager.CrazyflieRemove(m.channel, m.address)
+		}
+	case messageSend:
+		if registered {
+			sc.manager.PacketSend(m.channel, m.address, m.payload) // a dropped packet is counted in the link statistics
+		}
+	case messageSendPriority:
+		if registered {
+			sc.manager.PacketSendPriority(m.channel, m.address, m.payload)
+		}
+	case messageWaitForEmpty:
+		go func() {
+			if registered {
+				sc.manager.PacketQueueWaitForEmpty(sc.ctx, m.channel, m.address)
+			}
+			sc.send(message{kind: messageEmpty, channel: m.channel, address: m.address, id: m.id})
+		}()
+	case messageLinkStats:
+		var stats crazyradio.LinkStats
+		if registered {
+			stats = sc.manager.LinkStatsGet(m.channel, m.address)
+			sc.lock.Lock()
+			stats.Undelivered = sc.undelivered[m.key()]
+			sc.lock.Unlock()
+		}
+		payload, _ := json.Marshal(stats)
+		sc.send(message{kind: messageStats, channel: m.channel, address: m.address, id: m.id, payload: payload})
+	}
+}
+
+func (sc *shareConnection) register(m message) {
+	// without a timeout from the remote link, crazyradio.CrazyflieRegister applies its default
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout, ok := registerTimeoutParse(m.payload); ok {
+		ctx, cancel = context.WithTimeout(sc.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(sc.ctx)
+	}
+	defer cancel()
+
+	sc.lock.Lock()
+	sc.registrations[m.key()] = cancel
+	sc.lock.Unlock()
+
+	err := sc.manager.CrazyflieRegister(ctx, m.channel, m.datarate, m.address, func(resp []byte) {
+		sc.respond(m.key(), resp)
+	})
+
+	reply := message{kind: messageRegistered, channel: m.channel, address: m.address, id: m.id}
+	sc.lock.Lock()
+	delete(sc.registrations, m.key())
+	sc.lock.Unlock()
+	if err != nil {
+		reply.payload = []byte(err.Error())
+	} else {
+		sc.lock.Lock()
+		if sc.crazyflies != nil {
+			sc.crazyflies[m.key()] = true
+		} else {
+			sc.manager.CrazyflieRemove(m.channel, m.address) // the remote link went away while registering
+		}
+		sc.lock.Unlock()
+	}
+	sc.send(reply)
+}